@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Operations granted by the rules of an authorization policy.
+const (
+	opRead   = "read"
+	opWrite  = "write"
+	opDelete = "delete"
+)
+
+// authRule allows operations on the keys starting with Prefix. An empty
+// prefix covers every key. Keys of named buckets are matched as
+// {bucket}/{key}.
+type authRule struct {
+	Prefix string   `json:"prefix"`
+	Ops    []string `json:"ops"`
+}
+
+type authClient struct {
+	Name  string     `json:"name"`
+	Key   string     `json:"key"`
+	Rules []authRule `json:"rules"`
+}
+
+// authPolicy maps API keys to the operations allowed to their clients. A nil
+// policy lets every request through.
+type authPolicy struct {
+	Clients []*authClient `json:"clients"`
+
+	// byKey finds clients by a hash of their key, so that looking a key up
+	// takes the same time however much of it matches a known one.
+	byKey map[[sha256.Size]byte]*authClient
+}
+
+type authClientKey struct{}
+
+// loadAuthPolicy reads a policy from a JSON file like
+//
+//	{"clients": [{"name": "team", "key": "secret",
+//	  "rules": [{"prefix": "team", "ops": ["read", "write", "delete"]}]}]}
+func loadAuthPolicy(path string) (*authPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var p authPolicy
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("auth policy %s: %w", path, err)
+	}
+	p.byKey = make(map[[sha256.Size]byte]*authClient, len(p.Clients))
+	for i, c := range p.Clients {
+		if c.Name == "" || c.Key == "" {
+			return nil, fmt.Errorf("auth policy %s: client %d needs a name and a key", path, i)
+		}
+		sum := sha256.Sum256([]byte(c.Key))
+		if _, ok := p.byKey[sum]; ok {
+			return nil, fmt.Errorf("auth policy %s: client %s reuses the key of another client", path, c.Name)
+		}
+		for _, rule := range c.Rules {
+			for _, op := range rule.Ops {
+				if op != opRead && op != opWrite && op != opDelete {
+					return nil, fmt.Errorf("auth policy %s: client %s: unknown operation %q", path, c.Name, op)
+				}
+			}
+		}
+		p.byKey[sum] = c
+	}
+	return &p, nil
+}
+
+// wrap rejects requests without a valid API key, given as a bearer token,
+// and passes the client of the key on to the handler.
+func (p *authPolicy) wrap(h http.HandlerFunc) http.HandlerFunc {
+	if p == nil {
+		return h
+	}
+	return func(rw http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		c := p.byKey[sha256.Sum256([]byte(token))]
+		if !ok || c == nil {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="db"`)
+			writeError(rw, http.StatusUnauthorized, codeUnauthorized, "", "missing or invalid API key")
+			return
+		}
+		h(rw, r.WithContext(context.WithValue(r.Context(), authClientKey{}, c)))
+	}
+}
+
+// requestClient returns the client that sent the request, or nil if
+// authentication is disabled.
+func requestClient(r *http.Request) *authClient {
+	c, _ := r.Context().Value(authClientKey{}).(*authClient)
+	return c
+}
+
+func (c *authClient) allows(op, key string) bool {
+	for _, rule := range c.Rules {
+		if strings.HasPrefix(key, rule.Prefix) && slices.Contains(rule.Ops, op) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsRange reports whether a single rule covers every key from start up
+// to end. An empty end stands for the end of the key space.
+func (c *authClient) allowsRange(op, start, end string) bool {
+	for _, rule := range c.Rules {
+		if !slices.Contains(rule.Ops, op) || !strings.HasPrefix(start, rule.Prefix) {
+			continue
+		}
+		if ruleEnd := prefixEnd(rule.Prefix); ruleEnd == "" || (end != "" && end <= ruleEnd) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize reports whether the client may perform op on the key, and
+// responds with 403 if it may not.
+func authorize(rw http.ResponseWriter, r *http.Request, op, key string) bool {
+	c := requestClient(r)
+	if c == nil || c.allows(op, key) {
+		return true
+	}
+	writeError(rw, http.StatusForbidden, codeForbidden, key, fmt.Sprintf("client %s may not %s key %s", c.Name, op, key))
+	return false
+}
+
+func authorizeRange(rw http.ResponseWriter, r *http.Request, op, start, end string) bool {
+	c := requestClient(r)
+	if c == nil || c.allowsRange(op, start, end) {
+		return true
+	}
+	writeError(rw, http.StatusForbidden, codeForbidden, "", fmt.Sprintf("client %s may not %s keys from %q to %q", c.Name, op, start, end))
+	return false
+}
+
+// authorizeOps checks every operation of a batch or a transaction.
+func authorizeOps(rw http.ResponseWriter, r *http.Request, ops []batchOpBody) bool {
+	for _, op := range ops {
+		access := opWrite
+		if op.Op == "delete" {
+			access = opDelete
+		}
+		if !authorize(rw, r, access, op.Key) {
+			return false
+		}
+	}
+	return true
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or an empty key if there is no such key.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
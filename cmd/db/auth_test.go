@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPolicy = `{"clients": [
+	{"name": "alpha", "key": "alpha-key", "rules": [
+		{"prefix": "alpha", "ops": ["read", "write", "delete"]},
+		{"prefix": "shared", "ops": ["read"]}
+	]},
+	{"name": "admin", "key": "admin-key", "rules": [{"prefix": "", "ops": ["read", "write", "delete"]}]}
+]}`
+
+func mustPolicy(t *testing.T, policy string) (*authPolicy, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return loadAuthPolicy(path)
+}
+
+func TestLoadAuthPolicy(t *testing.T) {
+	if _, err := mustPolicy(t, testPolicy); err != nil {
+		t.Fatal(err)
+	}
+	for _, policy := range []string{
+		`{"clients": [{"name": "a", "rules": []}]}`,
+		`{"clients": [{"name": "a", "key": "k"}, {"name": "b", "key": "k"}]}`,
+		`{"clients": [{"name": "a", "key": "k", "rules": [{"prefix": "", "ops": ["admin"]}]}]}`,
+		`{"clients": [], "users": []}`,
+		`{"clients": `,
+	} {
+		if _, err := mustPolicy(t, policy); err == nil {
+			t.Errorf("Expected an error for %s", policy)
+		}
+	}
+}
+
+func TestAuthPolicy(t *testing.T) {
+	policy, err := mustPolicy(t, testPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := mustDb(t)
+	_ = db.Put("alpha1", "value")
+	_ = db.Put("beta1", "value")
+	_ = db.Put("shared1", "value")
+	handler := policy.wrap(func(rw http.ResponseWriter, r *http.Request) {
+		handleDbRequest(rw, r, db)
+	})
+
+	cases := []struct {
+		key, method, url, body string
+		status                 int
+		code                   string
+	}{
+		{"", "GET", "/db/alpha1", "", http.StatusUnauthorized, codeUnauthorized},
+		{"wrong-key", "GET", "/db/alpha1", "", http.StatusUnauthorized, codeUnauthorized},
+		{"alpha-key", "GET", "/db/alpha1", "", http.StatusOK, ""},
+		{"alpha-key", "POST", "/db/alpha2", `{"value":"v"}`, http.StatusCreated, ""},
+		{"alpha-key", "GET", "/db/beta1", "", http.StatusForbidden, codeForbidden},
+		{"alpha-key", "GET", "/db/shared1", "", http.StatusOK, ""},
+		{"alpha-key", "POST", "/db/shared1", `{"value":"v"}`, http.StatusForbidden, codeForbidden},
+		{"alpha-key", "HEAD", "/db/beta1", "", http.StatusForbidden, ""},
+		{"alpha-key", "POST", "/db/_batch", `{"ops":[{"op":"put","key":"alpha3","value":"v"},{"op":"delete","key":"beta1"}]}`, http.StatusForbidden, codeForbidden},
+		{"alpha-key", "POST", "/db/_tx", `{"reads":{"beta1":1},"writes":[]}`, http.StatusForbidden, codeForbidden},
+		{"alpha-key", "POST", "/db/_mget", `{"keys":["alpha1","beta1"]}`, http.StatusForbidden, codeForbidden},
+		{"alpha-key", "DELETE", "/db?prefix=alpha&confirm=true", "", http.StatusOK, ""},
+		{"alpha-key", "DELETE", "/db?prefix=al&confirm=true", "", http.StatusForbidden, codeForbidden},
+		{"alpha-key", "DELETE", "/db?start=alpha1&end=alpha9&confirm=true", "", http.StatusOK, ""},
+		{"alpha-key", "DELETE", "/db?start=alpha&end=b&confirm=true", "", http.StatusForbidden, codeForbidden},
+		{"alpha-key", "DELETE", "/db?start=alpha&confirm=true", "", http.StatusForbidden, codeForbidden},
+		{"admin-key", "DELETE", "/db?start=a&confirm=true", "", http.StatusOK, ""},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.url, strings.NewReader(c.body))
+		if c.key != "" {
+			req.Header.Set("Authorization", "Bearer "+c.key)
+		}
+		rw := httptest.NewRecorder()
+		handler(rw, req)
+		if rw.Code != c.status {
+			t.Errorf("%s %s as %q: unexpected status code %d", c.method, c.url, c.key, rw.Code)
+		}
+		if c.status == http.StatusUnauthorized && rw.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s %s as %q: missing WWW-Authenticate header", c.method, c.url, c.key)
+		}
+		if c.code == "" {
+			continue
+		}
+		var body errorResponseBody
+		if err := json.NewDecoder(rw.Body).Decode(&body); err != nil || body.Error.Code != c.code {
+			t.Errorf("%s %s as %q: unexpected error %+v (%v)", c.method, c.url, c.key, body.Error, err)
+		}
+	}
+}
+
+func TestAuthPolicy_Bulk(t *testing.T) {
+	policy, err := mustPolicy(t, testPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := mustDb(t)
+	handler := policy.wrap(func(rw http.ResponseWriter, r *http.Request) {
+		handleDbRequest(rw, r, db)
+	})
+
+	body := "{\"key\":\"alpha1\",\"value\":\"v\"}\n{\"key\":\"beta1\",\"value\":\"v\"}\n"
+	req := httptest.NewRequest("POST", "/db/_bulk", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer alpha-key")
+	rw := httptest.NewRecorder()
+	handler(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code %d", rw.Code)
+	}
+	dec := json.NewDecoder(rw.Body)
+	// Results are not written in the order of the lines.
+	results := make(map[string]bulkResultBody)
+	for dec.More() {
+		var res bulkResultBody
+		if err := dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		results[res.Key] = res
+	}
+	if len(results) != 2 || results["alpha1"].Status != http.StatusCreated || results["beta1"].Status != http.StatusForbidden ||
+		results["beta1"].Error == nil || results["beta1"].Error.Code != codeForbidden {
+		t.Errorf("Unexpected results %+v", results)
+	}
+	if _, err := db.Get("beta1"); err == nil {
+		t.Error("Forbidden line was written")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+type batchOpBody struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value any    `json:"value"`
+}
+
+type batchBody struct {
+	Ops []batchOpBody `json:"ops"`
+	// Encoding is base64 for keys and string values encoded by the client.
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// batchWriter is implemented by datastore.Batch and datastore.Tx.
+type batchWriter interface {
+	Put(key, value string)
+	PutInt64(key string, value int64)
+	Delete(key string)
+}
+
+func addOps(w batchWriter, ops []batchOpBody) error {
+	for i, op := range ops {
+		if op.Key == "" {
+			return fmt.Errorf("operation %d: missing key", i)
+		}
+		switch op.Op {
+		case "put":
+			switch v := op.Value.(type) {
+			case string:
+				w.Put(op.Key, v)
+			case json.Number:
+				n, err := jsonInt64(v)
+				if err != nil {
+					return fmt.Errorf("operation %d: %w", i, err)
+				}
+				w.PutInt64(op.Key, n)
+			default:
+				return fmt.Errorf("operation %d: unknown value type", i)
+			}
+		case "delete":
+			w.Delete(op.Key)
+		default:
+			return fmt.Errorf("operation %d: unknown operation %q", i, op.Op)
+		}
+	}
+	return nil
+}
+
+func handleBatchRequest(rw http.ResponseWriter, r *http.Request, db datastore.Engine) {
+	bdb, ok := db.(datastore.BatchEngine)
+	if !ok {
+		writeNotImplemented(rw, "storage engine does not support batches")
+		return
+	}
+
+	var bb batchBody
+	if !decodeRequestBody(rw, r, &bb) || !checkEncoding(rw, bb.Encoding) {
+		return
+	}
+	if bb.Encoding == encodingBase64 {
+		if err := decodeOps(bb.Ops); err != nil {
+			writeInvalidRequest(rw, "", err.Error())
+			return
+		}
+	}
+	if !authorizeOps(rw, r, bb.Ops) {
+		return
+	}
+
+	var b datastore.Batch
+	if err := addOps(&b, bb.Ops); err != nil {
+		writeInvalidRequest(rw, "", err.Error())
+		return
+	}
+
+	if err := bdb.Write(&b); err != nil {
+		writeStoreError(rw, "", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusCreated)
+}
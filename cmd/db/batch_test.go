@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+func TestHandleBatchRequest(t *testing.T) {
+	db := datastore.NewMemoryDb()
+	_ = db.Put("removed", "value")
+
+	rw := httptest.NewRecorder()
+	body := `{"ops":[{"op":"put","key":"key1","value":"value1"},{"op":"put","key":"key2","value":42},{"op":"delete","key":"removed"}]}`
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/_batch", strings.NewReader(body)), db)
+	if rw.Code != http.StatusCreated {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+	if v, err := db.Get("key1"); err != nil || v != "value1" {
+		t.Errorf("Bad value stored: %s (%v)", v, err)
+	}
+	if v, err := db.GetInt64("key2"); err != nil || v != 42 {
+		t.Errorf("Bad value stored: %d (%v)", v, err)
+	}
+	if _, err := db.Get("removed"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("Expected the key to be deleted, got %v", err)
+	}
+
+	rw = httptest.NewRecorder()
+	body = `{"ops":[{"op":"put","key":"key3","value":"value3"},{"op":"put","key":"key4","value":4.2}]}`
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/_batch", strings.NewReader(body)), db)
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+	if _, err := db.Get("key3"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("Expected no writes from a rejected batch, got %v", err)
+	}
+}
+
+func TestHandleBatchRequest_BucketKey(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The key would be taken for a key of the bucket named users.
+	rw := httptest.NewRecorder()
+	body := `{"ops":[{"op":"put","key":"users\u0000key","value":"value"}]}`
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/_batch", strings.NewReader(body)), db)
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+	users, _ := db.Bucket("users")
+	if _, err := users.Get("key"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("Expected no write to the bucket, got %v", err)
+	}
+}
+
+func TestHandleBatchRequest_Unsupported(t *testing.T) {
+	db, err := datastore.NewLsmDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rw := httptest.NewRecorder()
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/_batch", strings.NewReader(`{"ops":[]}`)), db)
+	if rw.Code != http.StatusNotImplemented {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+const bucketsPath = "/db/_buckets/"
+
+// handleDeleteRequest drops the bucket named in a /db/_buckets/{bucket} path.
+// A request to /db itself deletes a range of keys.
+func handleDeleteRequest(rw http.ResponseWriter, r *http.Request, db datastore.Engine) {
+	if path := r.URL.EscapedPath(); path == "/db" || path == "/db/" {
+		handleDeleteRangeRequest(rw, r, db)
+		return
+	}
+	name, ok := strings.CutPrefix(r.URL.EscapedPath(), bucketsPath)
+	if !ok || strings.Contains(name, "/") {
+		writeInvalidRequest(rw, "", "invalid url path")
+		return
+	}
+	if !authorizeRange(rw, r, opDelete, name+"/", prefixEnd(name+"/")) {
+		return
+	}
+	bdb, ok := db.(datastore.BucketEngine)
+	if !ok {
+		writeNotImplemented(rw, "storage engine does not support buckets")
+		return
+	}
+
+	if err := bdb.DropBucket(name); err != nil {
+		writeStoreError(rw, "", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
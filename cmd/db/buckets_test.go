@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+func TestHandleBucketRequests(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rw := httptest.NewRecorder()
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/users/key", strings.NewReader(`{"value":"user"}`)), db)
+	if rw.Code != http.StatusCreated {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+	rw = httptest.NewRecorder()
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/key", strings.NewReader(`{"value":"default"}`)), db)
+	if rw.Code != http.StatusCreated {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+
+	for url, value := range map[string]string{"/db/users/key": "user", "/db/key": "default"} {
+		rw = httptest.NewRecorder()
+		handleGetRequest(rw, httptest.NewRequest("GET", url, nil), db)
+		var body responseBody
+		if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if rw.Code != http.StatusOK || body.Value != value {
+			t.Errorf("%s: unexpected response %d %v", url, rw.Code, body)
+		}
+	}
+
+	rw = httptest.NewRecorder()
+	handleGetRequest(rw, httptest.NewRequest("GET", "/db/users/key/_history", nil), db)
+	var history historyBody
+	if err := json.NewDecoder(rw.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	if rw.Code != http.StatusOK || history.Key != "key" || len(history.Versions) != 1 || history.Versions[0].Value != "user" {
+		t.Errorf("Unexpected response %d %v", rw.Code, history)
+	}
+
+	// Only the reserved segment asks for the history, so a key named history
+	// is read as usual.
+	rw = httptest.NewRecorder()
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/users/history", strings.NewReader(`{"value":"h"}`)), db)
+	if rw.Code != http.StatusCreated {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+	rw = httptest.NewRecorder()
+	handleGetRequest(rw, httptest.NewRequest("GET", "/db/users/history", nil), db)
+	var body responseBody
+	if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if rw.Code != http.StatusOK || body.Key != "history" || body.Value != "h" {
+		t.Errorf("Unexpected response %d %v", rw.Code, body)
+	}
+
+	rw = httptest.NewRecorder()
+	handleDeleteRequest(rw, httptest.NewRequest("DELETE", "/db/_buckets/users", nil), db)
+	if rw.Code != http.StatusNoContent {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+	users, _ := db.Bucket("users")
+	if _, err := users.Get("key"); !errors.Is(err, datastore.ErrNotFound) {
+		t.Errorf("Expected the bucket to be dropped, got %v", err)
+	}
+	if v, err := db.Get("key"); err != nil || v != "default" {
+		t.Errorf("Bad value returned: %s (%v)", v, err)
+	}
+
+	rw = httptest.NewRecorder()
+	handleGetRequest(rw, httptest.NewRequest("GET", "/db/users/key", nil), datastore.NewMemoryDb())
+	if rw.Code != http.StatusNotImplemented {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+}
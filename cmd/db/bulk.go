@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+const (
+	// A bulk load is written in batches of at most this many lines or bytes.
+	bulkBatchLines = 256
+	bulkBatchBytes = 256 * 1024
+
+	maxMGetKeys = 1000
+)
+
+var errBadValue = errors.New("bad value")
+
+type bulkLineBody struct {
+	Key   string `json:"key"`
+	Value any    `json:"value"`
+}
+
+type bulkResultBody struct {
+	Line   int        `json:"line"`
+	Key    string     `json:"key,omitempty"`
+	Status int        `json:"status"`
+	Error  *errorBody `json:"error,omitempty"`
+}
+
+type bulkLine struct {
+	number int
+	key    string
+	value  any
+}
+
+type mgetBody struct {
+	Keys []string `json:"keys"`
+}
+
+type mgetValueBody struct {
+	Key   string `json:"key"`
+	Value any    `json:"value"`
+	Type  string `json:"type,omitempty"`
+	Found bool   `json:"found"`
+}
+
+type mgetResponseBody struct {
+	Values []mgetValueBody `json:"values"`
+}
+
+// decodeJSON decodes data into v keeping numbers as json.Number.
+func decodeJSON(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// jsonInt64 converts a JSON number to int64. Request bodies are decoded with
+// UseNumber, so that integers beyond 2^53 are not rounded through float64, and
+// numbers that do not convert exactly are rejected.
+func jsonInt64(n json.Number) (int64, error) {
+	v, err := strconv.ParseInt(n.String(), 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, errors.New("integer value out of range")
+	}
+	if err != nil {
+		return 0, errors.New("non-integer value")
+	}
+	return v, nil
+}
+
+// putValue adds a put of a JSON value to w. Numbers must be integers.
+func putValue(w batchWriter, key string, value any) error {
+	if key == "" {
+		return fmt.Errorf("%w: missing key", errBadValue)
+	}
+	switch v := value.(type) {
+	case string:
+		w.Put(key, v)
+	case json.Number:
+		n, err := jsonInt64(v)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errBadValue, err)
+		}
+		w.PutInt64(key, n)
+	default:
+		return fmt.Errorf("%w: unknown value type", errBadValue)
+	}
+	return nil
+}
+
+// enginePuts writes the puts added to it to the engine right away.
+type enginePuts struct {
+	db  datastore.Engine
+	err error
+}
+
+func (p *enginePuts) Put(key, value string) {
+	p.err = p.db.Put(key, value)
+}
+
+func (p *enginePuts) PutInt64(key string, value int64) {
+	p.err = p.db.PutInt64(key, value)
+}
+
+func (p *enginePuts) Delete(key string) {
+	p.err = p.db.Delete(key)
+}
+
+func newBulkResult(number int, key string, err error) bulkResultBody {
+	if err == nil {
+		return bulkResultBody{Line: number, Key: key, Status: http.StatusCreated}
+	}
+	status, code := http.StatusBadRequest, codeInvalidRequest
+	if !errors.Is(err, errBadValue) {
+		status, code = storeErrorStatus(err)
+	}
+	return bulkResultBody{Line: number, Key: key, Status: status, Error: &errorBody{Code: code, Message: err.Error(), Key: key}}
+}
+
+// handleBulkRequest loads NDJSON lines of {"key": ..., "value": ...} and
+// streams a result line for every line read. Lines are written in batches,
+// and the lines of a batch that fails as a whole are written one by one, so
+// that every line gets a result of its own.
+func handleBulkRequest(rw http.ResponseWriter, r *http.Request, db datastore.Engine) {
+	rc := http.NewResponseController(rw)
+	// Results are written while the body is still being read, and a bulk load
+	// may take longer than the server timeouts allow for a single request.
+	_ = rc.EnableFullDuplex()
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	rw.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(rw)
+
+	var pending []bulkLine
+	size := 0
+	flush := func() {
+		for _, res := range writeBulk(db, pending) {
+			_ = enc.Encode(res)
+		}
+		_ = rc.Flush()
+		pending, size = pending[:0], 0
+	}
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 64*1024), int(maxRequestBodySize()))
+	number := 0
+	for scanner.Scan() {
+		number++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var lb bulkLineBody
+		if err := decodeJSON(scanner.Bytes(), &lb); err != nil {
+			_ = enc.Encode(newBulkResult(number, "", fmt.Errorf("%w: json decoding error", errBadValue)))
+			continue
+		}
+		if err := putValue(&datastore.Batch{}, lb.Key, lb.Value); err != nil {
+			_ = enc.Encode(newBulkResult(number, lb.Key, err))
+			continue
+		}
+		if c := requestClient(r); c != nil && !c.allows(opWrite, lb.Key) {
+			_ = enc.Encode(bulkResultBody{Line: number, Key: lb.Key, Status: http.StatusForbidden, Error: &errorBody{
+				Code: codeForbidden, Message: fmt.Sprintf("client %s may not write key %s", c.Name, lb.Key), Key: lb.Key,
+			}})
+			continue
+		}
+		pending = append(pending, bulkLine{number: number, key: lb.Key, value: lb.Value})
+		size += len(scanner.Bytes())
+		if len(pending) == bulkBatchLines || size >= bulkBatchBytes {
+			flush()
+		}
+	}
+	if len(pending) > 0 {
+		flush()
+	}
+	if err := scanner.Err(); err != nil {
+		res := bulkResultBody{Line: number + 1, Status: http.StatusBadRequest, Error: &errorBody{Code: codeInvalidRequest, Message: err.Error()}}
+		if errors.Is(err, bufio.ErrTooLong) {
+			res.Status, res.Error.Code = http.StatusRequestEntityTooLarge, codeTooLarge
+		}
+		_ = enc.Encode(res)
+	}
+}
+
+func writeBulk(db datastore.Engine, lines []bulkLine) []bulkResultBody {
+	results := make([]bulkResultBody, len(lines))
+	if bdb, ok := db.(datastore.BatchEngine); ok && len(lines) > 1 {
+		var b datastore.Batch
+		for _, line := range lines {
+			_ = putValue(&b, line.key, line.value)
+		}
+		if err := bdb.Write(&b); err == nil {
+			for i, line := range lines {
+				results[i] = newBulkResult(line.number, line.key, nil)
+			}
+			return results
+		}
+	}
+	for i, line := range lines {
+		p := &enginePuts{db: db}
+		_ = putValue(p, line.key, line.value)
+		results[i] = newBulkResult(line.number, line.key, p.err)
+	}
+	return results
+}
+
+// getAny returns the value of the key whatever its type is, and its version
+// if the engine keeps one.
+func getAny(db datastore.Engine, key string) (any, uint64, error) {
+	if tdb, ok := db.(datastore.TransactionalEngine); ok {
+		return tdb.GetWithVersion(key)
+	}
+	v, err := db.Get(key)
+	if err == nil || errors.Is(err, datastore.ErrNotFound) {
+		return v, 0, err
+	}
+	n, err := db.GetInt64(key)
+	return n, 0, err
+}
+
+func handleMGetRequest(rw http.ResponseWriter, r *http.Request, db datastore.Engine) {
+	var mb mgetBody
+	if !decodeRequestBody(rw, r, &mb) {
+		return
+	}
+	if len(mb.Keys) > maxMGetKeys {
+		writeInvalidRequest(rw, "", fmt.Sprintf("at most %d keys may be requested at once", maxMGetKeys))
+		return
+	}
+	for _, key := range mb.Keys {
+		if !authorize(rw, r, opRead, key) {
+			return
+		}
+	}
+
+	var values []any
+	if mdb, ok := db.(datastore.MultiGetEngine); ok {
+		var err error
+		if values, err = mdb.GetMany(mb.Keys); err != nil {
+			writeStoreError(rw, "", err)
+			return
+		}
+	} else {
+		values = make([]any, len(mb.Keys))
+		for i, key := range mb.Keys {
+			v, _, err := getAny(db, key)
+			if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+				writeStoreError(rw, key, err)
+				return
+			}
+			if err == nil {
+				values[i] = v
+			}
+		}
+	}
+
+	res := mgetResponseBody{Values: make([]mgetValueBody, len(mb.Keys))}
+	for i, key := range mb.Keys {
+		res.Values[i] = mgetValueBody{Key: key, Value: values[i], Found: values[i] != nil}
+		switch values[i].(type) {
+		case string:
+			res.Values[i].Type = "string"
+		case int64:
+			res.Values[i].Type = "int64"
+		}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(res); err != nil {
+		writeError(rw, http.StatusInternalServerError, codeInternal, "", "json encoding error")
+	}
+}
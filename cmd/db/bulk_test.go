@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+func TestHandleBulkRequest(t *testing.T) {
+	logDb, err := datastore.NewDbWithOptions(t.TempDir(), datastore.Options{SegmentSize: 1024 * 1024, MaxValueSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logDb.Close()
+	// The LSM engine does not limit the size of values.
+	largeStatus := map[string]int{"log": http.StatusRequestEntityTooLarge, "lsm": http.StatusCreated}
+
+	for name, db := range map[string]datastore.Engine{"log": logDb, "lsm": mustLsm(t)} {
+		t.Run(name, func(t *testing.T) {
+			var body strings.Builder
+			for i := 0; i < 300; i++ {
+				fmt.Fprintf(&body, "{\"key\":\"key%03d\",\"value\":\"value%d\"}\n", i, i)
+			}
+			body.WriteString("{\"key\":\"int\",\"value\":42}\n")
+			body.WriteString("\n")
+			body.WriteString("not json\n")
+			body.WriteString("{\"key\":\"\",\"value\":\"value\"}\n")
+			body.WriteString("{\"key\":\"float\",\"value\":1.5}\n")
+			fmt.Fprintf(&body, "{\"key\":\"large\",\"value\":%q}\n", strings.Repeat("v", 100))
+			body.WriteString("{\"key\":\"last\",\"value\":\"value\"}")
+
+			rw := httptest.NewRecorder()
+			handlePostRequest(rw, httptest.NewRequest("POST", "/db/_bulk", strings.NewReader(body.String())), db)
+			if rw.Code != http.StatusOK {
+				t.Fatalf("Unexpected status code %d", rw.Code)
+			}
+			var results []bulkResultBody
+			dec := json.NewDecoder(rw.Body)
+			for dec.More() {
+				var res bulkResultBody
+				if err := dec.Decode(&res); err != nil {
+					t.Fatal(err)
+				}
+				results = append(results, res)
+			}
+			if len(results) != 306 {
+				t.Fatalf("Expected 306 results, got %d", len(results))
+			}
+			statuses := make(map[int]int)
+			for _, res := range results {
+				statuses[res.Line] = res.Status
+			}
+			expected := map[int]int{1: 201, 300: 201, 301: 201, 303: 400, 304: 400, 305: 400, 306: largeStatus[name], 307: 201}
+			for line, status := range expected {
+				if statuses[line] != status {
+					t.Errorf("Line %d: expected status %d, got %d", line, status, statuses[line])
+				}
+			}
+
+			if v, err := db.Get("key299"); err != nil || v != "value299" {
+				t.Errorf("Bad value stored: %s (%v)", v, err)
+			}
+			if v, err := db.GetInt64("int"); err != nil || v != 42 {
+				t.Errorf("Bad value stored: %d (%v)", v, err)
+			}
+			if v, err := db.Get("last"); err != nil || v != "value" {
+				t.Errorf("Bad value stored: %s (%v)", v, err)
+			}
+		})
+	}
+}
+
+func TestHandleBulkRequest_EscapedKeys(t *testing.T) {
+	db := mustDb(t)
+	body := "{\"key\":\"a b/c\",\"value\":\"bulk\"}\n"
+	rw := httptest.NewRecorder()
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/_bulk", strings.NewReader(body)), db)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code %d", rw.Code)
+	}
+
+	// A key written in bulk is the key of its escaped path.
+	rw = httptest.NewRecorder()
+	handleGetRequest(rw, httptest.NewRequest("GET", "/db/a%20b%2Fc", nil), db)
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), `"value":"bulk"`) {
+		t.Errorf("Unexpected response %d %s", rw.Code, rw.Body)
+	}
+
+	rw = httptest.NewRecorder()
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/x%20y", strings.NewReader(`{"value":"path"}`)), db)
+	if rw.Code != http.StatusCreated {
+		t.Fatalf("Unexpected status code %d", rw.Code)
+	}
+	if v, err := db.Get("x y"); err != nil || v != "path" {
+		t.Errorf("Bad value stored: %s (%v)", v, err)
+	}
+
+	// A separator smuggled in through an escape is rejected like any other.
+	rw = httptest.NewRecorder()
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/x%00y", strings.NewReader(`{"value":"path"}`)), db)
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+}
+
+func TestHandleMGetRequest(t *testing.T) {
+	for name, db := range map[string]datastore.Engine{"log": mustDb(t), "lsm": mustLsm(t)} {
+		t.Run(name, func(t *testing.T) {
+			if err := db.Put("key1", "value1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.PutInt64("key2", 42); err != nil {
+				t.Fatal(err)
+			}
+
+			rw := httptest.NewRecorder()
+			body := `{"keys":["key1","missing","key2"]}`
+			handlePostRequest(rw, httptest.NewRequest("POST", "/db/_mget", strings.NewReader(body)), db)
+			if rw.Code != http.StatusOK {
+				t.Fatalf("Unexpected status code %d", rw.Code)
+			}
+			var res mgetResponseBody
+			if err := json.NewDecoder(rw.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			expected := []mgetValueBody{
+				{Key: "key1", Value: "value1", Type: "string", Found: true},
+				{Key: "missing"},
+				{Key: "key2", Value: float64(42), Type: "int64", Found: true},
+			}
+			if !reflect.DeepEqual(res.Values, expected) {
+				t.Errorf("Expected %+v, got %+v", expected, res.Values)
+			}
+		})
+	}
+
+	keys := make([]string, maxMGetKeys+1)
+	body, _ := json.Marshal(mgetBody{Keys: keys})
+	rw := httptest.NewRecorder()
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/_mget", strings.NewReader(string(body))), mustDb(t))
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+}
+
+func mustDb(t *testing.T) datastore.Engine {
+	t.Helper()
+	db, err := datastore.NewDb(t.TempDir(), 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestHandleBulkRequest_Server(t *testing.T) {
+	db := mustDb(t)
+	srv := httptest.NewServer(newRequestCounter().wrap(func(rw http.ResponseWriter, r *http.Request) {
+		handleDbRequest(rw, r, db)
+	}))
+	defer srv.Close()
+
+	// Results of the first lines are sent while the rest of the body is still
+	// being written.
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < 10*bulkBatchLines; i++ {
+			fmt.Fprintf(pw, "{\"key\":\"key%d\",\"value\":\"value\"}\n", i)
+		}
+		_ = pw.Close()
+	}()
+	resp, err := http.Post(srv.URL+"/db/_bulk", "application/x-ndjson", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	n := 0
+	for dec.More() {
+		var res bulkResultBody
+		if err := dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Status != http.StatusCreated {
+			t.Fatalf("Unexpected result %+v", res)
+		}
+		n++
+	}
+	if n != 10*bulkBatchLines {
+		t.Errorf("Expected %d results, got %d", 10*bulkBatchLines, n)
+	}
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/kushnirko/kpi-apz-lab-5/datastore"
 	"github.com/kushnirko/kpi-apz-lab-5/httptools"
@@ -16,10 +19,27 @@ import (
 )
 
 var (
-	port        = flag.Int("port", 8080, "server port")
-	path        = flag.String("from", "", "recover database from disk")
-	temp        = flag.Bool("temp", false, "create temporary database")
-	segmentSize = flag.Int("segment", 10*1024*1024, "size of database segment")
+	port         = flag.Int("port", 8080, "server port")
+	respPort     = flag.Int("resp-port", 0, "port of the Redis protocol (RESP2) server, 0 to disable it")
+	path         = flag.String("from", "", "recover database from disk")
+	temp         = flag.Bool("temp", false, "create temporary database")
+	segmentSize  = flag.Int("segment", 10*1024*1024, "size of database segment")
+	maxKeySize   = flag.Int("max-key-size", datastore.DefaultMaxKeySize, "maximum key size in bytes")
+	maxValueSize = flag.Int("max-value-size", datastore.DefaultMaxValueSize, "maximum value size in bytes")
+	versions     = flag.Int("versions", 1, "number of versions retained per key")
+	engine       = flag.String("engine", "log", "storage engine: log, lsm or memory")
+	upgrade      = flag.Bool("upgrade", false, "rewrite segments in an outdated format before opening the database")
+	maxKeys      = flag.Int("max-keys", 0, "maximum number of keys kept when used as a cache, 0 for no limit")
+	maxBytes     = flag.Int64("max-bytes", 0, "maximum size of live records in bytes when used as a cache, 0 for no limit")
+	eviction     = flag.String("eviction", string(datastore.EvictLRU), "cache eviction policy: lru, lfu or random")
+	dedup        = flag.Int("dedup-threshold", 0, "store values of at least this many bytes once by content hash, 0 to disable")
+	coldDir      = flag.String("cold-dir", "", "directory for segments older than cold-age, empty to keep all segments in place")
+	coldAge      = flag.Duration("cold-age", 24*time.Hour, "age after which sealed segments are moved to cold-dir")
+	coldCompress = flag.Bool("cold-compress", false, "compress segments moved to cold-dir")
+
+	authPolicyPath = flag.String("auth-policy", "", "JSON file mapping API keys to allowed operations and key prefixes, empty to disable authentication")
+
+	indexes = make(indexFlag)
 
 	logEnabled = flag.Bool("log", true, "whether to write logs to stdout")
 )
@@ -41,93 +61,251 @@ func createDirectory() (string, error) {
 	}
 }
 
+func openEngine() (datastore.Engine, error) {
+	switch *engine {
+	case "log":
+		dir, err := createDirectory()
+		if err != nil {
+			return nil, err
+		}
+		if *upgrade {
+			if err := datastore.UpgradeSegments(dir); err != nil {
+				return nil, err
+			}
+		}
+		return datastore.NewDbWithOptions(dir, datastore.Options{
+			SegmentSize:    *segmentSize,
+			MaxKeySize:     *maxKeySize,
+			MaxValueSize:   *maxValueSize,
+			Versions:       *versions,
+			Indexes:        indexes,
+			MaxKeys:        *maxKeys,
+			MaxBytes:       *maxBytes,
+			Eviction:       datastore.EvictionPolicy(*eviction),
+			DedupThreshold: *dedup,
+			ColdDir:        *coldDir,
+			ColdAge:        *coldAge,
+			CompressCold:   *coldCompress,
+		})
+	case "lsm":
+		dir, err := createDirectory()
+		if err != nil {
+			return nil, err
+		}
+		return datastore.NewLsmDb(dir, *segmentSize)
+	case "memory":
+		return datastore.NewMemoryDb(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage engine %s", *engine)
+	}
+}
+
 type responseBody struct {
-	Key   string `json:"key"`
-	Value any    `json:"value"`
+	Key     string `json:"key"`
+	Value   any    `json:"value"`
+	Version uint64 `json:"version,omitempty"`
 }
 
 type requestBody struct {
 	Value any `json:"value"`
 }
 
-func handleGetRequest(rw http.ResponseWriter, r *http.Request, db *datastore.Db) {
+// historySegment ends the path of a GET request for the history of a key. It
+// is reserved like _batch and _tx, so a key named _history of a bucket cannot
+// be read with GET /db/{bucket}/_history.
+const historySegment = "_history"
+
+// resolveKey maps a /db/{key} or /db/{bucket}/{key} path to the engine holding
+// the key, once the client is authorized to perform op on it. Keys without a
+// bucket belong to the default bucket, which is the database itself.
+func resolveKey(rw http.ResponseWriter, r *http.Request, db datastore.Engine, op string) (datastore.Engine, string, bool) {
+	return resolvePath(rw, r, strings.Split(r.URL.EscapedPath(), "/"), db, op)
+}
+
+func resolvePath(rw http.ResponseWriter, r *http.Request, pathParts []string, db datastore.Engine, op string) (datastore.Engine, string, bool) {
+	if len(pathParts) != 3 && len(pathParts) != 4 {
+		writeInvalidRequest(rw, "", "invalid url path")
+		return nil, "", false
+	}
+	// The key is unescaped, so that /db/a%20b names the key "a b" a bulk load,
+	// a batch or a RESP client would write.
+	k, err := url.PathUnescape(pathParts[len(pathParts)-1])
+	if err != nil {
+		writeInvalidRequest(rw, "", "invalid url path")
+		return nil, "", false
+	}
+	if len(pathParts) == 3 {
+		if !authorize(rw, r, op, k) {
+			return nil, "", false
+		}
+		return db, k, true
+	}
+	if !authorize(rw, r, op, pathParts[2]+"/"+k) {
+		return nil, "", false
+	}
+	bdb, ok := db.(datastore.BucketEngine)
+	if !ok {
+		writeNotImplemented(rw, "storage engine does not support buckets")
+		return nil, "", false
+	}
+	bucket, err := bdb.Bucket(pathParts[2])
+	if err != nil {
+		writeStoreError(rw, "", err)
+		return nil, "", false
+	}
+	return bucket, k, true
+}
+
+func handleGetRequest(rw http.ResponseWriter, r *http.Request, db datastore.Engine) {
+	if strings.HasPrefix(r.URL.EscapedPath(), indexPath) {
+		handleQueryRequest(rw, r, db)
+		return
+	}
+	if r.URL.EscapedPath() == scanPath {
+		handleScanRequest(rw, r, db)
+		return
+	}
 	pathParts := strings.Split(r.URL.EscapedPath(), "/")
-	if len(pathParts) != 3 {
-		http.Error(rw, "invalid url path", http.StatusBadRequest)
+	history := len(pathParts) > 3 && pathParts[len(pathParts)-1] == historySegment
+	if history {
+		pathParts = pathParts[:len(pathParts)-1]
+	}
+	db, k, ok := resolvePath(rw, r, pathParts, db, opRead)
+	if !ok {
+		return
+	}
+	if history {
+		handleHistoryRequest(rw, db, k)
+		return
+	}
+	if r.URL.Query().Has("version") {
+		handleVersionRequest(rw, r, db, k)
 		return
 	}
-
-	k := pathParts[2]
 	t := r.URL.Query().Get("type")
 
+	if t != "" && t != "string" && t != "int64" {
+		writeInvalidRequest(rw, k, fmt.Sprintf("invalid data type %s", t))
+		return
+	}
+
 	var v any
+	var version uint64
 	var err error
-	switch t {
-	case "string", "":
-		v, err = db.Get(k)
-	case "int64":
+	if tdb, ok := db.(datastore.TransactionalEngine); ok {
+		v, version, err = tdb.GetWithVersion(k)
+		if err == nil {
+			err = checkType(v, t)
+		}
+	} else if t == "int64" {
 		v, err = db.GetInt64(k)
-	default:
-		http.Error(rw, fmt.Sprintf("invalid data type %s", t), http.StatusBadRequest)
-		return
+	} else {
+		v, err = db.Get(k)
 	}
 	if err != nil {
-		http.Error(rw, fmt.Sprintf("no value found for key %s", k), http.StatusNotFound)
+		writeKeyError(rw, k, err)
 		return
 	}
 
-	rw.Header().Set("Content-Type", "application/json")
-	if err = json.NewEncoder(rw).Encode(responseBody{Key: k, Value: v}); err != nil {
-		http.Error(rw, "json encoding error", http.StatusInternalServerError)
+	writeValue(rw, r, k, v, version)
+}
+
+// maxRequestBodySize leaves room for JSON framing and escaping of the largest
+// accepted value.
+func maxRequestBodySize() int64 {
+	return 2*int64(*maxValueSize) + 1024
+}
+
+// decodeRequestBody decodes the JSON body of the request into v and reports
+// the error to the client if it fails.
+func decodeRequestBody(rw http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(rw, r.Body, maxRequestBodySize()))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeError(rw, http.StatusRequestEntityTooLarge, codeTooLarge, "", fmt.Sprintf("request body exceeds %d bytes", maxBytesErr.Limit))
+			return false
+		}
+		writeInvalidRequest(rw, "", "json decoding error")
+		return false
 	}
+	return true
 }
 
-func handlePostRequest(rw http.ResponseWriter, r *http.Request, db *datastore.Db) {
-	pathParts := strings.Split(r.URL.EscapedPath(), "/")
-	if len(pathParts) != 3 {
-		http.Error(rw, "invalid url path", http.StatusBadRequest)
+func handlePostRequest(rw http.ResponseWriter, r *http.Request, db datastore.Engine) {
+	switch r.URL.EscapedPath() {
+	case "/db/_batch":
+		handleBatchRequest(rw, r, db)
+		return
+	case "/db/_tx":
+		handleTxRequest(rw, r, db)
+		return
+	case "/db/_bulk":
+		handleBulkRequest(rw, r, db)
+		return
+	case "/db/_mget":
+		handleMGetRequest(rw, r, db)
+		return
+	}
+	db, k, ok := resolveKey(rw, r, db, opWrite)
+	if !ok {
 		return
 	}
-
-	k := pathParts[2]
 
 	var rb requestBody
-	if err := json.NewDecoder(r.Body).Decode(&rb); err != nil {
-		http.Error(rw, "json decoding error", http.StatusBadRequest)
+	if !decodeRequestBody(rw, r, &rb) {
 		return
 	}
 
-	var err error
-	switch v := rb.Value.(type) {
-	case string:
-		err = db.Put(k, v)
-	case float64:
-		if v == float64(int64(v)) {
-			err = db.PutInt64(k, int64(v))
-		} else {
-			err = fmt.Errorf("non-integer value")
-		}
-	default:
-		err = fmt.Errorf("unknown value type")
+	p := &enginePuts{db: db}
+	if err := putValue(p, k, rb.Value); err != nil {
+		writeInvalidRequest(rw, k, err.Error())
+		return
 	}
-	if err != nil {
-		http.Error(rw, err.Error(), http.StatusBadRequest)
+	if p.err != nil {
+		writeStoreError(rw, k, p.err)
 		return
 	}
 
 	rw.WriteHeader(http.StatusCreated)
 }
 
+func handleDbRequest(rw http.ResponseWriter, r *http.Request, db datastore.Engine) {
+	switch r.Method {
+	case "GET":
+		handleGetRequest(rw, r, db)
+	case "HEAD":
+		handleHeadRequest(rw, r, db)
+	case "POST":
+		handlePostRequest(rw, r, db)
+	case "PUT":
+		handlePutRequest(rw, r, db)
+	case "DELETE":
+		handleDeleteRequest(rw, r, db)
+	default:
+		writeMethodNotAllowed(rw, r)
+	}
+}
+
 func main() {
+	flag.Var(indexes, "index", "secondary index on a JSON field as name=path, may be repeated")
 	flag.Parse()
 	logger.Init(*logEnabled)
 
-	dir, err := createDirectory()
-	if err != nil {
-		log.Fatal(err)
+	var policy *authPolicy
+	if *authPolicyPath != "" {
+		var err error
+		if policy, err = loadAuthPolicy(*authPolicyPath); err != nil {
+			log.Fatal(err)
+		}
+		// RESP has no way to present an API key.
+		if *respPort != 0 {
+			log.Fatal("the RESP server cannot be enabled together with an auth policy")
+		}
 	}
 
-	db, err := datastore.NewDb(dir, *segmentSize)
+	db, err := openEngine()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -137,19 +315,25 @@ func main() {
 		}
 	}()
 
+	requests := newRequestCounter()
+
 	h := new(http.ServeMux)
-	h.HandleFunc("/db/", func(rw http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			handleGetRequest(rw, r, db)
-		case "POST":
-			handlePostRequest(rw, r, db)
-		default:
-			rw.WriteHeader(http.StatusBadRequest)
-		}
+	handleDb := requests.wrap(policy.wrap(func(rw http.ResponseWriter, r *http.Request) {
+		handleDbRequest(rw, r, db)
+	}))
+	// /db is registered as well, so that DELETE /db?prefix= is not redirected
+	// to /db/.
+	h.HandleFunc("/db", handleDb)
+	h.HandleFunc("/db/", handleDb)
+	h.HandleFunc("/metrics", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(rw, db.Stats(), requests.snapshot())
 	})
 
 	server := httptools.CreateServer(*port, h)
 	server.Start()
+	if *respPort != 0 {
+		startRESPServer(*respPort, db)
+	}
 	signal.WaitForTerminationSignal()
 }
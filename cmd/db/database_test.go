@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+	"github.com/kushnirko/kpi-apz-lab-5/dbclient"
+)
+
+func TestHandlePostRequest(t *testing.T) {
+	db := datastore.NewMemoryDb()
+
+	rw := httptest.NewRecorder()
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/key1", strings.NewReader(`{"value":"value1"}`)), db)
+	if rw.Code != http.StatusCreated {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+	if v, err := db.Get("key1"); err != nil || v != "value1" {
+		t.Errorf("Bad value stored: %s (%v)", v, err)
+	}
+
+	rw = httptest.NewRecorder()
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/key2", strings.NewReader(`{"value":42}`)), db)
+	if rw.Code != http.StatusCreated {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+	if v, err := db.GetInt64("key2"); err != nil || v != 42 {
+		t.Errorf("Bad value stored: %d (%v)", v, err)
+	}
+
+	rw = httptest.NewRecorder()
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/key3", strings.NewReader(`{"value":4.2}`)), db)
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+}
+
+func TestHandlePostRequest_Int64(t *testing.T) {
+	db := datastore.NewMemoryDb()
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		handleDbRequest(rw, r, db)
+	}))
+	defer srv.Close()
+	c := dbclient.New(srv.URL, dbclient.Options{})
+	defer c.Close()
+
+	// The value is not representable as float64.
+	const large = 1<<60 + 1
+	if err := c.PutInt64("key", large); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := db.GetInt64("key"); err != nil || v != large {
+		t.Errorf("Bad value stored: %d (%v)", v, err)
+	}
+	if v, err := c.GetInt64("key"); err != nil || v != large {
+		t.Errorf("Bad value returned: %d (%v)", v, err)
+	}
+
+	for body, status := range map[string]int{
+		`{"value":9223372036854775807}`: http.StatusCreated,
+		`{"value":9223372036854775808}`: http.StatusBadRequest,
+		`{"value":1e3}`:                 http.StatusBadRequest,
+	} {
+		rw := httptest.NewRecorder()
+		handlePostRequest(rw, httptest.NewRequest("POST", "/db/max", strings.NewReader(body)), db)
+		if rw.Code != status {
+			t.Errorf("%s: unexpected status code %d", body, rw.Code)
+		}
+	}
+	if v, err := db.GetInt64("max"); err != nil || v != math.MaxInt64 {
+		t.Errorf("Bad value stored: %d (%v)", v, err)
+	}
+}
+
+func TestHandleGetRequest(t *testing.T) {
+	db := datastore.NewMemoryDb()
+	_ = db.Put("key1", "value1")
+	_ = db.PutInt64("key2", 42)
+
+	cases := []struct {
+		url    string
+		status int
+		value  any
+	}{
+		{"/db/key1", http.StatusOK, "value1"},
+		{"/db/key2?type=int64", http.StatusOK, float64(42)},
+		{"/db/missing", http.StatusNotFound, nil},
+		{"/db/key1?type=bool", http.StatusBadRequest, nil},
+	}
+	for _, c := range cases {
+		rw := httptest.NewRecorder()
+		handleGetRequest(rw, httptest.NewRequest("GET", c.url, nil), db)
+		if rw.Code != c.status {
+			t.Errorf("%s: unexpected status code %d", c.url, rw.Code)
+			continue
+		}
+		if c.status != http.StatusOK {
+			continue
+		}
+		var body responseBody
+		if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Value != c.value {
+			t.Errorf("%s: unexpected value %v", c.url, body.Value)
+		}
+	}
+}
+
+func TestHandlePostRequest_TooLarge(t *testing.T) {
+	db, err := datastore.NewDbWithOptions(t.TempDir(), datastore.Options{
+		SegmentSize:  1024,
+		MaxKeySize:   8,
+		MaxValueSize: 16,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rw := httptest.NewRecorder()
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/key", strings.NewReader(`{"value":"very long value to store"}`)), db)
+	if rw.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+	if !strings.Contains(rw.Body.String(), "value is too large") {
+		t.Errorf("Unexpected message %q", rw.Body.String())
+	}
+
+	rw = httptest.NewRecorder()
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/very-long-key", strings.NewReader(`{"value":"v"}`)), db)
+	if rw.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+// Codes of error responses. The status code tells the class of an error, the
+// code tells which error of the class it is.
+const (
+	codeInvalidRequest       = "invalid_request"
+	codeUnauthorized         = "unauthorized"
+	codeForbidden            = "forbidden"
+	codeNotFound             = "not_found"
+	codeTypeMismatch         = "type_mismatch"
+	codeConflict             = "conflict"
+	codeTooLarge             = "too_large"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeNotAcceptable        = "not_acceptable"
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeNotImplemented       = "not_implemented"
+	codeCorrupted            = "corrupted"
+	codeUnavailable          = "unavailable"
+	codeInternal             = "internal"
+)
+
+// dbMethods are the methods served under /db/.
+var dbMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE"}
+
+type errorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Key     string `json:"key,omitempty"`
+}
+
+type errorResponseBody struct {
+	Error errorBody `json:"error"`
+}
+
+// writeError responds with an error as JSON. The key is left out of errors
+// that do not concern a single key.
+func writeError(rw http.ResponseWriter, status int, code, key, message string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.Header().Del("Content-Length")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(errorResponseBody{Error: errorBody{Code: code, Message: message, Key: key}})
+}
+
+// writeStoreError responds with an error returned by a storage engine.
+func writeStoreError(rw http.ResponseWriter, key string, err error) {
+	status, code := storeErrorStatus(err)
+	writeError(rw, status, code, key, err.Error())
+}
+
+func storeErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, datastore.ErrNotFound), errors.Is(err, datastore.ErrUnknownIndex):
+		return http.StatusNotFound, codeNotFound
+	case errors.Is(err, datastore.ErrTypeMismatch):
+		return http.StatusConflict, codeTypeMismatch
+	case errors.Is(err, datastore.ErrConflict):
+		return http.StatusConflict, codeConflict
+	case errors.Is(err, datastore.ErrKeyTooLarge), errors.Is(err, datastore.ErrValueTooLarge),
+		errors.Is(err, datastore.ErrBatchTooLarge):
+		return http.StatusRequestEntityTooLarge, codeTooLarge
+	case errors.Is(err, datastore.ErrInvalidBucket), errors.Is(err, datastore.ErrInvalidKey),
+		errors.Is(err, datastore.ErrTxDone):
+		return http.StatusBadRequest, codeInvalidRequest
+	case errors.Is(err, datastore.ErrCorrupted):
+		return http.StatusInternalServerError, codeCorrupted
+	case errors.Is(err, datastore.ErrClosed):
+		return http.StatusServiceUnavailable, codeUnavailable
+	default:
+		return http.StatusInternalServerError, codeInternal
+	}
+}
+
+// writeKeyError responds with an error returned for reading the key.
+func writeKeyError(rw http.ResponseWriter, key string, err error) {
+	if errors.Is(err, datastore.ErrNotFound) {
+		writeError(rw, http.StatusNotFound, codeNotFound, key, fmt.Sprintf("no value found for key %s", key))
+		return
+	}
+	writeStoreError(rw, key, err)
+}
+
+func writeInvalidRequest(rw http.ResponseWriter, key, message string) {
+	writeError(rw, http.StatusBadRequest, codeInvalidRequest, key, message)
+}
+
+func writeNotImplemented(rw http.ResponseWriter, message string) {
+	writeError(rw, http.StatusNotImplemented, codeNotImplemented, "", message)
+}
+
+func writeMethodNotAllowed(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Allow", strings.Join(dbMethods, ", "))
+	writeError(rw, http.StatusMethodNotAllowed, codeMethodNotAllowed, "", "method "+r.Method+" is not allowed")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+func TestErrorResponses(t *testing.T) {
+	dir := t.TempDir()
+	db, err := datastore.NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_ = db.Put("key1", "value1")
+	_ = db.PutInt64("key2", 42)
+
+	cases := []struct {
+		method, url, body string
+		status            int
+		code, key         string
+	}{
+		{"GET", "/db/missing", "", http.StatusNotFound, codeNotFound, "missing"},
+		{"GET", "/db/key2", "", http.StatusConflict, codeTypeMismatch, "key2"},
+		{"GET", "/db/key1?type=int64", "", http.StatusConflict, codeTypeMismatch, "key1"},
+		{"GET", "/db/key1?type=bool", "", http.StatusBadRequest, codeInvalidRequest, "key1"},
+		{"GET", "/db/key1?version=99", "", http.StatusNotFound, codeNotFound, "key1"},
+		{"GET", "/db/key1?version=x", "", http.StatusBadRequest, codeInvalidRequest, "key1"},
+		{"GET", "/db/a/b/c", "", http.StatusBadRequest, codeInvalidRequest, ""},
+		{"POST", "/db/key3", `{"value":4.2}`, http.StatusBadRequest, codeInvalidRequest, "key3"},
+		{"POST", "/db/key3", `{"value":`, http.StatusBadRequest, codeInvalidRequest, ""},
+		{"POST", "/db/_tx", `{"reads":{"key1":100}}`, http.StatusConflict, codeConflict, ""},
+		{"PATCH", "/db/key1", "", http.StatusMethodNotAllowed, codeMethodNotAllowed, ""},
+	}
+	for _, c := range cases {
+		rw := httptest.NewRecorder()
+		handleDbRequest(rw, httptest.NewRequest(c.method, c.url, strings.NewReader(c.body)), db)
+		if rw.Code != c.status {
+			t.Errorf("%s %s: unexpected status code %d", c.method, c.url, rw.Code)
+		}
+		if rw.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s: unexpected content type %s", c.method, c.url, rw.Header().Get("Content-Type"))
+		}
+		var body errorResponseBody
+		if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+			t.Fatalf("%s %s: %v", c.method, c.url, err)
+		}
+		if body.Error.Code != c.code || body.Error.Key != c.key || body.Error.Message == "" {
+			t.Errorf("%s %s: unexpected error %+v", c.method, c.url, body.Error)
+		}
+		if c.status == http.StatusMethodNotAllowed && rw.Header().Get("Allow") != "GET, HEAD, POST, PUT, DELETE" {
+			t.Errorf("Unexpected Allow header %q", rw.Header().Get("Allow"))
+		}
+	}
+
+	// A record cut short on disk is reported as corruption, not as a
+	// missing key.
+	segment := filepath.Join(dir, "segment-1")
+	info, err := os.Stat(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The record ends with an 8 byte version number, the value is cut after it.
+	if err := os.Truncate(segment, info.Size()-12); err != nil {
+		t.Fatal(err)
+	}
+	rw := httptest.NewRecorder()
+	handleDbRequest(rw, httptest.NewRequest("GET", "/db/key2?type=int64", nil), db)
+	var body errorResponseBody
+	if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if rw.Code != http.StatusInternalServerError || body.Error.Code != codeCorrupted {
+		t.Errorf("Unexpected response %d %+v", rw.Code, body.Error)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+const indexPath = "/db/_index/"
+
+// indexFlag collects secondary indexes given as repeated name=path flags.
+type indexFlag map[string]string
+
+func (f indexFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for name, path := range f {
+		pairs = append(pairs, name+"="+path)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (f indexFlag) Set(value string) error {
+	name, path, ok := strings.Cut(value, "=")
+	if !ok || name == "" || path == "" {
+		return fmt.Errorf("expected name=path, got %q", value)
+	}
+	f[name] = path
+	return nil
+}
+
+type queryBody struct {
+	Index   string         `json:"index"`
+	Value   string         `json:"value"`
+	Results []responseBody `json:"results"`
+}
+
+func handleQueryRequest(rw http.ResponseWriter, r *http.Request, db datastore.Engine) {
+	name := strings.TrimPrefix(r.URL.EscapedPath(), indexPath)
+	if name == "" || strings.Contains(name, "/") {
+		writeInvalidRequest(rw, "", "invalid url path")
+		return
+	}
+	if !r.URL.Query().Has("eq") {
+		writeInvalidRequest(rw, "", "missing eq parameter")
+		return
+	}
+	idb, ok := db.(datastore.IndexedEngine)
+	if !ok {
+		writeNotImplemented(rw, "storage engine does not support indexes")
+		return
+	}
+
+	// Results are limited to the keys the client may read.
+	c := requestClient(r)
+	body := queryBody{Index: name, Value: r.URL.Query().Get("eq"), Results: []responseBody{}}
+	err := idb.QueryIndex(name, body.Value, func(key string, value any) error {
+		if c == nil || c.allows(opRead, key) {
+			body.Results = append(body.Results, responseBody{Key: key, Value: value})
+		}
+		return nil
+	})
+	if err != nil {
+		writeStoreError(rw, "", err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(rw).Encode(body); err != nil {
+		writeError(rw, http.StatusInternalServerError, codeInternal, "", "json encoding error")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+func TestHandleQueryRequest(t *testing.T) {
+	db, err := datastore.NewDbWithOptions(t.TempDir(), datastore.Options{
+		SegmentSize: 1024,
+		Indexes:     map[string]string{"city": "city"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_ = db.Put("alice", `{"city":"Kyiv"}`)
+	_ = db.Put("bob", `{"city":"Lviv"}`)
+
+	rw := httptest.NewRecorder()
+	handleGetRequest(rw, httptest.NewRequest("GET", "/db/_index/city?eq=Kyiv", nil), db)
+	var body queryBody
+	if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if rw.Code != http.StatusOK || len(body.Results) != 1 || body.Results[0].Key != "alice" ||
+		body.Results[0].Value != `{"city":"Kyiv"}` {
+		t.Errorf("Unexpected response %d %v", rw.Code, body)
+	}
+
+	cases := []struct {
+		url    string
+		status int
+	}{
+		{"/db/_index/missing?eq=Kyiv", http.StatusNotFound},
+		{"/db/_index/city", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		rw = httptest.NewRecorder()
+		handleGetRequest(rw, httptest.NewRequest("GET", c.url, nil), db)
+		if rw.Code != c.status {
+			t.Errorf("%s: unexpected status code %d", c.url, rw.Code)
+		}
+	}
+
+	rw = httptest.NewRecorder()
+	handleGetRequest(rw, httptest.NewRequest("GET", "/db/_index/city?eq=Kyiv", nil), datastore.NewMemoryDb())
+	if rw.Code != http.StatusNotImplemented {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+type requestKey struct {
+	method string
+	status int
+}
+
+type requestCounter struct {
+	mu     sync.Mutex
+	counts map[requestKey]uint64
+}
+
+func newRequestCounter() *requestCounter {
+	return &requestCounter{counts: make(map[requestKey]uint64)}
+}
+
+func (rc *requestCounter) inc(method string, status int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.counts[requestKey{method: method, status: status}]++
+}
+
+func (rc *requestCounter) snapshot() map[requestKey]uint64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	res := make(map[requestKey]uint64, len(rc.counts))
+	for k, v := range rc.counts {
+		res[k] = v
+	}
+	return res
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the connection of the response.
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+func (rc *requestCounter) wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		sr := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		h(sr, r)
+		rc.inc(r.Method, sr.status)
+	}
+}
+
+func writeMetrics(w io.Writer, s datastore.Stats, requests map[requestKey]uint64) {
+	writeMetric(w, "datastore_keys", "gauge", "Number of keys in the index.", s.Keys)
+	writeMetric(w, "datastore_segments", "gauge", "Number of segment files.", s.Segments)
+	writeMetric(w, "datastore_segment_bytes", "gauge", "Total size of segment files in bytes.", s.SegmentBytes)
+	writeMetric(w, "datastore_cold_segments", "gauge", "Number of segment files moved to the cold directory.", s.ColdSegments)
+	writeMetric(w, "datastore_dead_bytes", "gauge", "Bytes occupied by overwritten records.", s.DeadBytes)
+	writeMetric(w, "datastore_blobs", "gauge", "Number of blob files holding large values.", s.Blobs)
+	writeMetric(w, "datastore_blob_bytes", "gauge", "Total size of blob files in bytes.", s.BlobBytes)
+	writeMetric(w, "datastore_merges_total", "counter", "Number of completed segment merges.", s.Merges)
+	writeMetric(w, "datastore_merge_duration_seconds_total", "counter", "Total time spent merging segments.",
+		s.MergeDuration.Seconds())
+	writeMetric(w, "datastore_evictions_total", "counter", "Number of keys evicted to stay within the cache limits.", s.Evictions)
+	writeHistogram(w, "datastore_read_duration_seconds", "Latency of read operations.", s.Reads)
+	writeHistogram(w, "datastore_write_duration_seconds", "Latency of write operations.", s.Writes)
+
+	buckets := make([]string, 0, len(s.Buckets))
+	for name := range s.Buckets {
+		buckets = append(buckets, name)
+	}
+	sort.Strings(buckets)
+	fmt.Fprintln(w, "# HELP datastore_bucket_keys Number of keys in a bucket.")
+	fmt.Fprintln(w, "# TYPE datastore_bucket_keys gauge")
+	for _, name := range buckets {
+		fmt.Fprintf(w, "datastore_bucket_keys{bucket=%s} %d\n", labelValue(name), s.Buckets[name].Keys)
+	}
+	fmt.Fprintln(w, "# HELP datastore_bucket_bytes Size of the live records of a bucket in bytes.")
+	fmt.Fprintln(w, "# TYPE datastore_bucket_bytes gauge")
+	for _, name := range buckets {
+		fmt.Fprintf(w, "datastore_bucket_bytes{bucket=%s} %d\n", labelValue(name), s.Buckets[name].Bytes)
+	}
+
+	keys := make([]requestKey, 0, len(requests))
+	for k := range requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+	fmt.Fprintln(w, "# HELP db_http_requests_total Number of handled /db/ requests.")
+	fmt.Fprintln(w, "# TYPE db_http_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "db_http_requests_total{method=%s,code=\"%d\"} %d\n", labelValue(k.method), k.status, requests[k])
+	}
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value any) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	fmt.Fprintf(w, "%s %v\n", name, value)
+}
+
+func writeHistogram(w io.Writer, name, help string, h datastore.Histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for i, bound := range h.Buckets {
+		le := strconv.FormatFloat(bound.Seconds(), 'g', -1, 64)
+		fmt.Fprintf(w, "%s_bucket{le=%s} %d\n", name, labelValue(le), h.Counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	fmt.Fprintf(w, "%s_sum %v\n", name, h.Sum.Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+}
+
+// labelEscaper escapes a label value as the Prometheus text format requires.
+// Unlike %q, it leaves other characters as they are.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+func TestRequestCounter_Wrap(t *testing.T) {
+	rc := newRequestCounter()
+	h := rc.wrap(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			rw.WriteHeader(http.StatusCreated)
+			return
+		}
+		_, _ = rw.Write([]byte("ok"))
+	})
+
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/db/key", nil))
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/db/key", nil))
+	h(httptest.NewRecorder(), httptest.NewRequest("POST", "/db/key", nil))
+
+	counts := rc.snapshot()
+	if counts[requestKey{"GET", http.StatusOK}] != 2 {
+		t.Errorf("Unexpected GET count: %v", counts)
+	}
+	if counts[requestKey{"POST", http.StatusCreated}] != 1 {
+		t.Errorf("Unexpected POST count: %v", counts)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	s := datastore.Stats{
+		Keys:         3,
+		Segments:     2,
+		SegmentBytes: 150,
+		ColdSegments: 1,
+		DeadBytes:    40,
+		Merges:       1,
+		Evictions:    6,
+		Reads: datastore.Histogram{
+			Buckets: []time.Duration{time.Millisecond},
+			Counts:  []uint64{4},
+			Count:   5,
+			Sum:     10 * time.Millisecond,
+		},
+		Buckets: map[string]datastore.BucketStats{"users": {Keys: 2, Bytes: 64}},
+	}
+	out := new(bytes.Buffer)
+	writeMetrics(out, s, map[requestKey]uint64{{"GET", 404}: 7})
+
+	for _, line := range []string{
+		"datastore_keys 3",
+		"datastore_segments 2",
+		"datastore_segment_bytes 150",
+		"datastore_cold_segments 1",
+		"datastore_dead_bytes 40",
+		"datastore_merges_total 1",
+		"datastore_evictions_total 6",
+		`datastore_read_duration_seconds_bucket{le="0.001"} 4`,
+		`datastore_read_duration_seconds_bucket{le="+Inf"} 5`,
+		"datastore_read_duration_seconds_sum 0.01",
+		"datastore_read_duration_seconds_count 5",
+		`datastore_bucket_keys{bucket="users"} 2`,
+		`datastore_bucket_bytes{bucket="users"} 64`,
+		`db_http_requests_total{method="GET",code="404"} 7`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("Missing metric line %q in:\n%s", line, out)
+		}
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	for value, want := range map[string]string{
+		"users":       `"users"`,
+		`a"b\c`:       `"a\"b\\c"`,
+		"line\nbreak": `"line\nbreak"`,
+		"ключ\t":      "\"ключ\t\"",
+	} {
+		if got := labelValue(value); got != want {
+			t.Errorf("labelValue(%q) = %s, expected %s", value, got, want)
+		}
+	}
+}
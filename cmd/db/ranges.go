@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+type deleteRangeBody struct {
+	Deleted int `json:"deleted"`
+}
+
+// handleDeleteRangeRequest deletes the keys selected by DELETE
+// /db?prefix={prefix} or DELETE /db?start={start}&end={end}. An empty prefix
+// selects every key, so the request has to be confirmed with confirm=true.
+func handleDeleteRangeRequest(rw http.ResponseWriter, r *http.Request, db datastore.Engine) {
+	query := r.URL.Query()
+	hasPrefix := query.Has("prefix")
+	hasRange := query.Has("start") || query.Has("end")
+	if hasPrefix == hasRange {
+		writeInvalidRequest(rw, "", "expected either a prefix or a start and end parameter")
+		return
+	}
+	if confirm, _ := strconv.ParseBool(query.Get("confirm")); !confirm {
+		writeInvalidRequest(rw, "", "deleting a range of keys requires confirm=true")
+		return
+	}
+	start, end := query.Get("start"), query.Get("end")
+	if hasPrefix {
+		start, end = query.Get("prefix"), prefixEnd(query.Get("prefix"))
+	}
+	if !authorizeRange(rw, r, opDelete, start, end) {
+		return
+	}
+	rdb, ok := db.(datastore.RangeDeleteEngine)
+	if !ok {
+		writeNotImplemented(rw, "storage engine does not support range deletes")
+		return
+	}
+
+	var deleted int
+	var err error
+	if hasPrefix {
+		deleted, err = rdb.DeletePrefix(query.Get("prefix"))
+	} else {
+		deleted, err = rdb.DeleteRange(query.Get("start"), query.Get("end"))
+	}
+	if err != nil {
+		writeStoreError(rw, "", err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(deleteRangeBody{Deleted: deleted}); err != nil {
+		writeError(rw, http.StatusInternalServerError, codeInternal, "", "json encoding error")
+	}
+}
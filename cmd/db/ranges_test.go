@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+func TestHandleDeleteRangeRequest(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"run1/a", "run1/b", "run2/a", "other"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, url := range []string{"/db?prefix=run1/", "/db?prefix=run1/&confirm=false", "/db?confirm=true", "/db?prefix=run1/&start=a&confirm=true"} {
+		rw := httptest.NewRecorder()
+		handleDeleteRequest(rw, httptest.NewRequest("DELETE", url, nil), db)
+		if rw.Code != http.StatusBadRequest {
+			t.Errorf("%s: unexpected status code %d", url, rw.Code)
+		}
+	}
+	if _, err := db.Get("run1/a"); err != nil {
+		t.Fatalf("Keys were deleted without confirmation: %v", err)
+	}
+
+	for url, expected := range map[string]int{
+		"/db?prefix=run1/&confirm=true":         2,
+		"/db/?start=run2&end=run3&confirm=true": 1,
+		"/db?prefix=missing/&confirm=true":      0,
+	} {
+		rw := httptest.NewRecorder()
+		handleDeleteRequest(rw, httptest.NewRequest("DELETE", url, nil), db)
+		var body deleteRangeBody
+		if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if rw.Code != http.StatusOK || body.Deleted != expected {
+			t.Errorf("%s: unexpected response %d %+v", url, rw.Code, body)
+		}
+	}
+	for _, key := range []string{"run1/a", "run1/b", "run2/a"} {
+		if _, err := db.Get(key); !errors.Is(err, datastore.ErrNotFound) {
+			t.Errorf("Expected %s to be deleted, got %v", key, err)
+		}
+	}
+	if v, err := db.Get("other"); err != nil || v != "value" {
+		t.Errorf("Bad value returned: %s (%v)", v, err)
+	}
+
+	rw := httptest.NewRecorder()
+	handleDeleteRequest(rw, httptest.NewRequest("DELETE", "/db?prefix=&confirm=true", nil), mustLsm(t))
+	if rw.Code != http.StatusNotImplemented {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+}
+
+func mustLsm(t *testing.T) datastore.Engine {
+	t.Helper()
+	db, err := datastore.NewLsmDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
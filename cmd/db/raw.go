@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+const octetStream = "application/octet-stream"
+
+var errNotAcceptable = errors.New("int64 values cannot be returned as application/octet-stream")
+
+// acceptsRaw reports whether the client asked for raw bytes rather than JSON.
+// The media types of the Accept header are taken in the order they are
+// listed, quality values are not weighed.
+func acceptsRaw(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(part, ";")
+		switch strings.TrimSpace(mediaType) {
+		case octetStream:
+			return true
+		case "application/json", "application/*", "*/*":
+			return false
+		}
+	}
+	return false
+}
+
+func valueType(v any) string {
+	if _, ok := v.(int64); ok {
+		return "int64"
+	}
+	return "string"
+}
+
+func valueSize(v any) int {
+	if s, ok := v.(string); ok {
+		return len(s)
+	}
+	return 8
+}
+
+// encodeValue renders the value in the representation negotiated with the
+// client. Strings are returned as they are stored when raw bytes are
+// accepted, JSON replaces bytes that are not valid UTF-8.
+func encodeValue(r *http.Request, k string, v any, version uint64) (string, []byte, error) {
+	if acceptsRaw(r) {
+		s, ok := v.(string)
+		if !ok {
+			return "", nil, errNotAcceptable
+		}
+		return octetStream, []byte(s), nil
+	}
+	body, err := json.Marshal(responseBody{Key: k, Value: v, Version: version})
+	if err != nil {
+		return "", nil, err
+	}
+	return "application/json", append(body, '\n'), nil
+}
+
+// writeValue responds with the value. The body is dropped by the server for
+// HEAD requests, which get the same headers as GET.
+func writeValue(rw http.ResponseWriter, r *http.Request, k string, v any, version uint64) {
+	contentType, body, err := encodeValue(r, k, v, version)
+	if errors.Is(err, errNotAcceptable) {
+		writeError(rw, http.StatusNotAcceptable, codeNotAcceptable, k, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, codeInternal, k, "json encoding error")
+		return
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.Header().Set("X-Value-Type", valueType(v))
+	rw.Header().Set("X-Value-Size", strconv.Itoa(valueSize(v)))
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write(body)
+}
+
+// handleHeadRequest reports whether the key exists, and the type and size of
+// its value. Values of any type are found unless the type query parameter
+// asks for one.
+func handleHeadRequest(rw http.ResponseWriter, r *http.Request, db datastore.Engine) {
+	db, k, ok := resolveKey(rw, r, db, opRead)
+	if !ok {
+		return
+	}
+	v, version, err := getAny(db, k)
+	if err == nil && r.URL.Query().Has("type") {
+		err = checkType(v, r.URL.Query().Get("type"))
+	}
+	if err != nil {
+		writeKeyError(rw, k, err)
+		return
+	}
+	writeValue(rw, r, k, v, version)
+}
+
+// handlePutRequest stores the body of the request as the value of the key
+// without any decoding.
+func handlePutRequest(rw http.ResponseWriter, r *http.Request, db datastore.Engine) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != octetStream {
+		writeError(rw, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "", fmt.Sprintf("PUT expects %s, use POST for JSON values", octetStream))
+		return
+	}
+	db, k, ok := resolveKey(rw, r, db, opWrite)
+	if !ok {
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, int64(*maxValueSize)))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeError(rw, http.StatusRequestEntityTooLarge, codeTooLarge, k, fmt.Sprintf("request body exceeds %d bytes", maxBytesErr.Limit))
+		return
+	}
+	if err != nil {
+		writeInvalidRequest(rw, k, err.Error())
+		return
+	}
+
+	if err := db.Put(k, string(data)); err != nil {
+		writeStoreError(rw, k, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusCreated)
+}
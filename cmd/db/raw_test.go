@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+func TestHandlePutRequest_Raw(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	data := make([]byte, 256)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	req := httptest.NewRequest("PUT", "/db/binary", bytes.NewReader(data))
+	req.Header.Set("Content-Type", octetStream)
+	rw := httptest.NewRecorder()
+	handlePutRequest(rw, req, db)
+	if rw.Code != http.StatusCreated {
+		t.Fatalf("Unexpected status code %d", rw.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/db/binary", nil)
+	req.Header.Set("Accept", "application/octet-stream, application/json;q=0.5")
+	rw = httptest.NewRecorder()
+	handleGetRequest(rw, req, db)
+	if rw.Code != http.StatusOK || rw.Header().Get("Content-Type") != octetStream {
+		t.Fatalf("Unexpected response %d %s", rw.Code, rw.Header().Get("Content-Type"))
+	}
+	if !bytes.Equal(rw.Body.Bytes(), data) {
+		t.Errorf("Bad value returned: %v", rw.Body.Bytes())
+	}
+
+	// JSON stays the default representation.
+	rw = httptest.NewRecorder()
+	handleGetRequest(rw, httptest.NewRequest("GET", "/db/binary", nil), db)
+	if rw.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Unexpected content type %s", rw.Header().Get("Content-Type"))
+	}
+
+	req = httptest.NewRequest("PUT", "/db/binary", bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	rw = httptest.NewRecorder()
+	handlePutRequest(rw, req, db)
+	if rw.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+}
+
+func TestHandleHeadRequest(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_ = db.Put("key1", "value1")
+	_ = db.PutInt64("key2", 42)
+
+	cases := []struct {
+		url, accept string
+		status      int
+		valueType   string
+		size        string
+		length      int
+	}{
+		{"/db/key1", octetStream, http.StatusOK, "string", "6", 6},
+		{"/db/key2", "", http.StatusOK, "int64", "8", -1},
+		{"/db/key2", octetStream, http.StatusNotAcceptable, "", "", -1},
+		{"/db/key2?type=string", "", http.StatusConflict, "", "", -1},
+		{"/db/missing", "", http.StatusNotFound, "", "", -1},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("HEAD", c.url, nil)
+		req.Header.Set("Accept", c.accept)
+		rw := httptest.NewRecorder()
+		handleHeadRequest(rw, req, db)
+		if rw.Code != c.status {
+			t.Errorf("%s: unexpected status code %d", c.url, rw.Code)
+		}
+		if rw.Header().Get("X-Value-Type") != c.valueType || rw.Header().Get("X-Value-Size") != c.size {
+			t.Errorf("%s: unexpected headers %v", c.url, rw.Header())
+		}
+		if c.length >= 0 && rw.Header().Get("Content-Length") != strconv.Itoa(c.length) {
+			t.Errorf("%s: unexpected length %s", c.url, rw.Header().Get("Content-Length"))
+		}
+	}
+}
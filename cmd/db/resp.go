@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+	"github.com/kushnirko/kpi-apz-lab-5/logger"
+)
+
+// maxRESPArgs limits the number of arguments of a single command.
+const maxRESPArgs = 1024 * 1024
+
+// expireBucket holds the expiration deadlines of keys set through RESP as
+// unix milliseconds. The store has no notion of expiration, so expired keys
+// are deleted when they are accessed through RESP and by a periodic sweep.
+const expireBucket = "_resp_expire"
+
+const expireSweepInterval = time.Second
+
+// maxScanCursors is the number of SCAN cursors remembered. An iteration whose
+// cursor has been forgotten fails with an invalid cursor error.
+const maxScanCursors = 1024
+
+var errRESPProtocol = errors.New("protocol error")
+
+// respEngine is the storage engine behind the RESP front end. Commands that
+// read and then write a key run as transactions.
+type respEngine interface {
+	datastore.TransactionalEngine
+	datastore.BucketEngine
+	datastore.KeyEngine
+}
+
+type respServer struct {
+	db        respEngine
+	deadlines *datastore.Bucket
+	maxBulk   int
+	// mu orders changes of deadlines with the writes of their keys, so that
+	// a key is never deleted for a deadline that no longer applies to it.
+	mu sync.Mutex
+	// cursors maps the SCAN cursors handed out to the key the next page
+	// starts from. Clients expect numeric cursors, so the keys are not
+	// returned as cursors themselves.
+	cursorsMu  sync.Mutex
+	cursors    map[uint64]string
+	lastCursor uint64
+}
+
+func newRESPServer(db datastore.Engine, maxBulk int) (*respServer, error) {
+	rdb, ok := db.(respEngine)
+	if !ok {
+		return nil, fmt.Errorf("storage engine does not support the RESP protocol")
+	}
+	deadlines, err := rdb.Bucket(expireBucket)
+	if err != nil {
+		return nil, err
+	}
+	return &respServer{db: rdb, deadlines: deadlines, maxBulk: maxBulk, cursors: make(map[uint64]string)}, nil
+}
+
+// startRESPServer serves the Redis protocol on the port until the process
+// finishes.
+func startRESPServer(port int, db datastore.Engine) {
+	s, err := newRESPServer(db, max(*maxKeySize, *maxValueSize))
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		for range time.Tick(expireSweepInterval) {
+			if err := s.sweepExpired(); err != nil {
+				logger.Println(err)
+			}
+		}
+	}()
+	go func() {
+		logger.Println("Starting the RESP server...")
+		err := s.serve(l)
+		log.Fatalf("RESP server finished: %s. Finishing the process.", err)
+	}()
+}
+
+func (s *respServer) serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn executes the commands of a connection in order. Replies are
+// buffered while more pipelined commands are waiting to be read.
+func (s *respServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := &respWriter{w: bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(r, s.maxBulk)
+		if errors.Is(err, errRESPProtocol) {
+			w.writeError("ERR " + err.Error())
+			_ = w.w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := strings.EqualFold(args[0], "quit")
+		if quit {
+			w.writeSimple("OK")
+		} else {
+			s.execute(w, args)
+		}
+		if r.Buffered() == 0 || quit {
+			if err := w.w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// readCommand reads a command sent as an array of bulk strings or, as typed
+// by hand, as an inline line of space-separated words.
+func readCommand(r *bufio.Reader, maxBulk int) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxRESPArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+	args := make([]string, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got %q", errRESPProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulk {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if string(data[size:]) != "\r\n" {
+			return nil, fmt.Errorf("%w: bulk string is not terminated", errRESPProtocol)
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+type respWriter struct {
+	w *bufio.Writer
+}
+
+func (w *respWriter) writeSimple(s string) {
+	fmt.Fprintf(w.w, "+%s\r\n", s)
+}
+
+func (w *respWriter) writeError(s string) {
+	fmt.Fprintf(w.w, "-%s\r\n", s)
+}
+
+func (w *respWriter) writeInt(n int64) {
+	fmt.Fprintf(w.w, ":%d\r\n", n)
+}
+
+func (w *respWriter) writeBulk(s string) {
+	fmt.Fprintf(w.w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func (w *respWriter) writeNull() {
+	_, _ = w.w.WriteString("$-1\r\n")
+}
+
+func (w *respWriter) writeArrayHeader(n int) {
+	fmt.Fprintf(w.w, "*%d\r\n", n)
+}
+
+func (w *respWriter) writeBulks(items []string) {
+	w.writeArrayHeader(len(items))
+	for _, item := range items {
+		w.writeBulk(item)
+	}
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+// respTxAttempts is the number of times a command reading and writing a key
+// is retried when the key is changed concurrently.
+const respTxAttempts = 10
+
+// respError is an error reported to the client as is, prefix included.
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+const (
+	errNotInteger = respError("ERR value is not an integer or out of range")
+	errSyntax     = respError("ERR syntax error")
+)
+
+type respCommand struct {
+	run func(s *respServer, w *respWriter, args []string) error
+	// arity is the number of arguments including the command name, or minus
+	// the minimum number for commands taking a variable number of them.
+	arity int
+}
+
+var respCommands = map[string]respCommand{
+	"ping":   {(*respServer).ping, -1},
+	"get":    {(*respServer).get, 2},
+	"set":    {(*respServer).set, -3},
+	"setnx":  {(*respServer).setnx, 3},
+	"del":    {(*respServer).del, -2},
+	"exists": {(*respServer).exists, -2},
+	"incr":   {(*respServer).incr, 2},
+	"incrby": {(*respServer).incrby, 3},
+	"append": {(*respServer).append, 3},
+	"keys":   {(*respServer).keys, 2},
+	"scan":   {(*respServer).scan, -2},
+	"ttl":    {(*respServer).ttl, 2},
+	"expire": {(*respServer).expire, 3},
+}
+
+func (s *respServer) execute(w *respWriter, args []string) {
+	name := strings.ToLower(args[0])
+	cmd, ok := respCommands[name]
+	if !ok {
+		w.writeError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		w.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", name))
+		return
+	}
+	for _, key := range commandKeys(name, args) {
+		if strings.Contains(key, "\x00") {
+			w.writeError("ERR invalid key")
+			return
+		}
+	}
+	if err := cmd.run(s, w, args); err != nil {
+		var re respError
+		if errors.As(err, &re) {
+			w.writeError(string(re))
+		} else {
+			w.writeError("ERR " + err.Error())
+		}
+	}
+}
+
+// commandKeys returns the arguments of a command that are keys.
+func commandKeys(name string, args []string) []string {
+	switch name {
+	case "ping", "keys", "scan":
+		return nil
+	case "del", "exists":
+		return args[1:]
+	default:
+		return args[1:2]
+	}
+}
+
+// lookup returns the value of the key, deleting the key first if it has
+// expired.
+func (s *respServer) lookup(key string) (any, error) {
+	if err := s.expireIfDue(key); err != nil {
+		return nil, err
+	}
+	value, _, err := s.db.GetWithVersion(key)
+	return value, err
+}
+
+func (s *respServer) deadline(key string) (time.Time, bool, error) {
+	ms, err := s.deadlines.GetInt64(key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.UnixMilli(ms), true, nil
+}
+
+func (s *respServer) expireIfDue(key string) error {
+	if deadline, ok, err := s.deadline(key); err != nil || !ok || time.Now().Before(deadline) {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The deadline may have been changed in the meantime.
+	if deadline, ok, err := s.deadline(key); err != nil || !ok || time.Now().Before(deadline) {
+		return err
+	}
+	return s.remove(key)
+}
+
+// remove deletes the key together with its deadline.
+func (s *respServer) remove(key string) error {
+	if err := s.db.Delete(key); err != nil {
+		return err
+	}
+	return s.deadlines.Delete(key)
+}
+
+// setDeadline sets the deadline of the key, or clears it if ttl is zero.
+func (s *respServer) setDeadline(key string, ttl time.Duration) error {
+	if ttl == 0 {
+		return s.deadlines.Delete(key)
+	}
+	return s.deadlines.PutInt64(key, time.Now().Add(ttl).UnixMilli())
+}
+
+// update runs fn in a transaction and commits it, retrying on conflicts.
+func (s *respServer) update(fn func(tx *datastore.Tx) error) error {
+	var err error
+	for i := 0; i < respTxAttempts; i++ {
+		tx := s.db.Begin()
+		if err = fn(tx); err != nil {
+			return err
+		}
+		if err = tx.Commit(); !errors.Is(err, datastore.ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// txValue reads a value of any type within the transaction.
+func txValue(tx *datastore.Tx, key string) (any, error) {
+	value, err := tx.Get(key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		return value, nil
+	}
+	return tx.GetInt64(key)
+}
+
+func formatValue(value any) string {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (s *respServer) ping(w *respWriter, args []string) error {
+	switch len(args) {
+	case 1:
+		w.writeSimple("PONG")
+	case 2:
+		w.writeBulk(args[1])
+	default:
+		return respError("ERR wrong number of arguments for 'ping' command")
+	}
+	return nil
+}
+
+func (s *respServer) get(w *respWriter, args []string) error {
+	value, err := s.lookup(args[1])
+	if errors.Is(err, datastore.ErrNotFound) {
+		w.writeNull()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	w.writeBulk(formatValue(value))
+	return nil
+}
+
+// set implements SET key value [EX seconds | PX milliseconds] [NX | XX].
+func (s *respServer) set(w *respWriter, args []string) error {
+	key, value := args[1], args[2]
+	var ttl time.Duration
+	var nx, xx bool
+	for i := 3; i < len(args); i++ {
+		switch opt := strings.ToLower(args[i]); opt {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "ex", "px":
+			if i+1 == len(args) || ttl != 0 {
+				return errSyntax
+			}
+			i++
+			n, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil || n <= 0 {
+				return respError("ERR invalid expire time in 'set' command")
+			}
+			unit := time.Second
+			if opt == "px" {
+				unit = time.Millisecond
+			}
+			ttl = time.Duration(n) * unit
+		default:
+			return errSyntax
+		}
+	}
+	if nx && xx {
+		return errSyntax
+	}
+
+	written, err := s.write(key, value, ttl, nx, xx)
+	if err != nil {
+		return err
+	}
+	if written {
+		w.writeSimple("OK")
+	} else {
+		w.writeNull()
+	}
+	return nil
+}
+
+// write sets the value of the key, if it does not exist for nx or if it
+// exists for xx, and reports whether it was set.
+func (s *respServer) write(key, value string, ttl time.Duration, nx, xx bool) (bool, error) {
+	if err := s.expireIfDue(key); err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	written := true
+	var err error
+	if nx || xx {
+		err = s.update(func(tx *datastore.Tx) error {
+			_, err := txValue(tx, key)
+			if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+				return err
+			}
+			written = (err == nil && xx) || (err != nil && nx)
+			if written {
+				tx.Put(key, value)
+			}
+			return nil
+		})
+	} else {
+		err = s.db.Put(key, value)
+	}
+	if err != nil || !written {
+		return false, err
+	}
+	return true, s.setDeadline(key, ttl)
+}
+
+func (s *respServer) setnx(w *respWriter, args []string) error {
+	written, err := s.write(args[1], args[2], 0, true, false)
+	if err != nil {
+		return err
+	}
+	if written {
+		w.writeInt(1)
+	} else {
+		w.writeInt(0)
+	}
+	return nil
+}
+
+func (s *respServer) del(w *respWriter, args []string) error {
+	var deleted int64
+	for _, key := range args[1:] {
+		if _, err := s.lookup(key); errors.Is(err, datastore.ErrNotFound) {
+			continue
+		}
+		if err := s.remove(key); err != nil {
+			return err
+		}
+		deleted++
+	}
+	w.writeInt(deleted)
+	return nil
+}
+
+func (s *respServer) exists(w *respWriter, args []string) error {
+	var n int64
+	for _, key := range args[1:] {
+		_, err := s.lookup(key)
+		if err == nil {
+			n++
+		} else if !errors.Is(err, datastore.ErrNotFound) {
+			return err
+		}
+	}
+	w.writeInt(n)
+	return nil
+}
+
+func (s *respServer) incr(w *respWriter, args []string) error {
+	return s.incrementBy(w, args[1], 1)
+}
+
+func (s *respServer) incrby(w *respWriter, args []string) error {
+	delta, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	return s.incrementBy(w, args[1], delta)
+}
+
+// incrementBy adds delta to the value of the key, which is stored as int64.
+// Values stored as strings are converted if they hold an integer.
+func (s *respServer) incrementBy(w *respWriter, key string, delta int64) error {
+	if err := s.expireIfDue(key); err != nil {
+		return err
+	}
+	var res int64
+	err := s.update(func(tx *datastore.Tx) error {
+		value, err := txValue(tx, key)
+		if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+			return err
+		}
+		var n int64
+		switch v := value.(type) {
+		case int64:
+			n = v
+		case string:
+			if n, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return errNotInteger
+			}
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return respError("ERR increment or decrement would overflow")
+		}
+		res = n + delta
+		tx.PutInt64(key, res)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.writeInt(res)
+	return nil
+}
+
+func (s *respServer) append(w *respWriter, args []string) error {
+	key := args[1]
+	if err := s.expireIfDue(key); err != nil {
+		return err
+	}
+	var length int
+	err := s.update(func(tx *datastore.Tx) error {
+		value, err := txValue(tx, key)
+		if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+			return err
+		}
+		res := args[2]
+		if err == nil {
+			res = formatValue(value) + res
+		}
+		length = len(res)
+		tx.Put(key, res)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.writeInt(int64(length))
+	return nil
+}
+
+// liveKeys returns the keys matching the pattern that have not expired. Only
+// the deadlines of the matching keys are read.
+func (s *respServer) liveKeys(keys []string, pattern string) ([]string, error) {
+	now := time.Now()
+	var res []string
+	for _, key := range keys {
+		if !globMatch(pattern, key) {
+			continue
+		}
+		deadline, ok, err := s.deadline(key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || now.Before(deadline) {
+			res = append(res, key)
+		}
+	}
+	return res, nil
+}
+
+func (s *respServer) keys(w *respWriter, args []string) error {
+	keys, err := s.db.Keys("", "", 0)
+	if err != nil {
+		return err
+	}
+	res, err := s.liveKeys(keys, args[1])
+	if err != nil {
+		return err
+	}
+	w.writeBulks(res)
+	return nil
+}
+
+// scan implements SCAN cursor [MATCH pattern] [COUNT count]. A cursor stands
+// for the key the next page starts from, so a page does not walk the keys of
+// the previous ones again, and keys deleted during the iteration do not cause
+// others to be skipped.
+func (s *respServer) scan(w *respWriter, args []string) error {
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return respError("ERR invalid cursor")
+	}
+	start := ""
+	if cursor != 0 {
+		var ok bool
+		if start, ok = s.cursorStart(cursor); !ok {
+			return respError("ERR invalid cursor")
+		}
+	}
+	pattern, count := "*", 10
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			return errSyntax
+		}
+		switch strings.ToLower(args[i]) {
+		case "match":
+			pattern = args[i+1]
+		case "count":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				return errSyntax
+			}
+		default:
+			return errSyntax
+		}
+	}
+
+	// One key past the page tells whether the iteration is complete.
+	keys, err := s.db.Keys(start, "", count+1)
+	if err != nil {
+		return err
+	}
+	var next uint64
+	if len(keys) > count {
+		keys = keys[:count]
+		// Keys of the default bucket cannot contain the separator byte, so
+		// the next key is at least the last one followed by it.
+		next = s.newCursor(keys[count-1] + "\x00")
+	}
+	res, err := s.liveKeys(keys, pattern)
+	if err != nil {
+		return err
+	}
+	w.writeArrayHeader(2)
+	w.writeBulk(strconv.FormatUint(next, 10))
+	w.writeBulks(res)
+	return nil
+}
+
+// newCursor remembers where the next page of a scan starts and returns the
+// cursor for it. Only the last maxScanCursors cursors are kept.
+func (s *respServer) newCursor(start string) uint64 {
+	s.cursorsMu.Lock()
+	defer s.cursorsMu.Unlock()
+	s.lastCursor++
+	s.cursors[s.lastCursor] = start
+	if s.lastCursor > maxScanCursors {
+		delete(s.cursors, s.lastCursor-maxScanCursors)
+	}
+	return s.lastCursor
+}
+
+func (s *respServer) cursorStart(cursor uint64) (string, bool) {
+	s.cursorsMu.Lock()
+	defer s.cursorsMu.Unlock()
+	start, ok := s.cursors[cursor]
+	return start, ok
+}
+
+func (s *respServer) ttl(w *respWriter, args []string) error {
+	key := args[1]
+	if _, err := s.lookup(key); errors.Is(err, datastore.ErrNotFound) {
+		w.writeInt(-2)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	deadline, ok, err := s.deadline(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		w.writeInt(-1)
+		return nil
+	}
+	w.writeInt(int64(math.Ceil(time.Until(deadline).Seconds())))
+	return nil
+}
+
+func (s *respServer) expire(w *respWriter, args []string) error {
+	key := args[1]
+	seconds, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return errNotInteger
+	}
+	if _, err := s.lookup(key); errors.Is(err, datastore.ErrNotFound) {
+		w.writeInt(0)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seconds <= 0 {
+		err = s.remove(key)
+	} else {
+		err = s.setDeadline(key, time.Duration(seconds)*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	w.writeInt(1)
+	return nil
+}
+
+// sweepExpired deletes the keys whose deadline has passed.
+func (s *respServer) sweepExpired() error {
+	now := time.Now().UnixMilli()
+	var expired []string
+	err := s.deadlines.Scan("", "", func(key string, value any) error {
+		if ms, ok := value.(int64); ok && ms <= now {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range expired {
+		if err := s.expireIfDue(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// globMatch reports whether s matches a Redis glob pattern, which supports
+// *, ?, character classes such as [a-z] or [^a] and escaping with \.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				// An unterminated class matches the bracket itself.
+				if s[0] != '[' {
+					return false
+				}
+				break
+			}
+			class := pattern[1 : end+1]
+			if !matchClass(class, s[0]) {
+				return false
+			}
+			pattern = pattern[end+1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
+
+func matchClass(class string, c byte) bool {
+	negate := strings.HasPrefix(class, "^")
+	if negate {
+		class = class[1:]
+	}
+	matched := false
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			lo, hi := class[i], class[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (c >= lo && c <= hi)
+			i += 2
+			continue
+		}
+		matched = matched || class[i] == c
+	}
+	return matched != negate
+}
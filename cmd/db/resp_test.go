@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+type respClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func startTestRESPServer(t *testing.T, db datastore.Engine) (*respServer, *respClient) {
+	t.Helper()
+	s, err := newRESPServer(db, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() { _ = s.serve(l) }()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return s, &respClient{conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends the commands in a single write and returns their replies.
+func (c *respClient) do(t *testing.T, cmds ...[]string) []any {
+	t.Helper()
+	var b strings.Builder
+	for _, cmd := range cmds {
+		fmt.Fprintf(&b, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	replies := make([]any, len(cmds))
+	for i := range replies {
+		reply, err := readReply(c.r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replies[i] = reply
+	}
+	return replies
+}
+
+// readReply decodes a reply: simple strings and bulk strings as string,
+// integers as int64, errors as respError, null as nil and arrays as []any.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+func cmd(args ...string) []string {
+	return args
+}
+
+func TestRESP_Commands(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, c := startTestRESPServer(t, db)
+
+	replies := c.do(t,
+		cmd("PING"),
+		cmd("ping", "hello"),
+		cmd("SET", "key1", "value1"),
+		cmd("GET", "key1"),
+		cmd("GET", "missing"),
+		cmd("SETNX", "key1", "other"),
+		cmd("SETNX", "key2", "value2"),
+		cmd("SET", "key2", "new", "XX"),
+		cmd("SET", "key3", "new", "XX"),
+		cmd("SET", "key1", "new", "NX"),
+		cmd("EXISTS", "key1", "key2", "key3"),
+		cmd("INCR", "counter"),
+		cmd("INCRBY", "counter", "41"),
+		cmd("INCR", "key1"),
+		cmd("APPEND", "key2", "er"),
+		cmd("APPEND", "counter", "0"),
+		cmd("KEYS", "key*"),
+		cmd("DEL", "key1", "key3"),
+		cmd("GET", "key1"),
+		cmd("UNKNOWN"),
+		cmd("GET"),
+	)
+	expected := []any{
+		"PONG",
+		"hello",
+		"OK",
+		"value1",
+		nil,
+		int64(0),
+		int64(1),
+		"OK",
+		nil,
+		nil,
+		int64(2),
+		int64(1),
+		int64(42),
+		errNotInteger,
+		int64(5),
+		int64(3),
+		[]any{"key1", "key2"},
+		int64(1),
+		nil,
+		respError("ERR unknown command 'UNKNOWN'"),
+		respError("ERR wrong number of arguments for 'get' command"),
+	}
+	for i := range expected {
+		if !reflect.DeepEqual(replies[i], expected[i]) {
+			t.Errorf("Reply %d: expected %#v, got %#v", i, expected[i], replies[i])
+		}
+	}
+
+	// Values written over RESP are ordinary keys of the database.
+	if v, err := db.Get("key2"); err != nil || v != "newer" {
+		t.Errorf("Bad value stored: %s (%v)", v, err)
+	}
+	if v, err := db.Get("counter"); err != nil || v != "420" {
+		t.Errorf("Bad value stored: %s (%v)", v, err)
+	}
+}
+
+func TestRESP_Expire(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s, c := startTestRESPServer(t, db)
+
+	replies := c.do(t,
+		cmd("SET", "short", "value", "PX", "50"),
+		cmd("SET", "long", "value", "EX", "100"),
+		cmd("SET", "plain", "value"),
+		cmd("TTL", "long"),
+		cmd("TTL", "plain"),
+		cmd("TTL", "missing"),
+		cmd("EXPIRE", "plain", "100"),
+		cmd("EXPIRE", "missing", "100"),
+		cmd("SET", "long", "value"),
+		cmd("TTL", "long"),
+	)
+	expected := []any{"OK", "OK", "OK", int64(100), int64(-1), int64(-2), int64(1), int64(0), "OK", int64(-1)}
+	for i := range expected {
+		if !reflect.DeepEqual(replies[i], expected[i]) {
+			t.Errorf("Reply %d: expected %#v, got %#v", i, expected[i], replies[i])
+		}
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	replies = c.do(t, cmd("GET", "short"), cmd("EXISTS", "short"), cmd("KEYS", "*"))
+	expected = []any{nil, int64(0), []any{"long", "plain"}}
+	if !reflect.DeepEqual(replies, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, replies)
+	}
+
+	// Keys that are not accessed again are deleted by the sweep.
+	c.do(t, cmd("SET", "swept", "value", "PX", "10"), cmd("EXPIRE", "plain", "0"))
+	time.Sleep(20 * time.Millisecond)
+	if err := s.sweepExpired(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"swept", "plain"} {
+		if _, err := db.Get(key); err == nil {
+			t.Errorf("Expected %s to be deleted", key)
+		}
+	}
+}
+
+func TestRESP_Scan(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, c := startTestRESPServer(t, db)
+	for i := 0; i < 25; i++ {
+		c.do(t, cmd("SET", fmt.Sprintf("key%02d", i), "value"))
+	}
+	c.do(t, cmd("SET", "other", "value"))
+
+	var keys []any
+	cursor := "0"
+	for {
+		reply := c.do(t, cmd("SCAN", cursor, "MATCH", "key*", "COUNT", "7"))[0].([]any)
+		cursor = reply[0].(string)
+		keys = append(keys, reply[1].([]any)...)
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(keys) != 25 {
+		t.Errorf("Expected 25 keys, got %d: %v", len(keys), keys)
+	}
+
+	if reply := c.do(t, cmd("SCAN", "12345"))[0]; reply != respError("ERR invalid cursor") {
+		t.Errorf("Expected an invalid cursor error, got %v", reply)
+	}
+}
+
+func TestRESP_Protocol(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, c := startTestRESPServer(t, db)
+
+	// Inline commands are accepted as typed in a terminal.
+	if _, err := c.conn.Write([]byte("SET inline value\r\nGET inline\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []any{"OK", "value"} {
+		if reply, err := readReply(c.r); err != nil || reply != expected {
+			t.Errorf("Expected %v, got %v (%v)", expected, reply, err)
+		}
+	}
+
+	if _, err := c.conn.Write([]byte("*1\r\n$5000\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := readReply(c.r); err != nil || !strings.HasPrefix(string(reply.(respError)), "ERR protocol error") {
+		t.Errorf("Expected a protocol error, got %v (%v)", reply, err)
+	}
+
+	if _, err := newRESPServer(datastore.NewMemoryDb(), 1024); err == nil {
+		t.Error("Expected an error for an engine without transactions")
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"key*", "key1", true},
+		{"key*", "ke", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"a/*", "a/b/c", true},
+	}
+	for _, c := range cases {
+		if got := globMatch(c.pattern, c.s); got != c.match {
+			t.Errorf("%q %q: expected %v, got %v", c.pattern, c.s, c.match, got)
+		}
+	}
+}
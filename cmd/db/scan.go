@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+const scanPath = "/db/_scan"
+
+// encodingBase64 makes keys and string values of scans, batches and
+// transactions base64 encoded. JSON strings replace bytes that are not valid
+// UTF-8, so data moved between databases is encoded to be kept byte for byte.
+const encodingBase64 = "base64"
+
+// errScanLimit stops a scan once the requested number of keys is written.
+var errScanLimit = errors.New("scan limit reached")
+
+// encodedLineBody is a line of a scan in the base64 encoding. Type tells a
+// base64 encoded string from an int64, which is written as a JSON number.
+type encodedLineBody struct {
+	Key   string `json:"key"`
+	Value any    `json:"value"`
+	Type  string `json:"type"`
+}
+
+func encodeLine(key string, value any) encodedLineBody {
+	line := encodedLineBody{Key: base64.StdEncoding.EncodeToString([]byte(key)), Value: value, Type: valueType(value)}
+	if s, ok := value.(string); ok {
+		line.Value = base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	return line
+}
+
+// checkEncoding reports an encoding other than base64 or none to the client.
+func checkEncoding(rw http.ResponseWriter, encoding string) bool {
+	if encoding != "" && encoding != encodingBase64 {
+		writeInvalidRequest(rw, "", fmt.Sprintf("unknown encoding %s", encoding))
+		return false
+	}
+	return true
+}
+
+func decodeBase64(s string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	return string(data), err
+}
+
+// decodeOps decodes the keys and string values of operations sent in the
+// base64 encoding.
+func decodeOps(ops []batchOpBody) error {
+	for i := range ops {
+		key, err := decodeBase64(ops[i].Key)
+		if err != nil {
+			return fmt.Errorf("operation %d: invalid base64 key", i)
+		}
+		ops[i].Key = key
+		if s, ok := ops[i].Value.(string); ok {
+			if ops[i].Value, err = decodeBase64(s); err != nil {
+				return fmt.Errorf("operation %d: invalid base64 value", i)
+			}
+		}
+	}
+	return nil
+}
+
+// handleScanRequest streams the keys of GET
+// /db/_scan?start={start}&end={end}&limit={limit} with their values as NDJSON
+// lines in the format read by POST /db/_bulk, so that the output of one
+// database can be loaded into another. Keys the client may not read are left
+// out, and a limit of 0 streams every key of the range. An error hit after the
+// first line has been written ends the stream with a line holding the error.
+// With encoding=base64 the lines are encoded by encodeLine instead.
+func handleScanRequest(rw http.ResponseWriter, r *http.Request, db datastore.Engine) {
+	query := r.URL.Query()
+	encoding := query.Get("encoding")
+	if !checkEncoding(rw, encoding) {
+		return
+	}
+	limit := 0
+	if query.Has("limit") {
+		var err error
+		if limit, err = strconv.Atoi(query.Get("limit")); err != nil || limit < 0 {
+			writeInvalidRequest(rw, "", fmt.Sprintf("invalid limit %s", query.Get("limit")))
+			return
+		}
+	}
+	// A scan of the whole key space may take longer than the server timeouts
+	// allow for a single request.
+	_ = http.NewResponseController(rw).SetWriteDeadline(time.Time{})
+
+	scan := db.Scan
+	if sdb, ok := db.(datastore.ScanLimitEngine); ok && limit > 0 {
+		scan = func(start, end string, fn func(key string, value any) error) error {
+			return scanPages(sdb, start, end, limit, fn)
+		}
+	}
+	c := requestClient(r)
+	enc := json.NewEncoder(rw)
+	started := false
+	written := 0
+	err := scan(query.Get("start"), query.Get("end"), func(key string, value any) error {
+		if c != nil && !c.allows(opRead, key) {
+			return nil
+		}
+		written++
+		if !started {
+			rw.Header().Set("Content-Type", "application/x-ndjson")
+			rw.WriteHeader(http.StatusOK)
+			started = true
+		}
+		var err error
+		if encoding == encodingBase64 {
+			err = enc.Encode(encodeLine(key, value))
+		} else {
+			err = enc.Encode(bulkLineBody{Key: key, Value: value})
+		}
+		if err == nil && written == limit {
+			return errScanLimit
+		}
+		return err
+	})
+	switch {
+	case errors.Is(err, errScanLimit):
+	case err != nil && !started:
+		writeStoreError(rw, "", err)
+	case err != nil:
+		_, code := storeErrorStatus(err)
+		_ = enc.Encode(errorResponseBody{Error: errorBody{Code: code, Message: err.Error()}})
+	case !started:
+		rw.Header().Set("Content-Type", "application/x-ndjson")
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// scanPages scans the range a page of limit keys at a time, so that an engine
+// reading the values of a scan up front holds at most one page of them. Keys
+// the client may not read are left out of a page, so pages are read until the
+// range ends or fn stops the scan.
+func scanPages(db datastore.ScanLimitEngine, start, end string, limit int, fn func(key string, value any) error) error {
+	for {
+		n := 0
+		last := ""
+		err := db.ScanLimit(start, end, limit, func(key string, value any) error {
+			n++
+			last = key
+			return fn(key, value)
+		})
+		if err != nil || n < limit {
+			return err
+		}
+		start = last + "\x00"
+	}
+}
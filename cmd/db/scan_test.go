@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHandleScanRequest(t *testing.T) {
+	db := mustDb(t)
+	_ = db.Put("key1", "value1")
+	_ = db.PutInt64("key2", 42)
+	_ = db.Put("other", "value")
+
+	rw := httptest.NewRecorder()
+	handleDbRequest(rw, httptest.NewRequest("GET", "/db/_scan?start=key&end=l", nil), db)
+	if rw.Code != http.StatusOK || rw.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("Unexpected response %d %s", rw.Code, rw.Header().Get("Content-Type"))
+	}
+	output := rw.Body.String()
+	var lines []bulkLineBody
+	dec := json.NewDecoder(rw.Body)
+	for dec.More() {
+		var line bulkLineBody
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 || lines[0] != (bulkLineBody{"key1", "value1"}) || lines[1] != (bulkLineBody{"key2", float64(42)}) {
+		t.Errorf("Unexpected lines %+v", lines)
+	}
+
+	// The output is loaded by a bulk request as it is.
+	other := mustDb(t)
+	rw = httptest.NewRecorder()
+	handleDbRequest(rw, httptest.NewRequest("POST", "/db/_bulk", strings.NewReader(output)), other)
+	if v, err := other.GetInt64("key2"); err != nil || v != 42 {
+		t.Errorf("Bad value loaded: %d (%v)", v, err)
+	}
+
+	rw = httptest.NewRecorder()
+	handleDbRequest(rw, httptest.NewRequest("GET", "/db/_scan?limit=2", nil), db)
+	if lines := strings.Count(rw.Body.String(), "\n"); lines != 2 {
+		t.Errorf("Expected 2 lines, got %d", lines)
+	}
+	rw = httptest.NewRecorder()
+	handleDbRequest(rw, httptest.NewRequest("GET", "/db/_scan?limit=-1", nil), db)
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+
+	// An empty scan is an empty stream.
+	rw = httptest.NewRecorder()
+	handleDbRequest(rw, httptest.NewRequest("GET", "/db/_scan?start=x", nil), db)
+	if rw.Code != http.StatusOK || rw.Body.Len() != 0 {
+		t.Errorf("Unexpected response %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestHandleScanRequest_Base64(t *testing.T) {
+	db := mustDb(t)
+	_ = db.Put("key\xff", "value\xfe\x00")
+	_ = db.PutInt64("large", 1<<60+1)
+
+	rw := httptest.NewRecorder()
+	handleDbRequest(rw, httptest.NewRequest("GET", "/db/_scan?encoding=base64", nil), db)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code %d", rw.Code)
+	}
+	var writes []batchOpBody
+	dec := json.NewDecoder(rw.Body)
+	dec.UseNumber()
+	for dec.More() {
+		var line encodedLineBody
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		writes = append(writes, batchOpBody{Op: "put", Key: line.Key, Value: line.Value})
+	}
+	expected := []batchOpBody{
+		{"put", "a2V5/w==", "dmFsdWX+AA=="},
+		{"put", "bGFyZ2U=", json.Number("1152921504606846977")},
+	}
+	if !reflect.DeepEqual(writes, expected) {
+		t.Errorf("Unexpected lines %+v", writes)
+	}
+
+	// The lines are written to another database by a transaction unchanged.
+	other := mustDb(t)
+	body, _ := json.Marshal(txBody{Reads: map[string]uint64{"a2V5/w==": 0}, Writes: writes, Encoding: encodingBase64})
+	rw = httptest.NewRecorder()
+	handleDbRequest(rw, httptest.NewRequest("POST", "/db/_tx", strings.NewReader(string(body))), other)
+	if rw.Code != http.StatusCreated {
+		t.Fatalf("Unexpected response %d %s", rw.Code, rw.Body)
+	}
+	if v, err := other.Get("key\xff"); err != nil || v != "value\xfe\x00" {
+		t.Errorf("Bad value written: %q (%v)", v, err)
+	}
+	if v, err := other.GetInt64("large"); err != nil || v != 1<<60+1 {
+		t.Errorf("Bad value written: %d (%v)", v, err)
+	}
+
+	for _, c := range []struct{ method, url, body string }{
+		{"GET", "/db/_scan?encoding=hex", ""},
+		{"POST", "/db/_batch", `{"ops":[{"op":"delete","key":"a2V5/w=="}],"encoding":"hex"}`},
+		{"POST", "/db/_batch", `{"ops":[{"op":"delete","key":"!"}],"encoding":"base64"}`},
+	} {
+		rw = httptest.NewRecorder()
+		handleDbRequest(rw, httptest.NewRequest(c.method, c.url, strings.NewReader(c.body)), other)
+		if rw.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: unexpected status code %d", c.method, c.url, rw.Code)
+		}
+	}
+	rw = httptest.NewRecorder()
+	handleDbRequest(rw, httptest.NewRequest("POST", "/db/_batch", strings.NewReader(`{"ops":[{"op":"delete","key":"a2V5/w=="}],"encoding":"base64"}`)), other)
+	if _, err := other.Get("key\xff"); rw.Code != http.StatusCreated || err == nil {
+		t.Errorf("Key was not deleted: %d (%v)", rw.Code, err)
+	}
+}
+
+func TestHandleScanRequest_LimitAuth(t *testing.T) {
+	policy, err := mustPolicy(t, testPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := mustDb(t)
+	for _, key := range []string{"alpha1", "alpha2", "beta1", "beta2", "beta3", "shared1", "shared2"} {
+		_ = db.Put(key, "value")
+	}
+	handler := policy.wrap(func(rw http.ResponseWriter, r *http.Request) {
+		handleDbRequest(rw, r, db)
+	})
+
+	// The keys of beta fill a page of the limit, and the scan goes on past it.
+	req := httptest.NewRequest("GET", "/db/_scan?start=alpha2&limit=2", nil)
+	req.Header.Set("Authorization", "Bearer alpha-key")
+	rw := httptest.NewRecorder()
+	handler(rw, req)
+	var keys []string
+	dec := json.NewDecoder(rw.Body)
+	for dec.More() {
+		var line bulkLineBody
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, line.Key)
+	}
+	if expected := []string{"alpha2", "shared1"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected keys %v, got %v", expected, keys)
+	}
+}
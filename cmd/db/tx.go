@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+// txBody holds the versions of keys the client has read, as returned by GET
+// requests (0 for keys that were not found), and the writes to apply if none
+// of those keys has changed since.
+type txBody struct {
+	Reads  map[string]uint64 `json:"reads"`
+	Writes []batchOpBody     `json:"writes"`
+	// Encoding is base64 for keys and string values encoded by the client.
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func handleTxRequest(rw http.ResponseWriter, r *http.Request, db datastore.Engine) {
+	tdb, ok := db.(datastore.TransactionalEngine)
+	if !ok {
+		writeNotImplemented(rw, "storage engine does not support transactions")
+		return
+	}
+
+	var tb txBody
+	if !decodeRequestBody(rw, r, &tb) || !checkEncoding(rw, tb.Encoding) {
+		return
+	}
+	if tb.Encoding == encodingBase64 {
+		reads := make(map[string]uint64, len(tb.Reads))
+		for k, version := range tb.Reads {
+			key, err := decodeBase64(k)
+			if err != nil {
+				writeInvalidRequest(rw, "", "invalid base64 key")
+				return
+			}
+			reads[key] = version
+		}
+		tb.Reads = reads
+		if err := decodeOps(tb.Writes); err != nil {
+			writeInvalidRequest(rw, "", err.Error())
+			return
+		}
+	}
+	if !authorizeOps(rw, r, tb.Writes) {
+		return
+	}
+	for k := range tb.Reads {
+		if !authorize(rw, r, opRead, k) {
+			return
+		}
+	}
+
+	tx := tdb.Begin()
+	for k, version := range tb.Reads {
+		tx.Expect(k, version)
+	}
+	if err := addOps(tx, tb.Writes); err != nil {
+		writeInvalidRequest(rw, "", err.Error())
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeStoreError(rw, "", err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusCreated)
+}
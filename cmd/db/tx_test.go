@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+func TestHandleTxRequest(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_ = db.PutInt64("counter", 1)
+
+	rw := httptest.NewRecorder()
+	handleGetRequest(rw, httptest.NewRequest("GET", "/db/counter?type=int64", nil), db)
+	var body responseBody
+	if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Version != 1 {
+		t.Fatalf("Unexpected version %d", body.Version)
+	}
+
+	tx := fmt.Sprintf(`{"reads":{"counter":%d,"created":0},"writes":[{"op":"put","key":"counter","value":2},{"op":"put","key":"created","value":"yes"}]}`, body.Version)
+	rw = httptest.NewRecorder()
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/_tx", strings.NewReader(tx)), db)
+	if rw.Code != http.StatusCreated {
+		t.Errorf("Unexpected status code %d: %s", rw.Code, rw.Body)
+	}
+	if v, err := db.GetInt64("counter"); err != nil || v != 2 {
+		t.Errorf("Bad value stored: %d (%v)", v, err)
+	}
+
+	rw = httptest.NewRecorder()
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/_tx", strings.NewReader(tx)), db)
+	if rw.Code != http.StatusConflict {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+}
+
+func TestHandleTxRequest_Unsupported(t *testing.T) {
+	db := datastore.NewMemoryDb()
+
+	rw := httptest.NewRecorder()
+	handlePostRequest(rw, httptest.NewRequest("POST", "/db/_tx", strings.NewReader(`{}`)), db)
+	if rw.Code != http.StatusNotImplemented {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+}
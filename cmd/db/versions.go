@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+type versionBody struct {
+	Version uint64 `json:"version"`
+	Value   any    `json:"value"`
+}
+
+type historyBody struct {
+	Key      string        `json:"key"`
+	Versions []versionBody `json:"versions"`
+}
+
+func versionedEngine(rw http.ResponseWriter, db datastore.Engine) (datastore.VersionedEngine, bool) {
+	vdb, ok := db.(datastore.VersionedEngine)
+	if !ok {
+		writeNotImplemented(rw, "storage engine does not retain versions")
+	}
+	return vdb, ok
+}
+
+func handleVersionRequest(rw http.ResponseWriter, r *http.Request, db datastore.Engine, k string) {
+	vdb, ok := versionedEngine(rw, db)
+	if !ok {
+		return
+	}
+	number, err := strconv.ParseUint(r.URL.Query().Get("version"), 10, 64)
+	if err != nil {
+		writeInvalidRequest(rw, k, "invalid version")
+		return
+	}
+
+	v, err := vdb.GetVersion(k, number)
+	if err == nil {
+		err = checkType(v, r.URL.Query().Get("type"))
+	}
+	if errors.Is(err, datastore.ErrNotFound) {
+		writeError(rw, http.StatusNotFound, codeNotFound, k, fmt.Sprintf("no value found for key %s version %d", k, number))
+		return
+	}
+	if err != nil {
+		writeStoreError(rw, k, err)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(rw).Encode(responseBody{Key: k, Value: v, Version: number}); err != nil {
+		writeError(rw, http.StatusInternalServerError, codeInternal, k, "json encoding error")
+	}
+}
+
+func handleHistoryRequest(rw http.ResponseWriter, db datastore.Engine, k string) {
+	vdb, ok := versionedEngine(rw, db)
+	if !ok {
+		return
+	}
+	history, err := vdb.History(k)
+	if err != nil {
+		writeKeyError(rw, k, err)
+		return
+	}
+
+	body := historyBody{Key: k, Versions: make([]versionBody, len(history))}
+	for i, v := range history {
+		body.Versions[i] = versionBody{Version: v.Number, Value: v.Value}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(rw).Encode(body); err != nil {
+		writeError(rw, http.StatusInternalServerError, codeInternal, k, "json encoding error")
+	}
+}
+
+func checkType(v any, t string) error {
+	switch t {
+	case "string", "":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%w: string", datastore.ErrTypeMismatch)
+		}
+	case "int64":
+		if _, ok := v.(int64); !ok {
+			return fmt.Errorf("%w: int64", datastore.ErrTypeMismatch)
+		}
+	default:
+		return fmt.Errorf("invalid data type %s", t)
+	}
+	return nil
+}
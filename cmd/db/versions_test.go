@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+func TestHandleGetRequest_Versions(t *testing.T) {
+	db, err := datastore.NewDbWithOptions(t.TempDir(), datastore.Options{SegmentSize: 1024, Versions: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, v := range []string{"v1", "v2", "v3"} {
+		if err := db.Put("key", v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	handleGetRequest(rw, httptest.NewRequest("GET", "/db/key?version=2", nil), db)
+	var body responseBody
+	if err := json.NewDecoder(rw.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if rw.Code != http.StatusOK || body.Value != "v2" || body.Version != 2 {
+		t.Errorf("Unexpected response %d %v", rw.Code, body)
+	}
+
+	rw = httptest.NewRecorder()
+	handleGetRequest(rw, httptest.NewRequest("GET", "/db/key?version=1", nil), db)
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	handleGetRequest(rw, httptest.NewRequest("GET", "/db/key/_history", nil), db)
+	var history historyBody
+	if err := json.NewDecoder(rw.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	expected := []versionBody{{Version: 2, Value: "v2"}, {Version: 3, Value: "v3"}}
+	if rw.Code != http.StatusOK || !reflect.DeepEqual(history.Versions, expected) {
+		t.Errorf("Unexpected response %d %v", rw.Code, history)
+	}
+
+	rw = httptest.NewRecorder()
+	handleGetRequest(rw, httptest.NewRequest("GET", "/db/key/_history", nil), datastore.NewMemoryDb())
+	if rw.Code != http.StatusNotImplemented {
+		t.Errorf("Unexpected status code %d", rw.Code)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+var (
+	serverURL   = flag.String("url", "", "base URL of a cmd/db server; the library is used in process if empty")
+	engine      = flag.String("engine", "log", "storage engine used in process: log, lsm or memory")
+	dir         = flag.String("dir", "", "database directory used in process; a temporary one is used if empty")
+	segmentSize = flag.Int("segment", 10*1024*1024, "size of database segment used in process")
+
+	keys        = flag.Int("keys", 10000, "number of distinct keys")
+	readRatio   = flag.Float64("read-ratio", 0.9, "fraction of operations that are reads")
+	valueSize   = flag.String("value-size", "100", "value size in bytes, or a min-max range of uniformly distributed sizes")
+	distrib     = flag.String("dist", "uniform", "key distribution: uniform or zipf")
+	zipfS       = flag.Float64("zipf-s", 1.1, "exponent of the Zipfian distribution, greater than 1")
+	concurrency = flag.Int("concurrency", 8, "number of concurrent workers")
+	duration    = flag.Duration("duration", 10*time.Second, "duration of the run")
+	seed        = flag.Int64("seed", time.Now().UnixNano(), "random seed")
+	fill        = flag.Bool("prefill", true, "write every key before the run")
+	timeout     = flag.Duration("timeout", 10*time.Second, "timeout of HTTP requests")
+)
+
+func parseValueSize(s string) (int, int, error) {
+	minSize, maxSize, isRange := strings.Cut(s, "-")
+	lo, err := strconv.Atoi(minSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid value size %q", s)
+	}
+	if !isRange {
+		return lo, lo, nil
+	}
+	hi, err := strconv.Atoi(maxSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid value size %q", s)
+	}
+	return lo, hi, nil
+}
+
+func openTarget() (target, error) {
+	if *serverURL != "" {
+		return newHTTPTarget(*serverURL, *timeout), nil
+	}
+	var db datastore.Engine
+	var temp string
+	var err error
+	switch *engine {
+	case "memory":
+		db = datastore.NewMemoryDb()
+	case "log", "lsm":
+		path := *dir
+		if path == "" {
+			if path, err = os.MkdirTemp("", "dbbench"); err != nil {
+				return nil, err
+			}
+			temp = path
+		}
+		if *engine == "log" {
+			db, err = datastore.NewDb(path, *segmentSize)
+		} else {
+			db, err = datastore.NewLsmDb(path, *segmentSize)
+		}
+	default:
+		err = fmt.Errorf("unknown storage engine %s", *engine)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &engineTarget{db: db, temp: temp}, nil
+}
+
+func main() {
+	flag.Parse()
+
+	valueMin, valueMax, err := parseValueSize(*valueSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := workload{
+		keys:        *keys,
+		readRatio:   *readRatio,
+		valueMin:    valueMin,
+		valueMax:    valueMax,
+		zipf:        *distrib == "zipf",
+		zipfS:       *zipfS,
+		concurrency: *concurrency,
+		duration:    *duration,
+		seed:        *seed,
+	}
+	if *distrib != "uniform" && *distrib != "zipf" {
+		log.Fatalf("unknown key distribution %s", *distrib)
+	}
+	if err := w.validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	t, err := openTarget()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer func() {
+		if err := t.close(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if *fill {
+		log.Printf("writing %d keys", w.keys)
+		if err := prefill(t, w); err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Printf("running for %v with %d workers", w.duration, w.concurrency)
+	res := run(t, w)
+	s, err := t.stats()
+	if err != nil {
+		log.Printf("failed to read stats: %v", err)
+	}
+	writeReport(os.Stdout, res, s)
+}
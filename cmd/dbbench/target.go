@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+// target is the store a benchmark runs against.
+type target interface {
+	// get reads the key. A missing key is not an error.
+	get(key string) error
+	put(key, value string) error
+	stats() (targetStats, error)
+	close() error
+}
+
+type targetStats struct {
+	Keys     int
+	Segments int
+	Merges   uint64
+}
+
+// engineTarget runs the benchmark in process against a storage engine.
+type engineTarget struct {
+	db datastore.Engine
+	// temp is a temporary directory removed when the target is closed.
+	temp string
+}
+
+func (t *engineTarget) get(key string) error {
+	_, err := t.db.Get(key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (t *engineTarget) put(key, value string) error {
+	return t.db.Put(key, value)
+}
+
+func (t *engineTarget) stats() (targetStats, error) {
+	s := t.db.Stats()
+	return targetStats{Keys: s.Keys, Segments: s.Segments, Merges: s.Merges}, nil
+}
+
+func (t *engineTarget) close() error {
+	if err := t.db.Close(); err != nil {
+		return err
+	}
+	if t.temp != "" {
+		return os.RemoveAll(t.temp)
+	}
+	return nil
+}
+
+// httpTarget runs the benchmark against the HTTP API of cmd/db.
+type httpTarget struct {
+	base   string
+	client *http.Client
+}
+
+func newHTTPTarget(base string, timeout time.Duration) *httpTarget {
+	return &httpTarget{
+		base: strings.TrimSuffix(base, "/"),
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				// Every worker keeps its connection alive between requests.
+				MaxIdleConnsPerHost: 1024,
+			},
+		},
+	}
+}
+
+func (t *httpTarget) get(key string) error {
+	resp, err := t.client.Get(t.base + "/db/" + url.PathEscape(key))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("GET %s: unexpected status %d", key, resp.StatusCode)
+	}
+	return nil
+}
+
+func (t *httpTarget) put(key, value string) error {
+	body, err := json.Marshal(struct {
+		Value string `json:"value"`
+	}{Value: value})
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.base+"/db/"+url.PathEscape(key), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("POST %s: unexpected status %d", key, resp.StatusCode)
+	}
+	return nil
+}
+
+// stats reads the gauges it needs from the /metrics endpoint.
+func (t *httpTarget) stats() (targetStats, error) {
+	var s targetStats
+	resp, err := t.client.Get(t.base + "/metrics")
+	if err != nil {
+		return s, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s, fmt.Errorf("GET /metrics: unexpected status %d", resp.StatusCode)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		switch name {
+		case "datastore_keys":
+			s.Keys, _ = strconv.Atoi(value)
+		case "datastore_segments":
+			s.Segments, _ = strconv.Atoi(value)
+		case "datastore_merges_total":
+			s.Merges, _ = strconv.ParseUint(value, 10, 64)
+		}
+	}
+	return s, scanner.Err()
+}
+
+func (t *httpTarget) close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type workload struct {
+	keys        int
+	readRatio   float64
+	valueMin    int
+	valueMax    int
+	zipf        bool
+	zipfS       float64
+	concurrency int
+	duration    time.Duration
+	seed        int64
+}
+
+func (w workload) validate() error {
+	switch {
+	case w.keys <= 0:
+		return fmt.Errorf("key count must be positive")
+	case w.readRatio < 0 || w.readRatio > 1:
+		return fmt.Errorf("read ratio must be between 0 and 1")
+	case w.valueMin < 0 || w.valueMax < w.valueMin:
+		return fmt.Errorf("invalid value size range %d-%d", w.valueMin, w.valueMax)
+	case w.zipf && w.zipfS <= 1:
+		return fmt.Errorf("zipf exponent must be greater than 1")
+	case w.concurrency <= 0:
+		return fmt.Errorf("concurrency must be positive")
+	}
+	return nil
+}
+
+func key(i int) string {
+	return fmt.Sprintf("key-%08d", i)
+}
+
+// worker holds the per-goroutine random state of a workload.
+type worker struct {
+	w    workload
+	r    *rand.Rand
+	zipf *rand.Zipf
+}
+
+func newWorker(w workload, id int) *worker {
+	r := rand.New(rand.NewSource(w.seed + int64(id)))
+	wk := &worker{w: w, r: r}
+	if w.zipf {
+		wk.zipf = rand.NewZipf(r, w.zipfS, 1, uint64(w.keys-1))
+	}
+	return wk
+}
+
+// nextKey picks a key. With the Zipfian distribution low key numbers are the
+// most popular ones.
+func (wk *worker) nextKey() string {
+	if wk.zipf != nil {
+		return key(int(wk.zipf.Uint64()))
+	}
+	return key(wk.r.Intn(wk.w.keys))
+}
+
+func (wk *worker) nextValue() string {
+	size := wk.w.valueMin
+	if wk.w.valueMax > wk.w.valueMin {
+		size += wk.r.Intn(wk.w.valueMax - wk.w.valueMin + 1)
+	}
+	return strings.Repeat(string(rune('a'+wk.r.Intn(26))), size)
+}
+
+type result struct {
+	reads   []time.Duration
+	writes  []time.Duration
+	errors  int
+	lastErr error
+	elapsed time.Duration
+}
+
+func (r *result) merge(other *result) {
+	r.reads = append(r.reads, other.reads...)
+	r.writes = append(r.writes, other.writes...)
+	r.errors += other.errors
+	if other.lastErr != nil {
+		r.lastErr = other.lastErr
+	}
+}
+
+// prefill writes every key once so that reads do not hit missing keys.
+func prefill(t target, w workload) error {
+	keys := make(chan int)
+	errs := make(chan error, w.concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < w.concurrency; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			wk := newWorker(w, id)
+			for k := range keys {
+				if err := t.put(key(k), wk.nextValue()); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	var err error
+loop:
+	for k := 0; k < w.keys; k++ {
+		select {
+		case keys <- k:
+		case err = <-errs:
+			break loop
+		}
+	}
+	close(keys)
+	wg.Wait()
+	return err
+}
+
+// run executes the workload until its duration elapses.
+func run(t target, w workload) *result {
+	deadline := time.Now().Add(w.duration)
+	results := make([]*result, w.concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range results {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			wk := newWorker(w, id)
+			res := new(result)
+			for time.Now().Before(deadline) {
+				k := wk.nextKey()
+				read := wk.r.Float64() < w.readRatio
+				var value string
+				if !read {
+					value = wk.nextValue()
+				}
+				opStart := time.Now()
+				var err error
+				if read {
+					err = t.get(k)
+				} else {
+					err = t.put(k, value)
+				}
+				d := time.Since(opStart)
+				if err != nil {
+					res.errors++
+					res.lastErr = err
+					continue
+				}
+				if read {
+					res.reads = append(res.reads, d)
+				} else {
+					res.writes = append(res.writes, d)
+				}
+			}
+			results[id] = res
+		}(i)
+	}
+	wg.Wait()
+
+	total := &result{elapsed: time.Since(start)}
+	for _, res := range results {
+		total.merge(res)
+	}
+	return total
+}
+
+// percentile returns the p-th percentile of sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	// The rank is rounded first so that floating point noise, as in
+	// 99.9/100*1000, does not move it to the next latency.
+	rank := math.Round(p/100*float64(len(sorted))*1e6) / 1e6
+	i := int(math.Ceil(rank)) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func writeLatencies(out io.Writer, name string, latencies []time.Duration, elapsed time.Duration) {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	fmt.Fprintf(out, "%-6s %10d ops %12.1f ops/s", name, len(latencies), float64(len(latencies))/elapsed.Seconds())
+	for _, p := range []float64{50, 90, 99, 99.9} {
+		fmt.Fprintf(out, "  p%v %v", p, percentile(latencies, p))
+	}
+	var maxLatency time.Duration
+	if len(latencies) > 0 {
+		maxLatency = latencies[len(latencies)-1]
+	}
+	fmt.Fprintf(out, "  max %v\n", maxLatency)
+}
+
+func writeReport(out io.Writer, r *result, s targetStats) {
+	total := len(r.reads) + len(r.writes)
+	fmt.Fprintf(out, "duration %v, %d ops, %.1f ops/s, %d errors\n",
+		r.elapsed.Round(time.Millisecond), total, float64(total)/r.elapsed.Seconds(), r.errors)
+	if r.lastErr != nil {
+		fmt.Fprintf(out, "last error: %v\n", r.lastErr)
+	}
+	writeLatencies(out, "reads", r.reads, r.elapsed)
+	writeLatencies(out, "writes", r.writes, r.elapsed)
+	fmt.Fprintf(out, "keys %d, segments %d, merges %d\n", s.Keys, s.Segments, s.Merges)
+}
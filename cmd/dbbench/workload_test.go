@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kushnirko/kpi-apz-lab-5/datastore"
+)
+
+func TestPercentile(t *testing.T) {
+	var latencies []time.Duration
+	for i := 1; i <= 1000; i++ {
+		latencies = append(latencies, time.Duration(i))
+	}
+	for p, expected := range map[float64]time.Duration{50: 500, 90: 900, 99: 990, 99.9: 999, 100: 1000} {
+		if got := percentile(latencies, p); got != expected {
+			t.Errorf("p%v: expected %d, got %d", p, expected, got)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("Expected 0 for no latencies, got %d", got)
+	}
+}
+
+func TestParseValueSize(t *testing.T) {
+	if lo, hi, err := parseValueSize("100"); err != nil || lo != 100 || hi != 100 {
+		t.Errorf("Bad fixed size: %d-%d (%v)", lo, hi, err)
+	}
+	if lo, hi, err := parseValueSize("10-200"); err != nil || lo != 10 || hi != 200 {
+		t.Errorf("Bad size range: %d-%d (%v)", lo, hi, err)
+	}
+	if _, _, err := parseValueSize("10-"); err == nil {
+		t.Error("Expected an error for an invalid range")
+	}
+}
+
+func TestWorker_Zipf(t *testing.T) {
+	wk := newWorker(workload{keys: 1000, zipf: true, zipfS: 1.5}, 0)
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[wk.nextKey()]++
+	}
+	if counts[key(0)] < counts[key(100)]*10 {
+		t.Errorf("Keys are not skewed: %d hits for the first key, %d for the 100th", counts[key(0)], counts[key(100)])
+	}
+	for k := range counts {
+		if k > key(999) {
+			t.Errorf("Key %s is out of range", k)
+		}
+	}
+}
+
+func TestRun_Engine(t *testing.T) {
+	db, err := datastore.NewDb(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := &engineTarget{db: db}
+	defer target.close()
+
+	w := workload{keys: 100, readRatio: 0.5, valueMin: 10, valueMax: 50, concurrency: 4, duration: 200 * time.Millisecond}
+	if err := prefill(target, w); err != nil {
+		t.Fatal(err)
+	}
+	res := run(target, w)
+	if res.errors != 0 {
+		t.Fatalf("Unexpected errors: %v", res.lastErr)
+	}
+	if len(res.reads) == 0 || len(res.writes) == 0 {
+		t.Fatalf("Expected both reads and writes, got %d and %d", len(res.reads), len(res.writes))
+	}
+	s, err := target.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Keys != 100 || s.Segments < 2 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+
+	var out bytes.Buffer
+	writeReport(&out, res, s)
+	for _, expected := range []string{"reads", "writes", "p99", "keys 100"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Report does not mention %q:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestRun_HTTP(t *testing.T) {
+	var mu sync.Mutex
+	data := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path == "/metrics" {
+			fmt.Fprintf(rw, "# TYPE datastore_keys gauge\ndatastore_keys %d\ndatastore_segments 3\ndatastore_merges_total 2\n", len(data))
+			return
+		}
+		k := strings.TrimPrefix(r.URL.Path, "/db/")
+		switch r.Method {
+		case http.MethodGet:
+			if _, ok := data[k]; !ok {
+				rw.WriteHeader(http.StatusNotFound)
+			}
+		case http.MethodPost:
+			var body struct {
+				Value string `json:"value"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			data[k] = body.Value
+			rw.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	target := newHTTPTarget(server.URL, time.Second)
+	defer target.close()
+	w := workload{keys: 10, readRatio: 0.5, valueMin: 5, valueMax: 5, concurrency: 2, duration: 100 * time.Millisecond}
+	res := run(target, w)
+	if res.errors != 0 {
+		t.Fatalf("Unexpected errors: %v", res.lastErr)
+	}
+	s, err := target.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Keys == 0 || s.Segments != 3 || s.Merges != 2 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+}
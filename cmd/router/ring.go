@@ -0,0 +1,99 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"strconv"
+)
+
+// ringPoint is a virtual node: a position on the hash ring owned by a node.
+type ringPoint struct {
+	Hash uint32 `json:"hash"`
+	Node string `json:"node"`
+}
+
+// ring maps keys to nodes with consistent hashing. Every node owns vnodes
+// points of the ring, and a key belongs to the node owning the first point at
+// or after the hash of the key. Adding a node moves only the keys falling
+// between its points and the points before them. A ring is not modified once
+// built, so it may be shared between goroutines.
+type ring struct {
+	vnodes int
+	nodes  []string
+	points []ringPoint
+}
+
+func hashKey(key string) uint32 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+func newRing(vnodes int, nodes ...string) *ring {
+	r := &ring{vnodes: vnodes}
+	for _, node := range nodes {
+		r = r.withNode(node)
+	}
+	return r
+}
+
+// withNode returns a copy of the ring with the node added.
+func (r *ring) withNode(node string) *ring {
+	next := &ring{
+		vnodes: r.vnodes,
+		nodes:  append(slices.Clip(r.nodes), node),
+		points: make([]ringPoint, 0, len(r.points)+r.vnodes),
+	}
+	next.points = append(next.points, r.points...)
+	for i := 0; i < r.vnodes; i++ {
+		next.points = append(next.points, ringPoint{Hash: hashKey(node + "#" + strconv.Itoa(i)), Node: node})
+	}
+	// Points of different nodes sharing a hash are ordered by node, so that
+	// the owner of a key does not depend on the order the nodes were added in.
+	slices.SortFunc(next.points, func(a, b ringPoint) int {
+		if a.Hash != b.Hash {
+			return cmp.Compare(a.Hash, b.Hash)
+		}
+		return cmp.Compare(a.Node, b.Node)
+	})
+	return next
+}
+
+func (r *ring) has(node string) bool {
+	return slices.Contains(r.nodes, node)
+}
+
+// node returns the node owning the key, or an empty string if the ring has no
+// nodes.
+func (r *ring) node(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i, _ := slices.BinarySearchFunc(r.points, h, func(p ringPoint, h uint32) int {
+		return cmp.Compare(p.Hash, h)
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].Node
+}
+
+// shares returns the part of the hash space owned by every node.
+func (r *ring) shares() map[string]float64 {
+	shares := make(map[string]float64, len(r.nodes))
+	for _, node := range r.nodes {
+		shares[node] = 0
+	}
+	for i, p := range r.points {
+		// A point owns the hashes after the point before it, the first point
+		// wraps around the end of the ring.
+		prev := r.points[(i+len(r.points)-1)%len(r.points)].Hash
+		shares[p.Node] += float64(p.Hash-prev) / (1 << 32)
+	}
+	if len(r.points) == 1 {
+		shares[r.points[0].Node] = 1
+	}
+	return shares
+}
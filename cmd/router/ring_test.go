@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	if node := newRing(8).node("key"); node != "" {
+		t.Errorf("Expected no node on an empty ring, got %s", node)
+	}
+
+	nodes := []string{"shard1:8080", "shard2:8080", "shard3:8080"}
+	r := newRing(64, nodes...)
+	if len(r.points) != 192 {
+		t.Fatalf("Expected 192 points, got %d", len(r.points))
+	}
+	total := 0.0
+	for node, share := range r.shares() {
+		if share < 0.2 || share > 0.5 {
+			t.Errorf("Unbalanced share of %s: %f", node, share)
+		}
+		total += share
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Errorf("Shares add up to %f", total)
+	}
+
+	// The owner of a key does not depend on the order of the nodes.
+	reversed := newRing(64, nodes[2], nodes[1], nodes[0])
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if r.node(key) != reversed.node(key) {
+			t.Fatalf("Key %s has different owners", key)
+		}
+	}
+
+	// Adding a node only moves keys to it.
+	next := r.withNode("shard4:8080")
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if before, after := r.node(key), next.node(key); before != after {
+			if after != "shard4:8080" {
+				t.Errorf("Key %s moved from %s to %s", key, before, after)
+			}
+			moved++
+		}
+	}
+	if moved < 100 || moved > 400 {
+		t.Errorf("Unexpected number of moved keys %d", moved)
+	}
+	if len(r.nodes) != 3 || len(r.points) != 192 {
+		t.Error("The ring was modified by adding a node")
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kushnirko/kpi-apz-lab-5/dbclient"
+	"github.com/kushnirko/kpi-apz-lab-5/httptools"
+	"github.com/kushnirko/kpi-apz-lab-5/logger"
+	"github.com/kushnirko/kpi-apz-lab-5/signal"
+)
+
+var (
+	port     = flag.Int("port", 8080, "router port")
+	nodes    = flag.String("nodes", "", "comma-separated addresses of the database nodes, e.g. shard1:8080,shard2:8080; nodes added at runtime have to be listed here before a restart")
+	vnodes   = flag.Int("vnodes", 64, "number of virtual nodes of every database node on the hash ring")
+	timeout  = flag.Duration("timeout", 3*time.Second, "timeout of a request to a database node")
+	apiKey   = flag.String("api-key", "", "API key used to move keys between database nodes that require authentication")
+	adminKey = flag.String("admin-key", "", "API key required as a bearer token by the /admin endpoints, which are disabled without one")
+	pageSize = flag.Int("rebalance-page", 1000, "number of keys read from a database node at once while rebalancing")
+
+	logEnabled = flag.Bool("log", true, "whether to write logs to stdout")
+)
+
+const (
+	codeInvalidRequest   = "invalid_request"
+	codeConflict         = "conflict"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeNotImplemented   = "not_implemented"
+	codeUnavailable      = "unavailable"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+
+	rebalanceRunning = "running"
+	rebalanceDone    = "done"
+	rebalanceFailed  = "failed"
+)
+
+// reservedKeys are the paths under /db/ that cmd/db serves for several keys
+// at once. Their keys may live on different nodes, so they are not routed.
+var reservedKeys = []string{"_batch", "_tx", "_bulk", "_mget", "_scan", "_index", "_buckets"}
+
+type errorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Key     string `json:"key,omitempty"`
+}
+
+type errorResponseBody struct {
+	Error errorBody `json:"error"`
+}
+
+// writeError responds with an error in the format used by cmd/db.
+func writeError(rw http.ResponseWriter, status int, code, key, message string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(errorResponseBody{Error: errorBody{Code: code, Message: message, Key: key}})
+}
+
+type nodeBody struct {
+	Address string  `json:"address"`
+	Share   float64 `json:"share"`
+}
+
+// rebalanceBody reports the progress of moving keys to an added node.
+type rebalanceBody struct {
+	Node    string `json:"node"`
+	State   string `json:"state"`
+	Scanned int    `json:"scanned"`
+	Moved   int    `json:"moved"`
+	Error   string `json:"error,omitempty"`
+}
+
+type ringBody struct {
+	VNodes    int            `json:"vnodes"`
+	Nodes     []nodeBody     `json:"nodes"`
+	Points    []ringPoint    `json:"points"`
+	Rebalance *rebalanceBody `json:"rebalance,omitempty"`
+}
+
+type addNodeBody struct {
+	Address string `json:"address"`
+}
+
+// router forwards requests for single keys to the database nodes owning them.
+type router struct {
+	client   *http.Client
+	opts     dbclient.Options
+	pageSize int
+	adminKey string
+
+	mu   sync.Mutex
+	ring *ring
+	// prev is the ring before the last node was added. It is kept until the
+	// keys moving to the node are rebalanced, and reads of keys not found on
+	// their node fall back to their node in prev meanwhile.
+	prev      *ring
+	rebalance *rebalanceBody
+}
+
+func newRouter(r *ring, opts dbclient.Options, pageSize int, adminKey string) *router {
+	if opts.Timeout <= 0 {
+		opts.Timeout = dbclient.DefaultTimeout
+	}
+	return &router{
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost: 64,
+			IdleConnTimeout:     90 * time.Second,
+		}},
+		opts:     opts,
+		pageSize: pageSize,
+		adminKey: adminKey,
+		ring:     r,
+	}
+}
+
+// admin passes only requests carrying the admin key as a bearer token on to
+// h. The admin endpoints change the ring, so they are disabled unless the
+// router has a key.
+func (rt *router) admin(h http.HandlerFunc) http.HandlerFunc {
+	want := sha256.Sum256([]byte(rt.adminKey))
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if rt.adminKey == "" {
+			writeError(rw, http.StatusForbidden, codeForbidden, "", "the admin API is disabled, start the router with -admin-key to enable it")
+			return
+		}
+		// Comparing hashes takes the same time whatever the length of the token.
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		got := sha256.Sum256([]byte(token))
+		if !ok || subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="router"`)
+			writeError(rw, http.StatusUnauthorized, codeUnauthorized, "", "missing or invalid admin key")
+			return
+		}
+		h(rw, r)
+	}
+}
+
+// owners returns the nodes to send a request for the key to, in order.
+func (rt *router) owners(key string, read bool) []string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	node := rt.ring.node(key)
+	if !read || rt.prev == nil {
+		return []string{node}
+	}
+	prev := rt.prev.node(key)
+	if prev == node {
+		return []string{node}
+	}
+	// The key may be moved to its node between the first two reads, so its
+	// node is asked once more if the previous one no longer has it.
+	return []string{node, prev, node}
+}
+
+func (rt *router) handleDbRequest(rw http.ResponseWriter, r *http.Request) {
+	pathParts := strings.Split(r.URL.EscapedPath(), "/")
+	if len(pathParts) != 3 || pathParts[2] == "" || slices.Contains(reservedKeys, pathParts[2]) {
+		writeError(rw, http.StatusNotImplemented, codeNotImplemented, "", "the router only serves requests for single keys of the default bucket")
+		return
+	}
+	// Keys are hashed unescaped, the way cmd/db stores and lists them, so that
+	// a key is routed to the node rebalancing moves it to.
+	key, err := url.PathUnescape(pathParts[2])
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, codeInvalidRequest, "", "invalid url path")
+		return
+	}
+	switch r.Method {
+	case "GET", "HEAD":
+		rt.forward(rw, r, key, rt.owners(key, true))
+	case "POST", "PUT":
+		rt.forward(rw, r, key, rt.owners(key, false))
+	default:
+		rw.Header().Set("Allow", "GET, HEAD, POST, PUT")
+		writeError(rw, http.StatusMethodNotAllowed, codeMethodNotAllowed, "", fmt.Sprintf("method %s is not allowed", r.Method))
+	}
+}
+
+// forward sends the request to the nodes in turn until one of them finds the
+// key, and copies the last response to the client.
+func (rt *router) forward(rw http.ResponseWriter, r *http.Request, key string, nodes []string) {
+	for i, node := range nodes {
+		ctx, cancel := context.WithTimeout(r.Context(), rt.opts.Timeout)
+		fwdRequest := r.Clone(ctx)
+		fwdRequest.RequestURI = ""
+		fwdRequest.URL.Scheme = "http"
+		fwdRequest.URL.Host = node
+		fwdRequest.Host = node
+
+		resp, err := rt.client.Do(fwdRequest)
+		if err != nil {
+			cancel()
+			log.Printf("Failed to get response from %s: %s", node, err)
+			writeError(rw, http.StatusServiceUnavailable, codeUnavailable, key, fmt.Sprintf("database node %s is unavailable", node))
+			return
+		}
+		if resp.StatusCode == http.StatusNotFound && i < len(nodes)-1 {
+			_ = resp.Body.Close()
+			cancel()
+			continue
+		}
+		for k, values := range resp.Header {
+			for _, value := range values {
+				rw.Header().Add(k, value)
+			}
+		}
+		rw.Header().Set("X-Db-Node", node)
+		logger.Println("fwd", resp.StatusCode, resp.Request.URL)
+		rw.WriteHeader(resp.StatusCode)
+		if _, err := io.Copy(rw, resp.Body); err != nil {
+			log.Printf("Failed to write response: %s", err)
+		}
+		_ = resp.Body.Close()
+		cancel()
+		return
+	}
+}
+
+func (rt *router) handleRingRequest(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		rw.Header().Set("Allow", "GET")
+		writeError(rw, http.StatusMethodNotAllowed, codeMethodNotAllowed, "", fmt.Sprintf("method %s is not allowed", r.Method))
+		return
+	}
+	rt.mu.Lock()
+	current := rt.ring
+	var rebalance *rebalanceBody
+	if rt.rebalance != nil {
+		status := *rt.rebalance
+		rebalance = &status
+	}
+	rt.mu.Unlock()
+
+	shares := current.shares()
+	body := ringBody{VNodes: current.vnodes, Points: current.points, Rebalance: rebalance}
+	for _, node := range current.nodes {
+		body.Nodes = append(body.Nodes, nodeBody{Address: node, Share: shares[node]})
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(body)
+}
+
+// handleAddNodeRequest adds the node of POST /admin/nodes {"address": ...} to
+// the ring and moves the keys it now owns to it in the background. Adding the
+// node of a failed rebalance again retries it.
+func (rt *router) handleAddNodeRequest(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		rw.Header().Set("Allow", "POST")
+		writeError(rw, http.StatusMethodNotAllowed, codeMethodNotAllowed, "", fmt.Sprintf("method %s is not allowed", r.Method))
+		return
+	}
+	var ab addNodeBody
+	if err := json.NewDecoder(r.Body).Decode(&ab); err != nil {
+		writeError(rw, http.StatusBadRequest, codeInvalidRequest, "", "json decoding error")
+		return
+	}
+	if ab.Address == "" || strings.ContainsAny(ab.Address, "/,") {
+		writeError(rw, http.StatusBadRequest, codeInvalidRequest, "", fmt.Sprintf("invalid node address %q", ab.Address))
+		return
+	}
+
+	rt.mu.Lock()
+	var conflict string
+	switch {
+	case rt.rebalance != nil && rt.rebalance.State == rebalanceRunning:
+		conflict = fmt.Sprintf("keys are being moved to %s", rt.rebalance.Node)
+	case rt.prev != nil && rt.rebalance.Node != ab.Address:
+		conflict = fmt.Sprintf("moving keys to %s has failed, add it again to retry", rt.rebalance.Node)
+	case rt.prev == nil && rt.ring.has(ab.Address):
+		conflict = fmt.Sprintf("node %s is already on the ring", ab.Address)
+	}
+	if conflict != "" {
+		rt.mu.Unlock()
+		writeError(rw, http.StatusConflict, codeConflict, "", conflict)
+		return
+	}
+	if rt.prev == nil {
+		rt.prev, rt.ring = rt.ring, rt.ring.withNode(ab.Address)
+	}
+	rt.rebalance = &rebalanceBody{Node: ab.Address, State: rebalanceRunning}
+	status := *rt.rebalance
+	prev, next := rt.prev, rt.ring
+	rt.mu.Unlock()
+
+	logger.Printf("Adding node %s", ab.Address)
+	go rt.rebalanceNode(ab.Address, prev, next)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(rw).Encode(status)
+}
+
+// rebalanceNode moves the keys owned by the node on the next ring to it from
+// the nodes of the previous ring.
+func (rt *router) rebalanceNode(node string, prev, next *ring) {
+	dst := dbclient.New("http://"+node, rt.opts)
+	defer dst.Close()
+	var err error
+	for _, source := range prev.nodes {
+		src := dbclient.New("http://"+source, rt.opts)
+		err = rt.moveKeys(src, dst, node, next)
+		src.Close()
+		if err != nil {
+			err = fmt.Errorf("moving keys from %s: %w", source, err)
+			break
+		}
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if err != nil {
+		log.Printf("Failed to rebalance node %s: %s", node, err)
+		rt.rebalance.State, rt.rebalance.Error = rebalanceFailed, err.Error()
+		return
+	}
+	logger.Printf("Moved %d keys to node %s", rt.rebalance.Moved, node)
+	rt.rebalance.State = rebalanceDone
+	rt.prev = nil
+}
+
+// moveKeys pages through the keys of src and moves the ones owned by node on
+// the next ring to dst. A key written to dst since the node was added is
+// newer than the one on src, so it is kept.
+func (rt *router) moveKeys(src, dst *dbclient.Client, node string, next *ring) error {
+	start := ""
+	for {
+		kvs, err := src.Scan(start, "", rt.pageSize)
+		if err != nil {
+			return err
+		}
+		moved := 0
+		for _, kv := range kvs {
+			if next.node(kv.Key) != node {
+				continue
+			}
+			if _, err := dst.PutIfAbsent(kv.Key, kv.Value); err != nil {
+				return err
+			}
+			if err := src.Delete(kv.Key); err != nil {
+				return err
+			}
+			moved++
+		}
+
+		rt.mu.Lock()
+		rt.rebalance.Scanned += len(kvs)
+		rt.rebalance.Moved += moved
+		rt.mu.Unlock()
+
+		if len(kvs) < rt.pageSize {
+			return nil
+		}
+		start = dbclient.NextKey(kvs[len(kvs)-1].Key)
+	}
+}
+
+func main() {
+	flag.Parse()
+	logger.Init(*logEnabled)
+
+	var addrs []string
+	for _, addr := range strings.Split(*nodes, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		if slices.Contains(addrs, addr) {
+			log.Fatalf("database node %s is listed twice", addr)
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		log.Fatal("at least one database node is required")
+	}
+	if *vnodes <= 0 || *pageSize <= 0 {
+		log.Fatal("vnodes and rebalance-page have to be positive")
+	}
+
+	rt := newRouter(newRing(*vnodes, addrs...), dbclient.Options{Timeout: *timeout, APIKey: *apiKey}, *pageSize, *adminKey)
+
+	h := new(http.ServeMux)
+	h.HandleFunc("/db/", rt.handleDbRequest)
+	h.HandleFunc("/admin/ring", rt.admin(rt.handleRingRequest))
+	h.HandleFunc("/admin/nodes", rt.admin(rt.handleAddNodeRequest))
+
+	server := httptools.CreateServer(*port, h)
+	logger.Printf("Routing keys to %d database nodes...", len(addrs))
+	server.Start()
+	signal.WaitForTerminationSignal()
+}
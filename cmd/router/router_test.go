@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kushnirko/kpi-apz-lab-5/dbclient"
+)
+
+// fakeNode serves the parts of the cmd/db API used by the router from a map.
+// Scans, batches and transactions are base64 encoded, as dbclient sends them.
+type fakeNode struct {
+	mu     sync.Mutex
+	values map[string]any
+}
+
+type fakeOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value any    `json:"value"`
+}
+
+func decodeBase64(s string) string {
+	data, _ := base64.StdEncoding.DecodeString(s)
+	return string(data)
+}
+
+// decodeOp decodes the key and the value of an operation.
+func decodeOp(op fakeOp) fakeOp {
+	op.Key = decodeBase64(op.Key)
+	switch v := op.Value.(type) {
+	case string:
+		op.Value = decodeBase64(v)
+	case json.Number:
+		op.Value, _ = v.Int64()
+	}
+	return op
+}
+
+func decodeBody(r *http.Request, v any) {
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	_ = dec.Decode(v)
+}
+
+func (f *fakeNode) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key, _ := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/db/"))
+	switch {
+	case r.Method == "GET" && key == "_scan":
+		var keys []string
+		for k := range f.values {
+			if k >= r.URL.Query().Get("start") {
+				keys = append(keys, k)
+			}
+		}
+		slices.Sort(keys)
+		if limit, _ := strconv.Atoi(r.URL.Query().Get("limit")); limit > 0 && len(keys) > limit {
+			keys = keys[:limit]
+		}
+		enc := json.NewEncoder(rw)
+		for _, k := range keys {
+			line := map[string]any{"key": base64.StdEncoding.EncodeToString([]byte(k)), "value": f.values[k], "type": "int64"}
+			if s, ok := f.values[k].(string); ok {
+				line["value"], line["type"] = base64.StdEncoding.EncodeToString([]byte(s)), "string"
+			}
+			_ = enc.Encode(line)
+		}
+	case r.Method == "POST" && key == "_tx":
+		var body struct {
+			Reads  map[string]uint64 `json:"reads"`
+			Writes []fakeOp          `json:"writes"`
+		}
+		decodeBody(r, &body)
+		for k := range body.Reads {
+			if _, ok := f.values[decodeBase64(k)]; ok {
+				rw.WriteHeader(http.StatusConflict)
+				_, _ = rw.Write([]byte(`{"error":{"code":"conflict","message":"transaction conflict"}}`))
+				return
+			}
+		}
+		for _, op := range body.Writes {
+			op = decodeOp(op)
+			f.values[op.Key] = op.Value
+		}
+		rw.WriteHeader(http.StatusCreated)
+	case r.Method == "POST" && key == "_batch":
+		var body struct {
+			Ops []fakeOp `json:"ops"`
+		}
+		decodeBody(r, &body)
+		for _, op := range body.Ops {
+			delete(f.values, decodeOp(op).Key)
+		}
+		rw.WriteHeader(http.StatusCreated)
+	case r.Method == "GET":
+		v, ok := f.values[key]
+		if !ok {
+			http.Error(rw, "no value found for key "+key, http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(map[string]any{"key": key, "value": v})
+	case r.Method == "POST":
+		var body struct {
+			Value any `json:"value"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		f.values[key] = body.Value
+		rw.WriteHeader(http.StatusCreated)
+	}
+}
+
+func startNodes(t *testing.T, n int) ([]*fakeNode, []string) {
+	t.Helper()
+	var nodes []*fakeNode
+	var addrs []string
+	for i := 0; i < n; i++ {
+		node := &fakeNode{values: make(map[string]any)}
+		srv := httptest.NewServer(node)
+		t.Cleanup(srv.Close)
+		nodes = append(nodes, node)
+		addrs = append(addrs, strings.TrimPrefix(srv.URL, "http://"))
+	}
+	return nodes, addrs
+}
+
+const testAdminKey = "admin-secret"
+
+func newTestRouter(t *testing.T, addrs []string) (*router, *dbclient.Client) {
+	t.Helper()
+	rt := newRouter(newRing(16, addrs...), dbclient.Options{Backoff: time.Millisecond}, 7, testAdminKey)
+	h := new(http.ServeMux)
+	h.HandleFunc("/db/", rt.handleDbRequest)
+	h.HandleFunc("/admin/ring", rt.admin(rt.handleRingRequest))
+	h.HandleFunc("/admin/nodes", rt.admin(rt.handleAddNodeRequest))
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	c := dbclient.New(srv.URL, dbclient.Options{})
+	t.Cleanup(c.Close)
+	return rt, c
+}
+
+// adminRequest sends a request with the admin key to an admin endpoint.
+func adminRequest(t *testing.T, method, url, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func getRing(t *testing.T, base string) ringBody {
+	t.Helper()
+	resp := adminRequest(t, "GET", base, "")
+	defer resp.Body.Close()
+	var body ringBody
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func waitRebalance(t *testing.T, base string) ringBody {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		layout := getRing(t, base)
+		if layout.Rebalance != nil && layout.Rebalance.State != rebalanceRunning {
+			return layout
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Rebalancing did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	nodes, addrs := startNodes(t, 3)
+	rt, c := newTestRouter(t, addrs[:2])
+	srv := httptest.NewServer(rt.admin(rt.handleRingRequest))
+	defer srv.Close()
+
+	// The keys are escaped in request paths and routed by their unescaped form.
+	for i := 0; i < 100; i++ {
+		if err := c.Put(fmt.Sprintf("key %d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(nodes[0].values) == 0 || len(nodes[1].values) == 0 || len(nodes[0].values)+len(nodes[1].values) != 100 {
+		t.Fatalf("Unexpected distribution %d/%d", len(nodes[0].values), len(nodes[1].values))
+	}
+	if _, err := c.Get("missing"); err == nil {
+		t.Error("Expected an error for a missing key")
+	}
+
+	resp := adminRequest(t, "POST", srv.URL, fmt.Sprintf(`{"address":%q}`, addrs[2]))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+
+	add := httptest.NewServer(rt.admin(rt.handleAddNodeRequest))
+	defer add.Close()
+	resp = adminRequest(t, "POST", add.URL, fmt.Sprintf(`{"address":%q}`, addrs[2]))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Unexpected status code %d", resp.StatusCode)
+	}
+
+	// Keys stay readable while they are moved.
+	for i := 0; i < 100; i++ {
+		if v, err := c.Get(fmt.Sprintf("key %d", i)); err != nil || v != fmt.Sprintf("value%d", i) {
+			t.Fatalf("Bad value returned: %s (%v)", v, err)
+		}
+	}
+
+	layout := waitRebalance(t, srv.URL)
+	if layout.Rebalance.State != rebalanceDone || layout.Rebalance.Scanned != 100 || layout.Rebalance.Moved != len(nodes[2].values) {
+		t.Errorf("Unexpected rebalance status %+v", layout.Rebalance)
+	}
+	if len(layout.Nodes) != 3 || len(layout.Points) != 48 || layout.VNodes != 16 {
+		t.Errorf("Unexpected ring layout %+v", layout)
+	}
+	if len(nodes[2].values) == 0 {
+		t.Error("No keys moved to the added node")
+	}
+	for i, node := range nodes {
+		for k := range node.values {
+			if owner := rt.ring.node(k); owner != addrs[i] {
+				t.Errorf("Key %s is on %s, owned by %s", k, addrs[i], owner)
+			}
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if v, err := c.Get(fmt.Sprintf("key %d", i)); err != nil || v != fmt.Sprintf("value%d", i) {
+			t.Errorf("Bad value returned: %s (%v)", v, err)
+		}
+	}
+
+	resp = adminRequest(t, "POST", add.URL, fmt.Sprintf(`{"address":%q}`, addrs[2]))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Unexpected status code %d", resp.StatusCode)
+	}
+}
+
+func TestRouter_Rebalance_Exact(t *testing.T) {
+	nodes, addrs := startNodes(t, 2)
+	rt, _ := newTestRouter(t, addrs[:1])
+	srv := httptest.NewServer(rt.admin(rt.handleAddNodeRequest))
+	defer srv.Close()
+	ringSrv := httptest.NewServer(rt.admin(rt.handleRingRequest))
+	defer ringSrv.Close()
+
+	// Keys and values that do not survive JSON strings or float64 numbers,
+	// owned by the added node.
+	next := rt.ring.withNode(addrs[1])
+	values := map[string]any{}
+	for i := 0; len(values) < 2; i++ {
+		key := fmt.Sprintf("key\xff%d", i)
+		if next.node(key) != addrs[1] {
+			continue
+		}
+		if len(values) == 0 {
+			values[key] = "binary\xfe\x00value"
+		} else {
+			values[key] = int64(1<<60 + 1)
+		}
+	}
+	for k, v := range values {
+		nodes[0].values[k] = v
+	}
+
+	resp := adminRequest(t, "POST", srv.URL, fmt.Sprintf(`{"address":%q}`, addrs[1]))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Unexpected status code %d", resp.StatusCode)
+	}
+	if layout := waitRebalance(t, ringSrv.URL); layout.Rebalance.State != rebalanceDone || layout.Rebalance.Moved != 2 {
+		t.Fatalf("Unexpected rebalance status %+v", layout.Rebalance)
+	}
+	nodes[1].mu.Lock()
+	defer nodes[1].mu.Unlock()
+	for k, v := range values {
+		if nodes[1].values[k] != v {
+			t.Errorf("Bad value moved for %q: %#v", k, nodes[1].values[k])
+		}
+	}
+	if len(nodes[0].values) != 0 {
+		t.Errorf("Keys left on the old node: %v", nodes[0].values)
+	}
+}
+
+func TestRouter_Admin(t *testing.T) {
+	_, addrs := startNodes(t, 1)
+	rt, _ := newTestRouter(t, addrs)
+	srv := httptest.NewServer(rt.admin(rt.handleAddNodeRequest))
+	defer srv.Close()
+	disabled := newRouter(newRing(16, addrs...), dbclient.Options{}, 7, "")
+	disabledSrv := httptest.NewServer(disabled.admin(disabled.handleAddNodeRequest))
+	defer disabledSrv.Close()
+
+	cases := []struct {
+		url, auth string
+		status    int
+	}{
+		{srv.URL, "", http.StatusUnauthorized},
+		{srv.URL, "Bearer wrong", http.StatusUnauthorized},
+		{srv.URL, testAdminKey, http.StatusUnauthorized},
+		{disabledSrv.URL, "Bearer ", http.StatusForbidden},
+		{disabledSrv.URL, "Bearer " + testAdminKey, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("POST", c.url, strings.NewReader(`{"address":"added:8080"}`))
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%q: unexpected status code %d", c.auth, resp.StatusCode)
+		}
+	}
+	if rt.ring.has("added:8080") || disabled.ring.has("added:8080") {
+		t.Error("The ring was changed by an unauthenticated request")
+	}
+}
+
+func TestRouter_Fallback(t *testing.T) {
+	nodes, addrs := startNodes(t, 2)
+	rt, c := newTestRouter(t, addrs[:1])
+
+	// The key has not been moved to the added node yet.
+	rt.prev, rt.ring = rt.ring, rt.ring.withNode(addrs[1])
+	key := "key"
+	for i := 0; rt.ring.node(key) != addrs[1]; i++ {
+		key = fmt.Sprintf("key%d", i)
+	}
+	nodes[0].values[key] = "old"
+	if v, err := c.Get(key); err != nil || v != "old" {
+		t.Errorf("Bad value returned: %s (%v)", v, err)
+	}
+
+	// Writes go to the new owner, which is read first.
+	if err := c.Put(key, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if nodes[1].values[key] != "new" {
+		t.Errorf("Key was written to the old owner")
+	}
+	if v, err := c.Get(key); err != nil || v != "new" {
+		t.Errorf("Bad value returned: %s (%v)", v, err)
+	}
+
+	// Requests for several keys are not routed.
+	for _, path := range []string{"/db/_batch", "/db/bucket/key", "/db/_index/name"} {
+		rw := httptest.NewRecorder()
+		rt.handleDbRequest(rw, httptest.NewRequest("POST", path, nil))
+		if rw.Code != http.StatusNotImplemented {
+			t.Errorf("%s: unexpected status code %d", path, rw.Code)
+		}
+	}
+}
@@ -1,17 +1,16 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
-	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
 
+	"github.com/kushnirko/kpi-apz-lab-5/dbclient"
 	"github.com/kushnirko/kpi-apz-lab-5/httptools"
 	"github.com/kushnirko/kpi-apz-lab-5/logger"
 	"github.com/kushnirko/kpi-apz-lab-5/signal"
@@ -26,31 +25,35 @@ var (
 const (
 	confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 	confHealthFailure    = "CONF_HEALTH_FAILURE"
+	confDbAPIKey         = "CONF_DB_API_KEY"
 
-	database = "http://database:8080/db"
+	database = "http://database:8080"
 	teamName = "ryan-gosling-team"
 )
 
-func sendTimestamp() {
-	body := new(bytes.Buffer)
-	json.NewEncoder(body).Encode(struct {
-		Value string `json:"value"`
-	}{
-		Value: time.Now().Format("2006-01-02"),
-	})
-
-	c := http.DefaultClient
-	resp, err := c.Post(fmt.Sprintf("%s/%s", database, teamName), "application/json", body)
-	if err != nil {
+func sendTimestamp(db *dbclient.Client) {
+	if err := db.Put(teamName, time.Now().Format("2006-01-02")); err != nil {
 		log.Printf("failed to send timestamp: %v", err)
 	}
-	resp.Body.Close()
+}
+
+// getValue reads the value of the key whatever its type is.
+func getValue(db *dbclient.Client, key string) (any, error) {
+	v, err := db.Get(key)
+	if errors.Is(err, dbclient.ErrTypeMismatch) {
+		n, err := db.GetInt64(key)
+		return n, err
+	}
+	return v, err
 }
 
 func main() {
 	flag.Parse()
 	logger.Init(*logEnabled)
 
+	db := dbclient.New(database, dbclient.Options{APIKey: os.Getenv(confDbAPIKey)})
+	defer db.Close()
+
 	h := new(http.ServeMux)
 
 	h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
@@ -78,30 +81,32 @@ func main() {
 			return
 		}
 
-		c := http.DefaultClient
-		resp, err := c.Get(fmt.Sprintf("%s/%s", database, k))
-		if err != nil {
+		v, err := getValue(db, k)
+		if err != nil && !errors.Is(err, dbclient.ErrNotFound) {
+			logger.Printf("failed to get %s: %v", k, err)
 			rw.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		defer resp.Body.Close()
 
 		report.Process(r)
 
-		rw.Header().Set("content-type", "application/json")
-		rw.WriteHeader(resp.StatusCode)
-
-		if resp.StatusCode == http.StatusOK {
-			if _, err = io.Copy(rw, resp.Body); err != nil {
-				rw.WriteHeader(http.StatusInternalServerError)
-			}
+		if err != nil {
+			rw.WriteHeader(http.StatusNotFound)
+			return
 		}
+
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(struct {
+			Key   string `json:"key"`
+			Value any    `json:"value"`
+		}{Key: k, Value: v})
 	})
 
 	h.Handle("/report", report)
 
 	server := httptools.CreateServer(*port, h)
 	server.Start()
-	sendTimestamp()
+	sendTimestamp(db)
 	signal.WaitForTerminationSignal()
 }
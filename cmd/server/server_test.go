@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kushnirko/kpi-apz-lab-5/dbclient"
+)
+
+func TestGetValue(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/db/number" && r.URL.Query().Get("type") != "int64" {
+			rw.WriteHeader(http.StatusConflict)
+			_, _ = rw.Write([]byte(`{"error":{"code":"type_mismatch","message":"value has another type"}}`))
+			return
+		}
+		var value any = "value"
+		if r.URL.Path == "/db/number" {
+			value = int64(1<<60 + 1)
+		}
+		_ = json.NewEncoder(rw).Encode(map[string]any{"key": r.URL.Path[len("/db/"):], "value": value})
+	}))
+	defer srv.Close()
+	db := dbclient.New(srv.URL, dbclient.Options{})
+	defer db.Close()
+
+	if v, err := getValue(db, "text"); err != nil || v != "value" {
+		t.Errorf("Bad value returned: %v (%v)", v, err)
+	}
+	if v, err := getValue(db, "number"); err != nil || v != int64(1<<60+1) {
+		t.Errorf("Bad value returned: %v (%v)", v, err)
+	}
+}
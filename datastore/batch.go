@@ -0,0 +1,145 @@
+package datastore
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// batchHeaderSize is the size of the group record fields preceding the
+// records of a batch: the group has an empty key and the batch type.
+var batchHeaderSize = 16 + len(batchType)
+
+var ErrBatchTooLarge = fmt.Errorf("batch is too large")
+
+// Batch collects puts and deletes that are written atomically: after a crash
+// either all of them are recovered or none.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key   string
+	value any
+}
+
+type batchRequest struct {
+	records [][]byte
+	reply   chan error
+}
+
+func (b *Batch) Put(key, value string) {
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+func (b *Batch) PutInt64(key string, value int64) {
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{key: key, value: tombstone{}})
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+func (b *Batch) encode(opts Options) ([][]byte, error) {
+	records := make([][]byte, len(b.ops))
+	for i, op := range b.ops {
+		data, err := op.encode(opts)
+		if err != nil {
+			return nil, err
+		}
+		records[i] = data
+	}
+	return records, nil
+}
+
+func (op batchOp) encode(opts Options) ([]byte, error) {
+	if err := checkKey(op.key); err != nil {
+		return nil, err
+	}
+	switch v := op.value.(type) {
+	case string:
+		if err := opts.checkSize(op.key, len(v)); err != nil {
+			return nil, err
+		}
+		e := entry[string]{key: op.key, value: v}
+		return e.Encode(), nil
+	case int64:
+		if err := opts.checkSize(op.key, 8); err != nil {
+			return nil, err
+		}
+		e := entry[int64]{key: op.key, value: v}
+		return e.Encode(), nil
+	default:
+		e := entry[tombstone]{key: op.key}
+		return e.Encode(), nil
+	}
+}
+
+func (db *Db) Write(b *Batch) error {
+	return db.WriteContext(context.Background(), b)
+}
+
+func (db *Db) WriteContext(ctx context.Context, b *Batch) error {
+	if b.Len() == 0 {
+		return ctx.Err()
+	}
+	records, err := b.encode(db.opts)
+	if err != nil {
+		return err
+	}
+	reply := make(chan error, 1)
+	if err := request(ctx, db, db.batchCh, batchRequest{records: records, reply: reply}); err != nil {
+		return err
+	}
+	err, ctxErr := await(ctx, reply)
+	if ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// writeBatch writes the records as a single group record, so a crash while
+// writing it leaves a truncated group that recover() drops entirely.
+func (db *Db) writeBatch(records [][]byte) error {
+	defer db.observeWrite(time.Now())
+	var body []byte
+	for i, data := range records {
+		key := recordKey(data)
+		data, err := db.externalize(key, data)
+		if err != nil {
+			return err
+		}
+		data = withVersion(data, db.sequence+uint64(i)+1)
+		body = append(body, data...)
+	}
+	group := entry[batchRecords]{value: body}
+	data := group.Encode()
+	if len(data) > db.segmentSize {
+		return fmt.Errorf("%w: %d bytes exceeds the segment size of %d bytes", ErrBatchTooLarge, len(data), db.segmentSize)
+	}
+	if err := db.ensureSpace(len(data)); err != nil {
+		return err
+	}
+	if err := db.write(data); err != nil {
+		return err
+	}
+	db.applyRecords(data, packOffset(db.fileNumber, db.outOffset))
+	db.outOffset += int64(len(data))
+	return nil
+}
+
+// splitBatch returns the records stored in a batch group.
+func splitBatch(data []byte) [][]byte {
+	var records [][]byte
+	for body := data[batchHeaderSize:]; len(body) >= 4; {
+		size := binary.LittleEndian.Uint32(body)
+		records = append(records, body[:size])
+		body = body[size:]
+	}
+	return records
+}
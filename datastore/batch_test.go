@@ -0,0 +1,130 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDb_Write(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("removed", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	var b Batch
+	b.Put("key1", "value1")
+	b.PutInt64("key2", 42)
+	b.Delete("removed")
+	b.Put("key1", "value2")
+	if err := db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		if value, err := db.Get("key1"); err != nil || value != "value2" {
+			t.Errorf("Bad value returned: %s (%v)", value, err)
+		}
+		if value, err := db.GetInt64("key2"); err != nil || value != 42 {
+			t.Errorf("Bad value returned: %d (%v)", value, err)
+		}
+		if _, err := db.Get("removed"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+		}
+	}
+	check()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+}
+
+func TestDb_Write_TooLarge(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var b Batch
+	for i := 0; i < 5; i++ {
+		b.Put("key", "value")
+	}
+	if err := db.Write(&b); !errors.Is(err, ErrBatchTooLarge) {
+		t.Errorf("Expected ErrBatchTooLarge, got %v", err)
+	}
+	if _, err := db.Get("key"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected no records of a rejected batch, got %v", err)
+	}
+}
+
+func TestDb_Write_Incomplete(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key0", "value0"); err != nil {
+		t.Fatal(err)
+	}
+	var b Batch
+	b.Put("key1", "value1")
+	b.Put("key2", strings.Repeat("v", 50))
+	if err := db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash in the middle of writing the batch.
+	segment := filepath.Join(dir, outFileName+"-1")
+	info, err := os.Stat(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(segment, info.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("key0"); err != nil || value != "value0" {
+		t.Errorf("Bad value returned: %s (%v)", value, err)
+	}
+	for _, key := range []string{"key1", "key2"} {
+		if _, err := db.Get(key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected %s of an incomplete batch to be dropped, got %v", key, err)
+		}
+	}
+
+	if err := db.Put("key3", "value3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("key3"); err != nil || value != "value3" {
+		t.Errorf("Bad value returned after the dropped batch: %s (%v)", value, err)
+	}
+}
@@ -0,0 +1,178 @@
+package datastore
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	blobFileName = "blob"
+	// Shared blobs are named after the SHA-256 hash of their content.
+	sharedBlobPrefix = blobFileName + "-sha256-"
+	blobTempFileName = blobFileName + "-tmp"
+)
+
+// externalize moves the value of a record to a blob if the record does not
+// fit into a segment or the value is large enough to be deduplicated. It
+// returns the record to be written to the segment.
+func (db *Db) externalize(key string, data []byte) ([]byte, error) {
+	if db.opts.DedupThreshold > 0 && recordType(data) != tombstoneType && recordType(data) != rangeTombstoneType &&
+		recordValueSize(data) >= db.opts.DedupThreshold {
+		return db.writeSharedBlob(key, data)
+	}
+	if len(data) > db.segmentSize {
+		ref, _, err := db.writeBlob(key, data)
+		return ref, err
+	}
+	return data, nil
+}
+
+// writeBlob stores a record that does not fit into a segment in a separate
+// file and returns the reference record to be written to the segment instead.
+func (db *Db) writeBlob(key string, data []byte) ([]byte, string, error) {
+	name := blobFileName + "-" + strconv.Itoa(db.nextBlob)
+	f, err := db.fs.OpenFile(filepath.Join(db.dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return nil, "", err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return nil, "", err
+	}
+	if err := f.Close(); err != nil {
+		return nil, "", err
+	}
+	db.nextBlob++
+	ref := entry[blobRef]{
+		key:   key,
+		value: blobRef(name),
+	}
+	return ref.Encode(), name, nil
+}
+
+// writeSharedBlob stores the value of a record in a blob named after its
+// content, so equal values written under any number of keys share the blob.
+// The blob is written under a temporary name first, so a crash never leaves
+// a blob whose content does not match its name.
+func (db *Db) writeSharedBlob(key string, data []byte) ([]byte, error) {
+	value := withoutKey(data)
+	sum := sha256.Sum256(value)
+	name := sharedBlobPrefix + hex.EncodeToString(sum[:])
+	path := filepath.Join(db.dir, name)
+	ref := entry[blobRef]{
+		key:   key,
+		value: blobRef(name),
+	}
+	if db.blobRefs[name] > 0 {
+		return ref.Encode(), nil
+	}
+	// An unreferenced blob that is not removed yet is reused as well.
+	if _, err := db.fs.Stat(path); err == nil {
+		return ref.Encode(), nil
+	}
+
+	tmpPath := filepath.Join(db.dir, blobTempFileName)
+	f, err := db.fs.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(value); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := db.fs.Rename(tmpPath, path); err != nil {
+		return nil, err
+	}
+	return ref.Encode(), nil
+}
+
+// withoutKey returns the record with an empty key, which is how values are
+// stored in shared blobs.
+func withoutKey(data []byte) []byte {
+	kl := int(binary.LittleEndian.Uint32(data[4:]))
+	res := make([]byte, len(data)-kl)
+	binary.LittleEndian.PutUint32(res, uint32(len(res)))
+	copy(res[8:], data[8+kl:])
+	return res
+}
+
+func (db *Db) readBlob(ref blobRef) (any, error) {
+	f, err := openRead(db.fs, filepath.Join(db.dir, string(ref)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readValue(bufio.NewReaderSize(f, bufSize))
+}
+
+// trackBlob remembers which blob, if any, the latest record of the key refers to.
+func (db *Db) trackBlob(key string, data []byte) {
+	db.refBlob(db.blobs[key], -1)
+	if recordType(data) != blobRefType {
+		delete(db.blobs, key)
+		return
+	}
+	if ref, err := recordValue(data); err == nil {
+		db.blobs[key] = string(ref.(blobRef))
+		db.refBlob(db.blobs[key], 1)
+	}
+}
+
+// refBlob counts the references to a blob from the latest records of keys
+// and from retained versions. Blobs without references are removed by
+// removeUnreferencedBlobs after merges.
+func (db *Db) refBlob(name string, delta int) {
+	if name == "" {
+		return
+	}
+	if db.blobRefs[name] += delta; db.blobRefs[name] <= 0 {
+		delete(db.blobRefs, name)
+	}
+}
+
+// removeUnreferencedBlobs deletes blob files that no live key refers to.
+func (db *Db) removeUnreferencedBlobs() error {
+	files, err := db.fs.Glob(filepath.Join(db.dir, blobFileName+"-*"))
+	if err != nil {
+		return err
+	}
+	referenced := db.referencedBlobs()
+	for _, file := range files {
+		name := filepath.Base(file)
+		if number, err := strconv.Atoi(strings.TrimPrefix(name, blobFileName+"-")); err == nil && number >= db.nextBlob {
+			db.nextBlob = number + 1
+		}
+		if referenced[name] {
+			continue
+		}
+		if err := db.fs.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *Db) referencedBlobs() map[string]bool {
+	referenced := make(map[string]bool, len(db.blobRefs))
+	for name := range db.blobRefs {
+		referenced[name] = true
+	}
+	return referenced
+}
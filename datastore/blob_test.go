@@ -0,0 +1,200 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDb_LargeValues(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := strings.Repeat("large-value-", 50)
+	if err := db.Put("large", large); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("small", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("large"); err != nil || value != large {
+		t.Errorf("Bad large value returned (%v)", err)
+	}
+	if s := db.Stats(); s.Blobs != 1 || s.BlobBytes <= int64(len(large)) {
+		t.Errorf("Unexpected blob stats: %d blobs, %d bytes", s.Blobs, s.BlobBytes)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("large"); err != nil || value != large {
+		t.Errorf("Bad large value returned after reopen (%v)", err)
+	}
+
+	if err := db.Put("large", "now small"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if blobs, _ := filepath.Glob(filepath.Join(dir, blobFileName+"-*")); len(blobs) != 0 {
+		t.Errorf("Unreferenced blobs were not removed: %v", blobs)
+	}
+}
+
+func TestDb_Dedup(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{SegmentSize: 200, DedupThreshold: 64}
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := strings.Repeat("shared-value-", 20)
+	for i := 0; i < 5; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), shared); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var b Batch
+	b.Put("batched", shared)
+	if err := db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("small", "below the threshold"); err != nil {
+		t.Fatal(err)
+	}
+	if s := db.Stats(); s.Blobs != 1 || s.BlobBytes >= 2*int64(len(shared)) {
+		t.Errorf("Value is not stored once: %d blobs, %d bytes", s.Blobs, s.BlobBytes)
+	}
+	if blobs, _ := filepath.Glob(filepath.Join(dir, sharedBlobPrefix+"*")); len(blobs) != 1 {
+		t.Errorf("Expected a single shared blob, got %v", blobs)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"key0", "key4", "batched"} {
+		if value, err := db.Get(key); err != nil || value != shared {
+			t.Errorf("Bad shared value returned for %s (%v)", key, err)
+		}
+	}
+
+	// The blob stays while any key refers to it and is reclaimed by a merge
+	// once none does.
+	for i := 0; i < 5; i++ {
+		if err := db.Delete(fmt.Sprintf("key%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if value, err := db.Get("batched"); err != nil || value != shared {
+		t.Errorf("Bad shared value returned (%v)", err)
+	}
+	if err := db.Put("batched", "small"); err != nil {
+		t.Fatal(err)
+	}
+	if s := db.Stats(); s.Blobs != 0 {
+		t.Errorf("Expected no referenced blobs, got %d", s.Blobs)
+	}
+	sharedBlobs := func() []string {
+		blobs, _ := filepath.Glob(filepath.Join(dir, sharedBlobPrefix+"*"))
+		return blobs
+	}
+	for i := 0; len(sharedBlobs()) != 0 && i < 1000; i++ {
+		// Rewriting a key fills segments until one of the merges reclaims the blob.
+		if err := db.Put("filler", fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if blobs := sharedBlobs(); len(blobs) != 0 {
+		t.Errorf("Unreferenced shared blob was not removed: %v", blobs)
+	}
+}
+
+func TestDb_Dedup_Versions(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{SegmentSize: 1024, DedupThreshold: 64, Versions: 2}
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := strings.Repeat("shared-value-", 20)
+	for _, value := range []string{shared, "small", "smaller"} {
+		if err := db.Put("key", value); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("other", shared); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only two versions of the key are retained, neither of them refers to
+	// the blob any more.
+	db, err = NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if s := db.Stats(); s.Blobs != 0 {
+		t.Errorf("Expected no referenced blobs, got %d", s.Blobs)
+	}
+	if blobs, _ := filepath.Glob(filepath.Join(dir, sharedBlobPrefix+"*")); len(blobs) != 0 {
+		t.Errorf("Unreferenced shared blob was not removed: %v", blobs)
+	}
+
+	if err := db.Put("key", shared); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "small"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.GetVersion("key", 9); err != nil || value != shared {
+		t.Errorf("Bad value of a retained version (%v)", err)
+	}
+}
+
+func TestDb_SizeLimits(t *testing.T) {
+	db, err := NewDbWithOptions(t.TempDir(), Options{SegmentSize: 100, MaxKeySize: 8, MaxValueSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("too-long-key", "value"); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := db.Put("key", strings.Repeat("v", 17)); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := db.Put("key", strings.Repeat("v", 16)); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
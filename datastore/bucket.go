@@ -0,0 +1,132 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// bucketSeparator separates the bucket name from the key in the index. Keys of
+// the default bucket must not contain it.
+const bucketSeparator = "\x00"
+
+var (
+	ErrInvalidBucket = fmt.Errorf("invalid bucket name")
+	ErrInvalidKey    = fmt.Errorf("invalid key")
+)
+
+type BucketStats struct {
+	Keys  int
+	Bytes int64
+}
+
+// Bucket is a namespace within a Db. Its keys are stored in the same segments
+// and index as the keys of the database, prefixed with the bucket name.
+type Bucket struct {
+	db     *Db
+	name   string
+	prefix string
+}
+
+func (db *Db) Bucket(name string) (*Bucket, error) {
+	if err := checkBucketName(name); err != nil {
+		return nil, err
+	}
+	return &Bucket{db: db, name: name, prefix: name + bucketSeparator}, nil
+}
+
+// DropBucket removes every key of the bucket. The space is reclaimed by the
+// next merge of the segments holding them.
+func (db *Db) DropBucket(name string) error {
+	if err := checkBucketName(name); err != nil {
+		return err
+	}
+	e := entry[dropBucket]{
+		key: name + bucketSeparator,
+	}
+	return db.put(context.Background(), db.putCh, e.key, e.Encode())
+}
+
+func checkBucketName(name string) error {
+	if name == "" || strings.Contains(name, bucketSeparator) {
+		return fmt.Errorf("%w: %q", ErrInvalidBucket, name)
+	}
+	return nil
+}
+
+// checkKey rejects keys of the default bucket that would be taken for keys of
+// a named bucket.
+func checkKey(key string) error {
+	if isBucketKey(key) {
+		return fmt.Errorf("%w: %q contains the bucket separator", ErrInvalidKey, key)
+	}
+	return nil
+}
+
+func isBucketKey(key string) bool {
+	return strings.Contains(key, bucketSeparator)
+}
+
+func (db *Db) forgetBucket(prefix string) {
+	for key := range db.index {
+		if strings.HasPrefix(key, prefix) {
+			db.forget(key)
+		}
+	}
+}
+
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+func (b *Bucket) Get(key string) (string, error) {
+	return b.db.Get(b.prefix + key)
+}
+
+func (b *Bucket) GetInt64(key string) (int64, error) {
+	return b.db.GetInt64(b.prefix + key)
+}
+
+func (b *Bucket) Put(key, value string) error {
+	return b.db.putString(context.Background(), b.prefix+key, value)
+}
+
+func (b *Bucket) PutInt64(key string, value int64) error {
+	return b.db.putInt64(context.Background(), b.prefix+key, value)
+}
+
+func (b *Bucket) Delete(key string) error {
+	return b.db.delete(b.prefix + key)
+}
+
+func (b *Bucket) Scan(start, end string, fn func(key string, value any) error) error {
+	// The separator is the smallest byte, so every key of the bucket sorts
+	// below the name followed by the next byte.
+	bucketEnd := b.name + "\x01"
+	if end != "" {
+		bucketEnd = b.prefix + end
+	}
+	return b.db.scan(b.prefix+start, bucketEnd, true, 0, func(key string, value any) error {
+		return fn(strings.TrimPrefix(key, b.prefix), value)
+	})
+}
+
+func (b *Bucket) History(key string) ([]Version, error) {
+	return b.db.History(b.prefix + key)
+}
+
+func (b *Bucket) GetVersion(key string, number uint64) (any, error) {
+	return b.db.GetVersion(b.prefix+key, number)
+}
+
+// Stats reports the number of keys of the bucket and the size of their
+// records as Keys and SegmentBytes.
+func (b *Bucket) Stats() Stats {
+	s := b.db.Stats().Buckets[b.name]
+	return Stats{Keys: s.Keys, SegmentBytes: s.Bytes}
+}
+
+// Close does nothing: the bucket is closed together with its database.
+func (b *Bucket) Close() error {
+	return nil
+}
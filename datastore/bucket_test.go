@@ -0,0 +1,186 @@
+package datastore
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDb_Bucket(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := db.Bucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders, err := db.Bucket("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "default"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Put("key", "user"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.PutInt64("count", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := db.Get("key"); err != nil || value != "default" {
+		t.Errorf("Bad value returned: %s (%v)", value, err)
+	}
+	if value, err := users.Get("key"); err != nil || value != "user" {
+		t.Errorf("Bad value returned: %s (%v)", value, err)
+	}
+	if _, err := orders.Get("key"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	var keys []string
+	err = users.Scan("", "", func(key string, value any) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(keys, []string{"count", "key"}) {
+		t.Errorf("Unexpected bucket keys %v (%v)", keys, err)
+	}
+	keys = nil
+	err = db.Scan("", "", func(key string, value any) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(keys, []string{"key"}) {
+		t.Errorf("Unexpected default bucket keys %v (%v)", keys, err)
+	}
+
+	s := db.Stats()
+	if s.Keys != 3 || s.Buckets["users"].Keys != 2 || s.Buckets["users"].Bytes == 0 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+	if s := users.Stats(); s.Keys != 2 {
+		t.Errorf("Unexpected bucket stats %+v", s)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	users, _ = db.Bucket("users")
+	if value, err := users.GetInt64("count"); err != nil || value != 2 {
+		t.Errorf("Bad value returned after reopen: %d (%v)", value, err)
+	}
+
+	if _, err := db.Bucket(""); !errors.Is(err, ErrInvalidBucket) {
+		t.Errorf("Expected ErrInvalidBucket, got %v", err)
+	}
+}
+
+func TestDb_BucketSeparatorKey(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	key := "users" + bucketSeparator + "key"
+	if err := db.Put(key, "value"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey from Put, got %v", err)
+	}
+	if err := db.PutInt64(key, 1); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey from PutInt64, got %v", err)
+	}
+	b := new(Batch)
+	b.Put("valid", "value")
+	b.Put(key, "value")
+	if err := db.Write(b); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey from Write, got %v", err)
+	}
+	users, _ := db.Bucket("users")
+	if err := users.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(key); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey from Delete, got %v", err)
+	}
+	if value, err := users.Get("key"); err != nil || value != "value" {
+		t.Errorf("Bad value returned: %s (%v)", value, err)
+	}
+	if _, err := db.Get("valid"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the batch not to be written, got %v", err)
+	}
+}
+
+func TestDb_DropBucket(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, _ := db.Bucket("tmp")
+	for _, key := range []string{"k1", "k2", "k3"} {
+		if err := tmp.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("kept", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropBucket("tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmp.Put("k4", "new"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		if _, err := tmp.Get("k1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound for a dropped key, got %v", err)
+		}
+		if value, err := tmp.Get("k4"); err != nil || value != "new" {
+			t.Errorf("Bad value written after drop: %s (%v)", value, err)
+		}
+		if value, err := db.Get("kept"); err != nil || value != "value" {
+			t.Errorf("Bad value returned: %s (%v)", value, err)
+		}
+	}
+	check()
+
+	// Trigger merges so that the records of the dropped bucket are discarded.
+	for i := 0; i < 10; i++ {
+		if err := db.Put("filler", "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Stats().Merges == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if db.Stats().Merges == 0 {
+		t.Fatal("Segments were not merged")
+	}
+	check()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tmp, _ = db.Bucket("tmp")
+	check()
+	if s := db.Stats(); s.Buckets["tmp"].Keys != 1 {
+		t.Errorf("Unexpected bucket stats %+v", s.Buckets)
+	}
+}
@@ -0,0 +1,286 @@
+package datastore
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+)
+
+// EvictionPolicy selects the keys a database bounded by Options.MaxKeys or
+// Options.MaxBytes deletes to make room for new ones.
+type EvictionPolicy string
+
+const (
+	// EvictLRU evicts the least recently read or written key.
+	EvictLRU EvictionPolicy = "lru"
+	// EvictLFU evicts the least frequently read or written key, the least
+	// recently used one among equally frequent keys.
+	EvictLFU EvictionPolicy = "lfu"
+	// EvictRandom evicts a random key.
+	EvictRandom EvictionPolicy = "random"
+)
+
+// evictor tracks the use of keys and picks the next key to evict.
+type evictor interface {
+	touch(key string)
+	remove(key string)
+	victim() (string, bool)
+}
+
+// cache bounds the number of keys and the size of their records. Keys over
+// the limit are evicted by writing a tombstone, the same way they are deleted.
+type cache struct {
+	maxKeys   int
+	maxBytes  int64
+	bytes     int64
+	sizes     map[string]int64
+	evictor   evictor
+	evictions uint64
+}
+
+func newCache(opts Options) (*cache, error) {
+	if opts.MaxKeys <= 0 && opts.MaxBytes <= 0 {
+		return nil, nil
+	}
+	c := &cache{maxKeys: opts.MaxKeys, maxBytes: opts.MaxBytes, sizes: make(map[string]int64)}
+	switch opts.Eviction {
+	case EvictLRU, "":
+		c.evictor = newLRUEvictor()
+	case EvictLFU:
+		c.evictor = newLFUEvictor()
+	case EvictRandom:
+		c.evictor = newRandomEvictor()
+	default:
+		return nil, fmt.Errorf("unknown eviction policy %q", opts.Eviction)
+	}
+	return c, nil
+}
+
+// set records a write of the key taking size bytes.
+func (c *cache) set(key string, size int64) {
+	c.bytes += size - c.sizes[key]
+	c.sizes[key] = size
+	c.evictor.touch(key)
+}
+
+func (c *cache) remove(key string) {
+	c.bytes -= c.sizes[key]
+	delete(c.sizes, key)
+	c.evictor.remove(key)
+}
+
+// full reports whether keys have to be evicted. The last key is kept even if
+// its record alone exceeds MaxBytes.
+func (c *cache) full(keys int) bool {
+	if c.maxKeys > 0 && keys > c.maxKeys {
+		return true
+	}
+	return c.maxBytes > 0 && c.bytes > c.maxBytes && keys > 1
+}
+
+// cachedSize returns the size the record takes in the cache. A value moved to
+// a blob counts with the size of the blob, not of the reference to it.
+func (db *Db) cachedSize(data []byte) int64 {
+	size := int64(len(data))
+	if recordType(data) != blobRefType {
+		return size
+	}
+	if ref, err := recordValue(data); err == nil {
+		if info, err := db.fs.Stat(filepath.Join(db.dir, string(ref.(blobRef)))); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+func (db *Db) evictions() uint64 {
+	if db.cache == nil {
+		return 0
+	}
+	return db.cache.evictions
+}
+
+// evict deletes keys until the database fits into the cache limits. A write
+// has already succeeded when it is called, so failures are only reported.
+func (db *Db) evict() {
+	if db.cache == nil {
+		return
+	}
+	for db.cache.full(len(db.index)) {
+		key, ok := db.cache.evictor.victim()
+		if !ok {
+			return
+		}
+		e := entry[tombstone]{key: key}
+		if err := db.writeRecord(key, e.Encode()); err != nil {
+			fmt.Println(err)
+			return
+		}
+		db.cache.evictions++
+	}
+}
+
+type lruEvictor struct {
+	order *list.List
+	elems map[string]*list.Element
+}
+
+func newLRUEvictor() *lruEvictor {
+	return &lruEvictor{order: list.New(), elems: make(map[string]*list.Element)}
+}
+
+func (e *lruEvictor) touch(key string) {
+	if elem, ok := e.elems[key]; ok {
+		e.order.MoveToFront(elem)
+		return
+	}
+	e.elems[key] = e.order.PushFront(key)
+}
+
+func (e *lruEvictor) remove(key string) {
+	if elem, ok := e.elems[key]; ok {
+		e.order.Remove(elem)
+		delete(e.elems, key)
+	}
+}
+
+func (e *lruEvictor) victim() (string, bool) {
+	back := e.order.Back()
+	if back == nil {
+		return "", false
+	}
+	return back.Value.(string), true
+}
+
+type lfuItem struct {
+	key   string
+	count uint64
+	// used orders equally frequent keys by the time of their last use.
+	used  uint64
+	index int
+}
+
+// lfuHeap keeps the least frequently used key on top.
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].used < h[j].used
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x any) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+type lfuEvictor struct {
+	heap  lfuHeap
+	items map[string]*lfuItem
+	clock uint64
+}
+
+func newLFUEvictor() *lfuEvictor {
+	return &lfuEvictor{items: make(map[string]*lfuItem)}
+}
+
+func (e *lfuEvictor) touch(key string) {
+	e.clock++
+	if item, ok := e.items[key]; ok {
+		item.count++
+		item.used = e.clock
+		heap.Fix(&e.heap, item.index)
+		return
+	}
+	item := &lfuItem{key: key, count: 1, used: e.clock}
+	e.items[key] = item
+	heap.Push(&e.heap, item)
+}
+
+func (e *lfuEvictor) remove(key string) {
+	if item, ok := e.items[key]; ok {
+		heap.Remove(&e.heap, item.index)
+		delete(e.items, key)
+	}
+}
+
+// victim skips the key used most recently, which is the key just written when
+// a write makes the database exceed its limits. A new key is the least
+// frequently used one, and would be evicted by its own write otherwise.
+func (e *lfuEvictor) victim() (string, bool) {
+	if len(e.heap) == 0 {
+		return "", false
+	}
+	if e.heap[0].used != e.clock || len(e.heap) == 1 {
+		return e.heap[0].key, true
+	}
+	// The next key in the order is one of the children of the top.
+	next := 1
+	if len(e.heap) > 2 && e.heap.Less(2, 1) {
+		next = 2
+	}
+	return e.heap[next].key, true
+}
+
+type randomEvictor struct {
+	keys      []string
+	positions map[string]int
+	// last is the key used most recently, which is never evicted, so that a
+	// write is not undone by the eviction it causes.
+	last string
+}
+
+func newRandomEvictor() *randomEvictor {
+	return &randomEvictor{positions: make(map[string]int)}
+}
+
+func (e *randomEvictor) touch(key string) {
+	e.last = key
+	if _, ok := e.positions[key]; ok {
+		return
+	}
+	e.positions[key] = len(e.keys)
+	e.keys = append(e.keys, key)
+}
+
+func (e *randomEvictor) remove(key string) {
+	i, ok := e.positions[key]
+	if !ok {
+		return
+	}
+	last := e.keys[len(e.keys)-1]
+	e.keys[i] = last
+	e.positions[last] = i
+	e.keys = e.keys[:len(e.keys)-1]
+	delete(e.positions, key)
+}
+
+func (e *randomEvictor) victim() (string, bool) {
+	if len(e.keys) == 0 {
+		return "", false
+	}
+	i := rand.Intn(len(e.keys))
+	if e.keys[i] == e.last && len(e.keys) > 1 {
+		i = (i + 1) % len(e.keys)
+	}
+	return e.keys[i], true
+}
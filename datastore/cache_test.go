@@ -0,0 +1,211 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDb_Cache(t *testing.T) {
+	tests := []struct {
+		policy  EvictionPolicy
+		evicted string
+	}{
+		// key2 is the least recently used one.
+		{EvictLRU, "key2"},
+		// key3 is read once and key1 twice, key2 is not read at all.
+		{EvictLFU, "key2"},
+	}
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			dir := t.TempDir()
+			opts := Options{SegmentSize: 1024, MaxKeys: 3, Eviction: test.policy}
+			db, err := NewDbWithOptions(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range []string{"key1", "key2", "key3"} {
+				if err := db.Put(key, "value"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, key := range []string{"key1", "key3", "key1"} {
+				if _, err := db.Get(key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Put("key4", "value"); err != nil {
+				t.Fatal(err)
+			}
+
+			check := func() {
+				t.Helper()
+				for _, key := range []string{"key1", "key2", "key3", "key4"} {
+					_, err := db.Get(key)
+					if key == test.evicted && !errors.Is(err, ErrNotFound) {
+						t.Errorf("Expected %s to be evicted, got %v", key, err)
+					}
+					if key != test.evicted && err != nil {
+						t.Errorf("Unexpected error for %s: %v", key, err)
+					}
+				}
+			}
+			check()
+			if s := db.Stats(); s.Keys != 3 || s.Evictions != 1 {
+				t.Errorf("Expected 3 keys and 1 eviction, got %d and %d", s.Keys, s.Evictions)
+			}
+
+			// Evictions are stored as tombstones.
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			db, err = NewDbWithOptions(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			check()
+		})
+	}
+}
+
+func TestDb_Cache_Random(t *testing.T) {
+	db, err := NewDbWithOptions(t.TempDir(), Options{SegmentSize: 256, MaxKeys: 5, Eviction: EvictRandom})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := db.Stats(); s.Keys != 5 || s.Evictions != 15 {
+		t.Errorf("Expected 5 keys and 15 evictions, got %d and %d", s.Keys, s.Evictions)
+	}
+	if _, err := db.Get("key19"); err != nil {
+		t.Errorf("The last written key was evicted: %v", err)
+	}
+}
+
+func TestRandomEvictor(t *testing.T) {
+	e := newRandomEvictor()
+	for _, key := range []string{"key1", "key2", "key3", "key2"} {
+		e.touch(key)
+	}
+	// key2 was used last, so it is never picked while there are others.
+	for i := 0; i < 100; i++ {
+		if key, ok := e.victim(); !ok || key == "key2" {
+			t.Fatalf("Unexpected victim %s", key)
+		}
+	}
+	e.remove("key1")
+	e.remove("key3")
+	if key, ok := e.victim(); !ok || key != "key2" {
+		t.Errorf("Expected the only key to be the victim, got %s", key)
+	}
+}
+
+func TestDb_Cache_LFU_NewKey(t *testing.T) {
+	db, err := NewDbWithOptions(t.TempDir(), Options{SegmentSize: 1024, MaxKeys: 2, Eviction: EvictLFU})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"a", "b"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"a", "b"} {
+		if _, err := db.Get(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// c is used less often than a and b, but it is the key being written.
+	if err := db.Put("c", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("c"); err != nil {
+		t.Errorf("The last written key was evicted: %v", err)
+	}
+	if _, err := db.Get("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected a to be evicted, got %v", err)
+	}
+	if s := db.Stats(); s.Keys != 2 || s.Evictions != 1 {
+		t.Errorf("Expected 2 keys and 1 eviction, got %d and %d", s.Keys, s.Evictions)
+	}
+}
+
+func TestDb_Cache_MaxBytes(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The limit is applied to a database written without one when it is
+	// opened.
+	e := entry[string]{key: "key0", value: "value"}
+	size := int64(len(withVersion(e.Encode(), 1)))
+	db, err = NewDbWithOptions(dir, Options{SegmentSize: 1024, MaxBytes: 4 * size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if s := db.Stats(); s.Keys != 4 || s.Evictions != 6 {
+		t.Errorf("Expected 4 keys and 6 evictions, got %d and %d", s.Keys, s.Evictions)
+	}
+	for i := 6; i < 10; i++ {
+		if _, err := db.Get(fmt.Sprintf("key%d", i)); err != nil {
+			t.Errorf("Unexpected error for key%d: %v", i, err)
+		}
+	}
+
+	// A value larger than the cache still fits on its own.
+	large := make([]byte, 8*size)
+	if err := db.Put("large", string(large)); err != nil {
+		t.Fatal(err)
+	}
+	if s := db.Stats(); s.Keys != 1 {
+		t.Errorf("Expected only the large key to remain, got %d keys", s.Keys)
+	}
+}
+
+func TestDb_Cache_UnknownPolicy(t *testing.T) {
+	if _, err := NewDbWithOptions(t.TempDir(), Options{MaxKeys: 1, Eviction: "fifo"}); err == nil {
+		t.Error("Expected an error for an unknown eviction policy")
+	}
+}
+
+func TestDb_Cache_MaxBytes_Blobs(t *testing.T) {
+	value := strings.Repeat("v", 1000)
+	db, err := NewDbWithOptions(t.TempDir(), Options{SegmentSize: 1024, DedupThreshold: 100, MaxBytes: 2500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// The records only refer to the shared blob, but each key counts with
+	// the whole value.
+	for i := 0; i < 5; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := db.Stats(); s.Keys != 2 || s.Evictions != 3 {
+		t.Errorf("Expected 2 keys and 3 evictions, got %d and %d", s.Keys, s.Evictions)
+	}
+	if v, err := db.Get("key4"); err != nil || v != value {
+		t.Errorf("Bad value returned for key4 (%v)", err)
+	}
+}
@@ -0,0 +1,282 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+const crashDir = "db"
+
+// crashOp is a step of the workload that the crash tests replay against a
+// database and a model map.
+type crashOp struct {
+	batch  bool
+	keys   []string
+	values []string // an empty value deletes the key
+}
+
+// crashEngine opens a storage engine under the crash tests.
+type crashEngine struct {
+	open    func(fsys FS) (Engine, error)
+	batches bool
+}
+
+var (
+	crashDb = crashEngine{
+		open: func(fsys FS) (Engine, error) {
+			return NewDbWithOptions(crashDir, crashOptions(fsys))
+		},
+		batches: true,
+	}
+	crashLsm = crashEngine{
+		open: func(fsys FS) (Engine, error) {
+			return NewLsmDbWithOptions(crashDir, crashOptions(fsys))
+		},
+	}
+)
+
+func crashWorkload(seed int64, n int, batches bool) []crashOp {
+	r := rand.New(rand.NewSource(seed))
+	ops := make([]crashOp, n)
+	for i := range ops {
+		var op crashOp
+		count := 1
+		if r.Intn(4) == 0 && batches {
+			op.batch = true
+			count = 2
+		}
+		for j := 0; j < count; j++ {
+			op.keys = append(op.keys, fmt.Sprintf("k%d", r.Intn(10)))
+			value := ""
+			if r.Intn(5) != 0 {
+				value = fmt.Sprintf("v%d-%d%s", i, j, strings.Repeat("x", r.Intn(20)))
+			}
+			op.values = append(op.values, value)
+		}
+		ops[i] = op
+	}
+	return ops
+}
+
+func (op crashOp) apply(db Engine) error {
+	if op.batch {
+		var b Batch
+		for i, key := range op.keys {
+			if op.values[i] == "" {
+				b.Delete(key)
+			} else {
+				b.Put(key, op.values[i])
+			}
+		}
+		return db.(BatchEngine).Write(&b)
+	}
+	if op.values[0] == "" {
+		return db.Delete(op.keys[0])
+	}
+	return db.Put(op.keys[0], op.values[0])
+}
+
+func (op crashOp) update(model map[string]string) {
+	for i, key := range op.keys {
+		if op.values[i] == "" {
+			delete(model, key)
+		} else {
+			model[key] = op.values[i]
+		}
+	}
+}
+
+func crashOptions(fsys FS) Options {
+	return Options{SegmentSize: 200, FS: fsys}
+}
+
+// contents reads every key the workload may have written.
+func contents(db Engine) (map[string]string, error) {
+	res := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("k%d", i)
+		value, err := db.Get(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res[key] = value
+	}
+	return res, nil
+}
+
+func equalModels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if v, ok := b[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// checkRecovered opens the database and checks that it holds either the model
+// or the model with the pending operation applied as a whole.
+func checkRecovered(t *testing.T, e crashEngine, fsys FS, model map[string]string, pending *crashOp) {
+	t.Helper()
+	db, err := e.open(fsys)
+	if err != nil {
+		t.Fatalf("Recovery failed: %v", err)
+	}
+	defer db.Close()
+	got, err := contents(db)
+	if err != nil {
+		t.Fatalf("Read after recovery failed: %v", err)
+	}
+	expected := []map[string]string{model}
+	if pending != nil {
+		applied := make(map[string]string, len(model))
+		for key, value := range model {
+			applied[key] = value
+		}
+		pending.update(applied)
+		expected = append(expected, applied)
+	}
+	ok := false
+	for _, m := range expected {
+		ok = ok || equalModels(got, m)
+	}
+	if !ok {
+		t.Fatalf("Recovered %v, expected one of %v", got, expected)
+	}
+
+	// The recovered database keeps working.
+	if err := db.Put("after", "recovery"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("after"); err != nil || value != "recovery" {
+		t.Fatalf("Bad value returned after recovery: %s (%v)", value, err)
+	}
+}
+
+// waitForMerge gives a merge started by the workload a chance to finish, so
+// that faults are injected into merges as well.
+func waitForMerge(db Engine, fsys *FaultFS) {
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Stats().Merges == 0 && !fsys.Faulted() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// countOps runs the workload without faults and returns the number of file
+// system operations it takes.
+func countOps(t *testing.T, e crashEngine, ops []crashOp) int {
+	t.Helper()
+	fsys := NewFaultFS(NewMemFS(), FaultFail, 0)
+	db, err := e.open(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range ops {
+		if err := op.apply(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForMerge(db, fsys)
+	if db.Stats().Merges == 0 {
+		t.Fatal("The workload does not merge segments")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return fsys.Ops()
+}
+
+func TestDb_Crash(t *testing.T) {
+	testCrash(t, crashDb)
+}
+
+func TestLsmDb_Crash(t *testing.T) {
+	testCrash(t, crashLsm)
+}
+
+func testCrash(t *testing.T, e crashEngine) {
+	ops := crashWorkload(1, 60, e.batches)
+	total := countOps(t, e, ops)
+	for n := 1; n <= total; n++ {
+		mem := NewMemFS()
+		fsys := NewFaultFS(mem, FaultCrash, n)
+		model := make(map[string]string)
+		var pending *crashOp
+		if db, err := e.open(fsys); err == nil {
+			for i := range ops {
+				if err := ops[i].apply(db); err != nil {
+					pending = &ops[i]
+					break
+				}
+				ops[i].update(model)
+			}
+			if pending == nil {
+				waitForMerge(db, fsys)
+			}
+			_ = db.Close()
+		}
+		if !fsys.Faulted() {
+			continue
+		}
+		t.Run(fmt.Sprintf("op%d", n), func(t *testing.T) {
+			checkRecovered(t, e, mem, model, pending)
+		})
+	}
+}
+
+// TestDb_Faults checks that a failed operation has no effect and that the
+// database keeps working after it.
+func TestDb_Faults(t *testing.T) {
+	testFaults(t, crashDb)
+}
+
+func TestLsmDb_Faults(t *testing.T) {
+	testFaults(t, crashLsm)
+}
+
+func testFaults(t *testing.T, e crashEngine) {
+	ops := crashWorkload(2, 60, e.batches)
+	total := countOps(t, e, ops)
+	for _, mode := range []FaultMode{FaultFail, FaultShortWrite} {
+		for n := 1; n <= total; n++ {
+			mem := NewMemFS()
+			fsys := NewFaultFS(mem, mode, n)
+			db, err := e.open(fsys)
+			if err != nil {
+				checkRecovered(t, e, mem, nil, nil)
+				continue
+			}
+			model := make(map[string]string)
+			for _, op := range ops {
+				if err := op.apply(db); err == nil {
+					op.update(model)
+				} else if !errors.Is(err, ErrInjected) {
+					t.Fatalf("Unexpected error with a fault at operation %d: %v", n, err)
+				}
+			}
+			waitForMerge(db, fsys)
+			if !fsys.Faulted() {
+				_ = db.Close()
+				continue
+			}
+			got, err := contents(db)
+			if err != nil {
+				t.Fatalf("Read failed with a fault at operation %d: %v", n, err)
+			}
+			if !equalModels(got, model) {
+				t.Fatalf("Got %v with a fault at operation %d, expected %v", got, n, model)
+			}
+			_ = db.Close()
+			checkRecovered(t, e, mem, model, nil)
+		}
+	}
+}
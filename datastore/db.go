@@ -2,347 +2,878 @@ package datastore
 
 import (
 	"bufio"
-	"encoding/binary"
+	"container/heap"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
-	outFileName = "segment"
-	bufSize     = 8192
+	outFileName    = "segment"
+	tempFileName   = "temp"
+	mergedFileName = "merged"
+	bufSize        = 8192
 )
 
-var ErrNotFound = fmt.Errorf("record does not exist")
+var (
+	ErrNotFound     = fmt.Errorf("record does not exist")
+	ErrClosed       = fmt.Errorf("database is closed")
+	ErrTypeMismatch = fmt.Errorf("value does not match expected type")
+	ErrCorrupted    = fmt.Errorf("corrupted file")
+)
 
 type hashIndex map[string]int64
 
+type keyOffset struct {
+	key    string
+	offset int64
+}
+
+type scanRequest struct {
+	start, end string
+	// buckets includes keys of named buckets in the result.
+	buckets bool
+	// limit is the maximum number of keys returned, 0 for no limit.
+	limit int
+	reply chan []keyOffset
+}
+
+type putRequest struct {
+	key   string
+	data  []byte
+	reply chan error
+}
+
+type getRequest struct {
+	key   string
+	reply chan location
+}
+
+// location is the offset of the current record of a key and its version.
+type location struct {
+	offset  int64
+	version uint64
+}
+
 type Db struct {
-	out             *os.File
+	fs              FS
+	out             File
 	outPath         string
 	outOffset       int64
+	outHeaderSize   int64
 	fileNumber      int
-	segmentNumbers  []int
 	dir             string
-	lastChangedEl   string
 	segmentSize     int
+	opts            Options
 	mergingSegments []string
+	movingSegments  []string
 	mergeMu         sync.Mutex
-	putCh           chan entry[string]
-	putInt64Ch      chan entry[int64]
-	getInt64Ch      chan string
-	getCh           chan string
-	getOffsetCh     chan int64
-	finishMergeCh   chan hashIndex
+	filesMu         sync.RWMutex
+	generation      uint64
+	putCh           chan putRequest
+	deleteCh        chan putRequest
+	deleteRangeCh   chan deleteRangeRequest
+	scanCh          chan scanRequest
+	getCh           chan getRequest
+	getManyCh       chan getManyRequest
+	finishMergeCh   chan mergeState
+	finishMoveCh    chan moveState
+	historyCh       chan historyRequest
+	batchCh         chan batchRequest
+	commitCh        chan commitRequest
+	queryCh         chan queryRequest
+	statsCh         chan chan statsSnapshot
 	index           hashIndex
+	sizes           map[string]int64
+	versions        map[string]uint64
+	sequence        uint64
+	history         map[string][]version
+	liveBytes       int64
+	buckets         map[string]BucketStats
+	blobs           map[string]string
+	blobRefs        map[string]int
+	cold            map[int]string
+	compressed      compressedSegments
+	secondary       map[string]*secondaryIndex
+	cache           *cache
+	nextBlob        int
+	merges          uint64
+	mergeStarted    time.Time
+	mergeDuration   time.Duration
+	readLatency     *latencyRecorder
+	writeLatency    *latencyRecorder
+	done            chan struct{}
+	monitorDone     chan struct{}
+	closeOnce       sync.Once
+	mergeCtx        context.Context
+	mergeCancel     context.CancelFunc
+	mergeWg         sync.WaitGroup
 }
 
 func NewDb(dir string, segmentSize int) (*Db, error) {
-	outputPath := filepath.Join(dir, outFileName+"-1")
-	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	return NewDbWithOptions(dir, Options{SegmentSize: segmentSize})
+}
+
+func NewDbWithOptions(dir string, opts Options) (*Db, error) {
+	opts = opts.withDefaults()
+	if opts.ColdDir != "" && filepath.Clean(opts.ColdDir) == filepath.Clean(dir) {
+		return nil, fmt.Errorf("cold directory must differ from the database directory")
+	}
+	c, err := newCache(opts)
 	if err != nil {
 		return nil, err
 	}
 	db := &Db{
-		outPath:         outputPath,
-		out:             f,
+		fs:              opts.FS,
 		index:           make(hashIndex),
-		segmentNumbers:  make([]int, 0),
 		mergingSegments: make([]string, 0),
 		fileNumber:      1,
 		dir:             dir,
-		segmentSize:     segmentSize,
-		putCh:           make(chan entry[string]),
-		putInt64Ch:      make(chan entry[int64]),
-		getInt64Ch:      make(chan string),
-		getCh:           make(chan string),
-		getOffsetCh:     make(chan int64),
-		finishMergeCh:   make(chan hashIndex),
+		segmentSize:     opts.SegmentSize,
+		opts:            opts,
+		putCh:           make(chan putRequest),
+		deleteCh:        make(chan putRequest),
+		deleteRangeCh:   make(chan deleteRangeRequest),
+		scanCh:          make(chan scanRequest),
+		getCh:           make(chan getRequest),
+		getManyCh:       make(chan getManyRequest),
+		finishMergeCh:   make(chan mergeState),
+		finishMoveCh:    make(chan moveState),
+		historyCh:       make(chan historyRequest),
+		batchCh:         make(chan batchRequest),
+		commitCh:        make(chan commitRequest),
+		queryCh:         make(chan queryRequest),
+		statsCh:         make(chan chan statsSnapshot),
+		sizes:           make(map[string]int64),
+		versions:        make(map[string]uint64),
+		history:         make(map[string][]version),
+		buckets:         make(map[string]BucketStats),
+		blobs:           make(map[string]string),
+		blobRefs:        make(map[string]int),
+		cold:            make(map[int]string),
+		secondary:       newSecondaryIndexes(opts.Indexes),
+		cache:           c,
+		nextBlob:        1,
+		readLatency:     newLatencyRecorder(),
+		writeLatency:    newLatencyRecorder(),
+		done:            make(chan struct{}),
+		monitorDone:     make(chan struct{}),
 	}
+	db.mergeCtx, db.mergeCancel = context.WithCancel(context.Background())
 	db.mergingSegments = nil
-	db.segmentNumbers = db.getSegmentNumbers()
 	err = db.recover()
-	if err != nil && err != io.EOF {
+	if err == nil || err == io.EOF {
+		err = db.removeUnreferencedBlobs()
+	}
+	if err != nil {
+		if db.out != nil {
+			_ = db.out.Close()
+		}
 		return nil, err
 	}
+	// The limits may have been lowered since the database was written.
+	db.evict()
 	go db.OperationMonitor()
 
 	return db, nil
 }
 
 func (db *Db) recover() error {
+	if err := db.completeMove(); err != nil {
+		return err
+	}
+	if err := db.completeMerge(); err != nil {
+		return err
+	}
 	segments, err := db.getAllSegments()
 	if err != nil {
 		return err
 	}
-	_, err = os.Stat("temp")
-	if !os.IsNotExist(err) {
-		_, err = os.Stat(outFileName + "-1")
-		if !os.IsNotExist(err) {
-			err = os.Remove("temp")
-			if err != nil {
-				return err
-			}
-		} else {
-			err = os.Rename("temp", outFileName+"-1")
-			if err != nil {
-				return err
-			}
-		}
+	if len(segments) == 0 {
+		db.outPath = db.segmentPath(1)
+		db.out, db.outHeaderSize, err = openSegment(db.fs, db.outPath, 1)
+		db.outOffset = db.outHeaderSize
+		return err
 	}
-	for i, segment := range segments {
-		if err := db.processSegment(segment, i == len(segments)-1); err != nil {
+	// Cold segments are not written to, so the active segment is always hot.
+	if last, _ := segmentNumber(segments[len(segments)-1]); db.cold[last] != "" {
+		f, _, err := openSegment(db.fs, db.segmentPath(last+1), last+1)
+		if err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
 			return err
 		}
+		segments = append(segments, db.segmentPath(last+1))
 	}
-	return nil
+	return db.loadSegments(segments)
 }
 
-func (db *Db) processSegment(segment string, isLastSegment bool) error {
-	db.outOffset = 0
-	fileNumber, err := strconv.Atoi(segment[8:])
+// completeMerge finishes a merge interrupted by a crash. A merged segment is
+// renamed from temp to merged-F-L once it is complete, which commits the merge
+// of segments F to L. A temp file is a merge that was not committed.
+func (db *Db) completeMerge() error {
+	merged, err := db.fs.Glob(filepath.Join(db.dir, mergedFileName+"-*"))
 	if err != nil {
 		return err
 	}
-	input, err := os.Open(segment)
-	if err != nil {
-		return err
+	type mergeRange struct{ first, last int }
+	ranges := make(map[string]mergeRange, len(merged))
+	for _, path := range merged {
+		if first, last, err := parseMergedName(path); err == nil {
+			ranges[path] = mergeRange{first, last}
+		}
 	}
-	defer func(input *os.File) {
-		err := input.Close()
-		if err != nil {
-			fmt.Println(err)
+	sort.Slice(merged, func(i, j int) bool { return ranges[merged[i]].last < ranges[merged[j]].last })
+	for _, path := range merged {
+		r, ok := ranges[path]
+		if !ok {
+			continue
 		}
-	}(input)
-	in := bufio.NewReaderSize(input, bufSize)
-	for {
-		header, err := in.Peek(bufSize)
-		if err == io.EOF {
-			if len(header) == 0 {
-				if isLastSegment {
-					return db.prepareLastSegment(segment, fileNumber)
-				}
-				return nil
-			}
-		} else if err != nil {
+		if err := db.replaceSegments(path, r.first, r.last); err != nil {
 			return err
 		}
-		size := binary.LittleEndian.Uint32(header)
-		data := make([]byte, size)
-		n, err := in.Read(data)
-		if err != nil {
-			return err
+	}
+	temp := filepath.Join(db.dir, tempFileName)
+	if _, err := db.fs.Stat(temp); err != nil {
+		return nil
+	}
+	// Earlier versions renamed temp to segment-1 right after removing the
+	// merged segments, so temp without segment-1 is a complete merge. Those
+	// versions did not move segments to a cold directory.
+	if _, err := db.fs.Stat(db.segmentPath(1)); os.IsNotExist(err) && len(db.cold) == 0 {
+		return db.fs.Rename(temp, db.segmentPath(1))
+	}
+	return db.fs.Remove(temp)
+}
+
+// replaceSegments removes the segments from first to last and puts the merged
+// segment in place of the first one. Merged segments are always hot.
+func (db *Db) replaceSegments(merged string, first, last int) error {
+	segments, err := db.listSegments(db.dir)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if n, _ := segmentNumber(segment); n >= first && n <= last {
+			if err := db.fs.Remove(segment); err != nil {
+				return err
+			}
 		}
-		if n != int(size) {
-			return fmt.Errorf("corrupted file")
+	}
+	return db.fs.Rename(merged, db.segmentPath(first))
+}
+
+func mergedName(first, last int) string {
+	return mergedFileName + "-" + strconv.Itoa(first) + "-" + strconv.Itoa(last)
+}
+
+// parseMergedName returns the range of segments a merged segment replaces.
+// Earlier versions always merged from the first segment and named the merged
+// segment after the last one only.
+func parseMergedName(path string) (int, int, error) {
+	name := strings.TrimPrefix(filepath.Base(path), mergedFileName+"-")
+	firstName, lastName, ok := strings.Cut(name, "-")
+	if !ok {
+		last, err := strconv.Atoi(name)
+		return 1, last, err
+	}
+	first, err := strconv.Atoi(firstName)
+	if err != nil {
+		return 0, 0, err
+	}
+	last, err := strconv.Atoi(lastName)
+	return first, last, err
+}
+
+// applyRecords applies a single record or every record of a batch group.
+func (db *Db) applyRecords(data []byte, offset int64) {
+	if recordType(data) != batchType {
+		db.applyRecord(recordKey(data), data, offset)
+		return
+	}
+	start := batchHeaderSize
+	for _, record := range splitBatch(data) {
+		db.applyRecord(recordKey(record), record, offset+int64(start))
+		start += len(record)
+	}
+}
+
+// applyRecord updates the in-memory state with a record stored at offset.
+func (db *Db) applyRecord(key string, data []byte, offset int64) {
+	// Deletions are numbered as well, so that the sequence does not go back
+	// when a deleted key is written again.
+	number, ok := recordVersion(data)
+	if !ok {
+		number = db.sequence + 1
+	}
+	db.sequence = max(db.sequence, number)
+	switch recordType(data) {
+	case tombstoneType:
+		db.forget(key)
+		return
+	case dropBucketType:
+		db.forgetBucket(key)
+		return
+	case rangeTombstoneType:
+		db.forgetRange(key, recordRangeEnd(data))
+		return
+	}
+	previous, exists := db.index[key]
+	if exists && db.opts.Versions > 1 {
+		db.pushHistory(key, previous)
+	}
+	if db.cache != nil {
+		db.cache.set(key, db.cachedSize(data))
+	}
+	keys := 1
+	if exists {
+		keys = 0
+	}
+	db.countKey(key, keys, int64(len(data))-db.sizes[key])
+	db.index[key] = offset
+	db.sizes[key] = int64(len(data))
+	db.versions[key] = number
+	db.trackBlob(key, data)
+	db.updateIndexes(key, data)
+}
+
+func (db *Db) forget(key string) {
+	if _, ok := db.index[key]; ok {
+		if db.cache != nil {
+			db.cache.remove(key)
 		}
-		var e entry[string]
-		e.Decode(data)
-		db.index[e.key] = db.outOffset + int64((fileNumber-1)*db.segmentSize)
-		db.outOffset += int64(n)
+		db.countKey(key, -1, -db.sizes[key])
 	}
+	db.refBlob(db.blobs[key], -1)
+	for _, v := range db.history[key] {
+		db.refBlob(v.blob, -1)
+		db.liveBytes -= v.size
+	}
+	delete(db.index, key)
+	delete(db.sizes, key)
+	delete(db.blobs, key)
+	delete(db.versions, key)
+	delete(db.history, key)
+	db.removeFromIndexes(key)
+}
+
+// packOffset combines the segment number and the position of a record in it
+// into a single index value.
+func packOffset(fileNumber int, position int64) int64 {
+	return int64(fileNumber)<<32 | position
+}
+
+func unpackOffset(offset int64) (int, int64) {
+	return int(offset >> 32), offset & 0xffffffff
 }
 
 func (db *Db) prepareLastSegment(segment string, fileNumber int) error {
-	err := db.out.Close()
-	if err != nil {
-		return err
+	var err error
+	if db.out != nil {
+		if err = db.out.Close(); err != nil {
+			return err
+		}
 	}
 	db.fileNumber = fileNumber
-	db.out, err = os.OpenFile(segment, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	db.outPath = segment
+	db.out, db.outHeaderSize, err = openSegment(db.fs, segment, fileNumber)
 	if err != nil {
 		return err
 	}
+	if db.outOffset < db.outHeaderSize {
+		db.outOffset = db.outHeaderSize
+	}
 	return nil
 }
 
 func (db *Db) OperationMonitor() {
+	defer close(db.monitorDone)
+	var tierTicks <-chan time.Time
+	if db.opts.ColdDir != "" {
+		ticker := time.NewTicker(tierCheckInterval(db.opts.ColdAge))
+		defer ticker.Stop()
+		tierTicks = ticker.C
+	}
 	for {
 		select {
-		case e := <-db.putCh:
-			db.makeRecord(e)
-		case e := <-db.putInt64Ch:
-			db.makeRecordInt64(e)
-		case key := <-db.getCh:
-			offset := db.getOffset(key)
-			db.getOffsetCh <- offset
-		case key := <-db.getInt64Ch:
-			offset := db.getOffset(key)
-			db.getOffsetCh <- offset
-		case index := <-db.finishMergeCh:
-			err := db.finishMergingSegments(index)
+		case <-db.done:
+			return
+		case req := <-db.putCh:
+			req.reply <- db.writeRecord(req.key, req.data)
+			db.evict()
+		case req := <-db.deleteCh:
+			req.reply <- db.makeTombstone(req.key, req.data)
+		case req := <-db.deleteRangeCh:
+			req.reply <- db.deleteRange(req.start, req.end)
+		case req := <-db.scanCh:
+			req.reply <- db.scanIndex(req.start, req.end, req.buckets, req.limit)
+		case req := <-db.getCh:
+			req.reply <- db.locate(req.key)
+		case req := <-db.getManyCh:
+			req.reply <- db.locateMany(req.keys)
+		case req := <-db.historyCh:
+			req.reply <- db.versionsOf(req.key)
+		case req := <-db.batchCh:
+			req.reply <- db.writeBatch(req.records)
+			db.evict()
+		case req := <-db.commitCh:
+			req.reply <- db.commit(req.reads, req.records)
+			db.evict()
+		case req := <-db.queryCh:
+			req.reply <- db.queryIndex(req.name, req.value)
+		case state := <-db.finishMergeCh:
+			err := db.finishMergingSegments(state)
 			if err != nil {
 				fmt.Println(err)
 			}
+		case state := <-db.finishMoveCh:
+			if err := db.finishMovingSegments(state); err != nil {
+				fmt.Println(err)
+			}
+		case <-tierTicks:
+			if err := db.startMoveProcess(); err != nil {
+				fmt.Println(err)
+			}
+		case reply := <-db.statsCh:
+			reply <- db.collectStats()
 		}
 	}
 }
 
+// Close stops accepting operations, cancels a merge in progress and syncs the
+// active segment to disk. Subsequent operations fail with ErrClosed.
 func (db *Db) Close() error {
-	for {
-		if db.mergingSegments == nil {
-			return db.out.Close()
+	var err error
+	db.closeOnce.Do(func() {
+		close(db.done)
+		<-db.monitorDone
+		db.mergeCancel()
+		db.mergeWg.Wait()
+		if err = db.out.Sync(); err != nil {
+			_ = db.out.Close()
+			return
 		}
-	}
+		err = db.out.Close()
+	})
+	return err
 }
 
-func (db *Db) Get(key string) (string, error) {
-	db.getCh <- key
-	offset := <-db.getOffsetCh
-	if offset == -1 {
-		return "", ErrNotFound
+func request[T any](ctx context.Context, db *Db, ch chan<- T, req T) error {
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	reader, file, err := db.getReaderByOffset(offset)
-	if err != nil {
-		return "", err
+	select {
+	case ch <- req:
+		return nil
+	case <-db.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	defer func(file *os.File) {
-		err := file.Close()
-		if err != nil {
-			fmt.Println(err)
-		}
-	}(file)
-	value, err := readValue(reader)
+}
+
+func await[T any](ctx context.Context, reply <-chan T) (T, error) {
+	select {
+	case res := <-reply:
+		return res, nil
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+func (db *Db) Get(key string) (string, error) {
+	return db.GetContext(context.Background(), key)
+}
+
+func (db *Db) GetContext(ctx context.Context, key string) (string, error) {
+	value, _, err := db.get(ctx, key)
 	if err != nil {
 		return "", err
 	}
 
 	stingValue, ok := value.(string)
 	if !ok {
-		return "", fmt.Errorf("value does not match expected type: string")
+		return "", fmt.Errorf("%w: string", ErrTypeMismatch)
 	}
 
 	return stingValue, nil
 }
 
-func (db *Db) getReaderByOffset(offset int64) (*bufio.Reader, *os.File, error) {
-	fileNumber := int(math.Floor(float64(offset/int64(db.segmentSize)))) + 1
-	if !db.checkFileNumberExistence(fileNumber) {
-		fileNumber = 1
+func (db *Db) get(ctx context.Context, key string) (any, uint64, error) {
+	defer db.observeRead(time.Now())
+	var loc location
+	var value any
+	err := db.readConsistent(func() error {
+		reply := make(chan location, 1)
+		if err := request(ctx, db, db.getCh, getRequest{key: key, reply: reply}); err != nil {
+			return err
+		}
+		var err error
+		loc, err = await(ctx, reply)
+		return err
+	}, func() error {
+		if loc.offset == -1 {
+			return ErrNotFound
+		}
+		var err error
+		value, err = db.readValueAt(loc.offset)
+		return err
+	})
+	return value, loc.version, err
+}
+
+// readConsistent obtains offsets from the monitor with locate and reads the
+// records they point to with read. Both steps are repeated if a merge has
+// replaced the segment files in between.
+func (db *Db) readConsistent(locate func() error, read func() error) error {
+	for {
+		db.filesMu.RLock()
+		generation := db.generation
+		db.filesMu.RUnlock()
+
+		if err := locate(); err != nil {
+			return err
+		}
+
+		db.filesMu.RLock()
+		if generation != db.generation {
+			db.filesMu.RUnlock()
+			continue
+		}
+		err := read()
+		db.filesMu.RUnlock()
+		return err
 	}
-	position := offset - int64((fileNumber-1)*db.segmentSize)
-	outPath := filepath.Join(db.dir, outFileName+"-"+strconv.FormatInt(int64(fileNumber), 10))
-	file, err := os.Open(outPath)
-	if err != nil {
-		return nil, file, err
+}
+
+func (db *Db) put(ctx context.Context, ch chan putRequest, key string, data []byte) error {
+	reply := make(chan error, 1)
+	if err := request(ctx, db, ch, putRequest{key: key, data: data, reply: reply}); err != nil {
+		return err
 	}
-	_, err = file.Seek(position, 0)
+	err, ctxErr := await(ctx, reply)
+	if ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+func (db *Db) readValueAt(offset int64) (any, error) {
+	reader, file, err := db.getReaderByOffset(offset)
 	if err != nil {
-		return nil, file, err
+		return nil, err
 	}
-	return bufio.NewReader(file), file, nil
+	defer func(file io.Closer) {
+		err := file.Close()
+		if err != nil {
+			fmt.Println(err)
+		}
+	}(file)
+	value, err := readValue(reader)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		// The index points at a record cut short.
+		return nil, fmt.Errorf("%w: %w", ErrCorrupted, io.ErrUnexpectedEOF)
+	}
+	if ref, ok := value.(blobRef); ok && err == nil {
+		return db.readBlob(ref)
+	}
+	return value, err
+}
+
+func (db *Db) getReaderByOffset(offset int64) (*bufio.Reader, io.Closer, error) {
+	fileNumber, position := unpackOffset(offset)
+	return db.segmentReader(fileNumber, position)
+}
+
+func (db *Db) observeRead(start time.Time) {
+	db.readLatency.observe(time.Since(start))
+}
+
+func (db *Db) observeWrite(start time.Time) {
+	db.writeLatency.observe(time.Since(start))
 }
 
-func (db *Db) getOffset(key string) int64 {
+func (db *Db) locate(key string) location {
 	offset, ok := db.index[key]
 	if !ok {
-		return -1
+		return location{offset: -1}
 	}
-	return offset
+	if db.cache != nil {
+		db.cache.evictor.touch(key)
+	}
+	return location{offset: offset, version: db.versions[key]}
 }
 
 func (db *Db) Put(key, value string) error {
+	return db.PutContext(context.Background(), key, value)
+}
+
+func (db *Db) PutContext(ctx context.Context, key, value string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return db.putString(ctx, key, value)
+}
+
+// putString writes a string value of a key of any bucket.
+func (db *Db) putString(ctx context.Context, key, value string) error {
+	if err := db.opts.checkSize(key, len(value)); err != nil {
+		return err
+	}
 	e := entry[string]{
 		key:   key,
 		value: value,
 	}
-	db.putCh <- e
-	return nil
+	return db.put(ctx, db.putCh, e.key, e.Encode())
 }
 
-func (db *Db) makeRecord(e entry[string]) {
-	fileInfo, err := db.out.Stat()
+func (db *Db) makeTombstone(key string, data []byte) error {
+	if _, ok := db.index[key]; !ok {
+		return nil
+	}
+	return db.writeRecord(key, data)
+}
+
+func (db *Db) writeRecord(key string, data []byte) error {
+	defer db.observeWrite(time.Now())
+	data, err := db.externalize(key, data)
 	if err != nil {
-		return
+		return err
 	}
-	if int64(len(e.Encode())) > (int64(db.segmentSize) - fileInfo.Size()) {
-		db.lastChangedEl = e.key
-		err = db.createNewSegment()
-		if err != nil {
-			return
-		}
+	if len(data) > db.segmentSize {
+		return fmt.Errorf("%w: record does not fit into a segment", ErrKeyTooLarge)
 	}
-	n, err := db.out.Write(e.Encode())
-	if err == nil {
-		db.index[e.key] = db.outOffset + int64((db.fileNumber-1)*db.segmentSize)
-		db.outOffset += int64(n)
+	data = withVersion(data, db.sequence+1)
+	if err := db.ensureSpace(len(data)); err != nil {
+		return err
+	}
+	if err := db.write(data); err != nil {
+		return err
 	}
+	db.applyRecord(key, data, packOffset(db.fileNumber, db.outOffset))
+	db.outOffset += int64(len(data))
+	return nil
 }
 
-func (db *Db) makeRecordInt64(e entry[int64]) {
-	fileInfo, err := db.out.Stat()
-	if err != nil {
-		return
-	}
-	if int64(len(e.Encode())) > (int64(db.segmentSize) - fileInfo.Size()) {
-		db.lastChangedEl = e.key
-		err = db.createNewSegment()
-		if err != nil {
-			return
+// write appends data to the active segment. A failed write may leave a part
+// of the data behind, so the segment is cut back to the last complete record.
+func (db *Db) write(data []byte) error {
+	if _, err := db.out.Write(data); err != nil {
+		if truncErr := db.out.Truncate(db.outOffset); truncErr != nil {
+			return errors.Join(err, truncErr)
 		}
+		return err
 	}
-	n, err := db.out.Write(e.Encode())
-	if err == nil {
-		db.index[e.key] = db.outOffset + int64((db.fileNumber-1)*db.segmentSize)
-		db.outOffset += int64(n)
-	}
+	return nil
 }
 
 func (db *Db) GetInt64(key string) (int64, error) {
-	db.getInt64Ch <- key
-	offset := <-db.getOffsetCh
-	if offset == -1 {
-		return 0, ErrNotFound
-	}
-	reader, file, err := db.getReaderByOffset(offset)
-	defer func(file *os.File) {
-		err := file.Close()
-		if err != nil {
-			fmt.Println(err)
-		}
-	}(file)
-	value, err := readValue(reader)
+	return db.GetInt64Context(context.Background(), key)
+}
+
+func (db *Db) GetInt64Context(ctx context.Context, key string) (int64, error) {
+	value, _, err := db.get(ctx, key)
 	if err != nil {
 		return 0, err
 	}
 	int64Value, ok := value.(int64)
 	if !ok {
-		return 0, fmt.Errorf("value does not match expected type: int64")
+		return 0, fmt.Errorf("%w: int64", ErrTypeMismatch)
 	}
 	return int64Value, nil
 }
 
 func (db *Db) PutInt64(key string, value int64) error {
+	return db.PutInt64Context(context.Background(), key, value)
+}
+
+func (db *Db) PutInt64Context(ctx context.Context, key string, value int64) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return db.putInt64(ctx, key, value)
+}
+
+func (db *Db) putInt64(ctx context.Context, key string, value int64) error {
+	if err := db.opts.checkSize(key, 8); err != nil {
+		return err
+	}
 	e := entry[int64]{
 		key:   key,
 		value: value,
 	}
-	db.putInt64Ch <- e
-	return nil
+	return db.put(ctx, db.putCh, e.key, e.Encode())
 }
 
-func (db *Db) createNewSegment() error {
-	err := db.out.Close()
+func (db *Db) Delete(key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return db.delete(key)
+}
+
+func (db *Db) delete(key string) error {
+	e := entry[tombstone]{
+		key: key,
+	}
+	return db.put(context.Background(), db.deleteCh, e.key, e.Encode())
+}
+
+func (db *Db) Scan(start, end string, fn func(key string, value any) error) error {
+	return db.scan(start, end, false, 0, fn)
+}
+
+// ScanLimit is Scan over the first limit keys of the range only, unless limit
+// is 0. The values of a scan are read before fn is called, so a page of a large
+// range is scanned with a limit rather than stopped by fn.
+func (db *Db) ScanLimit(start, end string, limit int, fn func(key string, value any) error) error {
+	return db.scan(start, end, false, limit, fn)
+}
+
+func (db *Db) scan(start, end string, buckets bool, limit int, fn func(key string, value any) error) error {
+	ctx := context.Background()
+	return db.readAll(func() ([]keyOffset, error) {
+		reply := make(chan []keyOffset, 1)
+		if err := request(ctx, db, db.scanCh, scanRequest{start: start, end: end, buckets: buckets, limit: limit, reply: reply}); err != nil {
+			return nil, err
+		}
+		return await(ctx, reply)
+	}, fn)
+}
+
+// Keys returns the keys of the range in order without reading their values. At
+// most limit keys are returned unless limit is 0.
+func (db *Db) Keys(start, end string, limit int) ([]string, error) {
+	ctx := context.Background()
+	reply := make(chan []keyOffset, 1)
+	if err := request(ctx, db, db.scanCh, scanRequest{start: start, end: end, limit: limit, reply: reply}); err != nil {
+		return nil, err
+	}
+	found, err := await(ctx, reply)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(found))
+	for i, ko := range found {
+		keys[i] = ko.key
+	}
+	return keys, nil
+}
+
+// readAll reads the values of the records found by locate and passes them to
+// fn in the order they were returned.
+func (db *Db) readAll(locate func() ([]keyOffset, error), fn func(key string, value any) error) error {
+	var keys []keyOffset
+	var values []any
+	err := db.readConsistent(func() error {
+		var err error
+		keys, err = locate()
+		return err
+	}, func() error {
+		values = make([]any, len(keys))
+		for i, ko := range keys {
+			value, err := db.readValueAt(ko.offset)
+			if err != nil {
+				return err
+			}
+			values[i] = value
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
-	db.fileNumber++
-	db.segmentNumbers = append(db.segmentNumbers, db.fileNumber)
-	db.outOffset = 0
-	db.outPath = filepath.Join(db.dir, outFileName+"-"+strconv.FormatInt(int64(db.fileNumber), 10))
-	f, err := os.OpenFile(db.outPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	for i, ko := range keys {
+		if err := fn(ko.key, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanIndex returns the keys of the range in order. Unless limit is 0, only
+// the first limit keys are kept while the index is walked, so a page of a
+// large range does not sort the whole range.
+func (db *Db) scanIndex(start, end string, buckets bool, limit int) []keyOffset {
+	var res keyOffsetHeap
+	for key, offset := range db.index {
+		if !inRange(key, start, end) || (!buckets && isBucketKey(key)) {
+			continue
+		}
+		ko := keyOffset{key: key, offset: offset}
+		switch {
+		case limit <= 0:
+			res = append(res, ko)
+		case len(res) < limit:
+			heap.Push(&res, ko)
+		case key < res[0].key:
+			res[0] = ko
+			heap.Fix(&res, 0)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].key < res[j].key
+	})
+	return res
+}
+
+// keyOffsetHeap keeps the greatest key on top, so that it is the one replaced
+// by a smaller key.
+type keyOffsetHeap []keyOffset
+
+func (h keyOffsetHeap) Len() int           { return len(h) }
+func (h keyOffsetHeap) Less(i, j int) bool { return h[i].key > h[j].key }
+func (h keyOffsetHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *keyOffsetHeap) Push(x any)        { *h = append(*h, x.(keyOffset)) }
+
+func (h *keyOffsetHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// ensureSpace starts a new segment if n more bytes do not fit into the active
+// one. The header does not count towards the size of a segment.
+func (db *Db) ensureSpace(n int) error {
+	if int64(n) > int64(db.segmentSize)-(db.outOffset-db.outHeaderSize) {
+		return db.createNewSegment()
+	}
+	return nil
+}
+
+func (db *Db) createNewSegment() error {
+	// The active segment stays in place until the new one is ready, so that
+	// a failure to create it does not leave the database without a segment.
+	fileNumber := db.fileNumber + 1
+	outPath := db.segmentPath(fileNumber)
+	out, headerSize, err := openSegment(db.fs, outPath, fileNumber)
 	if err != nil {
 		return err
 	}
-	db.out = f
-	if db.mergingSegments == nil {
+	closeErr := db.out.Close()
+	db.fileNumber = fileNumber
+	db.outPath = outPath
+	db.out = out
+	db.outHeaderSize = headerSize
+	db.outOffset = headerSize
+	if db.mergingSegments == nil && db.movingSegments == nil {
 		err = db.startMergeProcess()
 	}
-	return err
+	if err == nil {
+		err = db.startMoveProcess()
+	}
+	return errors.Join(closeErr, err)
 }
 
 func (db *Db) startMergeProcess() error {
@@ -351,35 +882,62 @@ func (db *Db) startMergeProcess() error {
 		return err
 	}
 	if segments != nil {
+		first, err := segmentNumber(segments[0])
+		if err != nil {
+			return err
+		}
+		last, err := segmentNumber(segments[len(segments)-1])
+		if err != nil {
+			return err
+		}
 		db.mergingSegments = segments
-		hashIndexCopy := db.createHashIndexCopy()
-		delete(hashIndexCopy, db.lastChangedEl)
+		db.mergeStarted = time.Now()
+		state := db.snapshot(first, last)
+		// Cold segments are not merged, so the keys they hold must stay
+		// deleted after the merge.
+		if len(db.cold) > 0 {
+			state.segments = segments
+		}
+		db.mergeWg.Add(1)
 		go func() {
-			err := db.mergeSegments(hashIndexCopy)
-			if err != nil {
-				fmt.Println(err)
+			defer db.mergeWg.Done()
+			err := db.mergeSegments(db.mergeCtx, state)
+			if err != nil && err != context.Canceled {
+				select {
+				case db.finishMergeCh <- mergeState{err: err}:
+				case <-db.mergeCtx.Done():
+				}
 			}
 		}()
 	}
 	return err
 }
 
-func (db *Db) mergeSegments(index hashIndex) error {
+func (db *Db) mergeSegments(ctx context.Context, state mergeState) (err error) {
 	db.mergeMu.Lock()
 	defer db.mergeMu.Unlock()
-	tempFileOutPath := filepath.Join(db.dir, "temp")
-	tempFile, err := os.OpenFile(tempFileOutPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	tempPath := filepath.Join(db.dir, tempFileName)
+	if err := db.fs.Remove(tempPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	tempFile, outOffset, err := openSegment(db.fs, tempPath, state.first)
 	if err != nil {
 		return err
 	}
-	outOffset := int64(0)
-	for k, offset := range index {
+	defer func() {
+		if err != nil {
+			_ = tempFile.Close()
+			_ = db.fs.Remove(tempPath)
+		}
+	}()
+	copyRecord := func(offset int64) error {
 		reader, file, err := db.getReaderByOffset(offset)
 		if err != nil {
 			return err
 		}
 		record, err := readRecord(reader)
 		if err != nil {
+			_ = file.Close()
 			return err
 		}
 		err = file.Close()
@@ -387,94 +945,201 @@ func (db *Db) mergeSegments(index hashIndex) error {
 			return err
 		}
 		n, err := tempFile.Write(record)
-		if err == nil {
-			index[k] = outOffset
-			outOffset += int64(n)
+		if err != nil {
+			return err
+		}
+		state.moved[offset] = packOffset(state.first, outOffset)
+		outOffset += int64(n)
+		return nil
+	}
+	// The tombstones dropped by the merge may hold the last version numbers
+	// given, so the merged segment starts with a tombstone of an empty key
+	// keeping the sequence from going back on the next start.
+	if state.sequence > 0 {
+		marker := withVersion((&entry[tombstone]{}).Encode(), state.sequence)
+		n, err := tempFile.Write(marker)
+		if err != nil {
+			return err
+		}
+		outOffset += int64(n)
+	}
+	// Deletions are older than every live record they could hide, so they
+	// go first.
+	for _, segment := range state.segments {
+		n, err := copyDeletions(db.fs, segment, tempFile)
+		if err != nil {
+			return err
+		}
+		outOffset += n
+	}
+	for _, offset := range state.offsets {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err = copyRecord(offset); err != nil {
+			return err
 		}
 	}
+	if err = tempFile.Sync(); err != nil {
+		return err
+	}
 	if err = tempFile.Close(); err != nil {
 		return err
 	}
-	db.finishMergeCh <- index
-	return err
+	select {
+	case db.finishMergeCh <- state:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (db *Db) finishMergingSegments(index hashIndex) error {
+// finishMergingSegments puts the merged segment in place of the segments it
+// was made of. Renaming the merged segment from temp to merged-N commits the
+// merge: a crash before that leaves the old segments as they were, and after
+// that the replacement is completed by completeMerge on the next start.
+func (db *Db) finishMergingSegments(state mergeState) error {
+	if state.err != nil {
+		// The merge is retried when the next segment is created.
+		db.mergingSegments = nil
+		return state.err
+	}
 	db.mergeMu.Lock()
 	defer db.mergeMu.Unlock()
-	db.index = index
 	defer func() {
-		db.segmentNumbers = db.getSegmentNumbers()
 		db.mergingSegments = nil
 		err := db.startMergeProcess()
+		if err == nil {
+			err = db.startMoveProcess()
+		}
 		if err != nil {
 			fmt.Println(err)
 		}
 	}()
-	for _, segment := range db.mergingSegments {
-		if err := os.Remove(segment); err != nil {
+	temp := filepath.Join(db.dir, tempFileName)
+	merged := filepath.Join(db.dir, mergedName(state.first, state.last))
+	if err := db.fs.Rename(temp, merged); err != nil {
+		_ = db.fs.Remove(temp)
+		return err
+	}
+
+	db.filesMu.Lock()
+	defer db.filesMu.Unlock()
+	if err := db.replaceSegments(merged, state.first, state.last); err != nil {
+		// The merge is committed, so the replacement is retried the same way
+		// it would be on the next start.
+		if err := db.completeMerge(); err != nil {
 			return err
 		}
 	}
-	err := db.recover()
-	if err != nil {
-		return err
+	db.generation++
+	// Records written since the merge started are in newer segments, so only
+	// the offsets of the merged records change.
+	for key, offset := range db.index {
+		if moved, ok := state.moved[offset]; ok {
+			db.index[key] = moved
+		}
 	}
-	return err
+	for _, versions := range db.history {
+		for i, v := range versions {
+			if moved, ok := state.moved[v.offset]; ok {
+				versions[i].offset = moved
+			}
+		}
+	}
+	db.merges++
+	db.mergeDuration += time.Since(db.mergeStarted)
+	return db.removeUnreferencedBlobs()
 }
 
+// getAllSegments returns the segments of both tiers ordered by number.
 func (db *Db) getAllSegments() ([]string, error) {
-	err := os.Chdir(db.dir)
+	segments, err := db.listSegments(db.dir)
+	if err != nil || db.opts.ColdDir == "" {
+		return segments, err
+	}
+	cold, err := db.listSegments(db.opts.ColdDir)
 	if err != nil {
 		return nil, err
 	}
-	segments, err := filepath.Glob(outFileName + "-*")
+	segments = append(cold, segments...)
+	sortSegments(segments)
+	return segments, nil
+}
+
+func (db *Db) listSegments(dir string) ([]string, error) {
+	segments, err := db.fs.Glob(filepath.Join(dir, outFileName+"-*"))
 	if err != nil {
 		return nil, err
 	}
-	return segments, err
+	sortSegments(segments)
+	return segments, nil
+}
+
+func sortSegments(segments []string) {
+	sort.Slice(segments, func(i, j int) bool {
+		ni, _ := segmentNumber(segments[i])
+		nj, _ := segmentNumber(segments[j])
+		return ni < nj
+	})
+}
+
+func (db *Db) segmentPath(n int) string {
+	return filepath.Join(db.dir, outFileName+"-"+strconv.Itoa(n))
 }
 
 func (db *Db) defineSegmentsToMerge() ([]string, error) {
-	segments, err := db.getAllSegments()
+	segments, err := db.listSegments(db.dir)
 	if err != nil {
 		return nil, err
 	}
-	if len(segments) <= 2 {
+	// Only sealed hot segments are merged. A failed rotation may leave an
+	// empty segment after the active one, so the active one is not always the
+	// last.
+	var sealed []string
+	for _, segment := range segments {
+		n, _ := segmentNumber(segment)
+		if _, cold := db.cold[n]; n < db.fileNumber && !cold {
+			sealed = append(sealed, segment)
+		}
+	}
+	if len(sealed) < 2 {
 		return nil, err
 	}
-	return segments[:len(segments)-1], err
+	return sealed, err
 }
 
-func (db *Db) createHashIndexCopy() hashIndex {
-	copiedIndex := make(hashIndex)
-	for key, value := range db.index {
-		copiedIndex[key] = value
-	}
-	return copiedIndex
+// mergeState lists the records a merge copies from the segments from first
+// to last, and maps their offsets to the offsets in the merged segment.
+type mergeState struct {
+	first, last int
+	offsets     []int64
+	moved       map[int64]int64
+	// sequence is the last version number given when the merge started.
+	sequence uint64
+	// segments is set if the deletions they hold have to be kept.
+	segments []string
+	// err is set instead when the merge fails.
+	err error
 }
 
-func (db *Db) getSegmentNumbers() []int {
-	files, err := db.getAllSegments()
-	if err != nil {
-		return nil
+func (db *Db) snapshot(first, last int) mergeState {
+	state := mergeState{
+		first:    first,
+		last:     last,
+		moved:    make(map[int64]int64, len(db.index)),
+		sequence: db.sequence,
 	}
-	var segmentNumbers []int
-	for _, file := range files {
-		number, err := strconv.Atoi(file[8:])
-		if err != nil {
-			return nil
+	add := func(offset int64) {
+		if fileNumber, _ := unpackOffset(offset); fileNumber >= first && fileNumber <= last {
+			state.offsets = append(state.offsets, offset)
 		}
-		segmentNumbers = append(segmentNumbers, number)
 	}
-	return segmentNumbers
-}
-
-func (db *Db) checkFileNumberExistence(number int) bool {
-	for _, v := range db.segmentNumbers {
-		if v == number {
-			return true
+	for key, offset := range db.index {
+		for _, v := range db.history[key] {
+			add(v.offset)
 		}
+		add(offset)
 	}
-	return false
+	return state
 }
@@ -1,6 +1,7 @@
 package datastore
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -18,7 +19,11 @@ func TestDb_Put(t *testing.T) {
 		time.Sleep(2 * time.Second)
 		os.RemoveAll(dir)
 	}()
-	db, err := NewDb(dir, 100)
+	recordSize := func(key, value string) int64 {
+		return int64(len(withVersion((&entry[string]{key, value}).Encode(), 1)))
+	}
+	// Three records of the pairs fill a segment.
+	db, err := NewDb(dir, int(3*recordSize("key1", "value1"))+4)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -98,11 +103,13 @@ func TestDb_Put(t *testing.T) {
 		}
 		size2 := outInfo2.Size()
 
-		if size1 != 96 {
-			t.Errorf("Unexpected size (%d vs 96)", size1)
+		expected1 := segmentHeaderSize + recordSize("key1", "value1") + recordSize("key2", "value2") + recordSize("key3", "value3")
+		if size1 != expected1 {
+			t.Errorf("Unexpected size (%d vs %d)", size1, expected1)
 		}
-		if size2 != 76 {
-			t.Errorf("Unexpected size (%d vs 76)", size2)
+		expected2 := segmentHeaderSize + recordSize("key2", "someOTHERvalue") + recordSize("newKey", "newValue")
+		if size2 != expected2 {
+			t.Errorf("Unexpected size (%d vs %d)", size2, expected2)
 		}
 
 		err = outFile1.Close()
@@ -119,7 +126,7 @@ func TestDb_Put(t *testing.T) {
 		if err := db.Close(); err != nil {
 			t.Fatal(err)
 		}
-		db, err = NewDb(dir, 100)
+		db, err = NewDb(dir, 124)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -199,7 +206,11 @@ func TestDb_Put_Int64_Values(t *testing.T) {
 		time.Sleep(2 * time.Second)
 		os.RemoveAll(dir)
 	}()
-	db, err := NewDb(dir, 100)
+	recordSize := func(key, value string) int64 {
+		return int64(len(withVersion((&entry[string]{key, value}).Encode(), 1)))
+	}
+	// Three records of the pairs fill a segment.
+	db, err := NewDb(dir, int(3*recordSize("key1", "value1"))+4)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -302,3 +313,101 @@ func TestDb_Put_Int64_Values(t *testing.T) {
 		}
 	})
 }
+
+func TestDb_Delete_Recovery(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get("key1"); err != ErrNotFound {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if value, err := db.Get("key2"); err != nil || value != "value2" {
+		t.Errorf("Bad value returned expected value2, got %s (%v)", value, err)
+	}
+}
+
+func TestDb_Close(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%10), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("Repeated close failed: %s", err)
+	}
+	if _, err := db.Get("key1"); err != ErrClosed {
+		t.Errorf("Unexpected error after close: %v", err)
+	}
+	if err := db.Put("key1", "value"); err != ErrClosed {
+		t.Errorf("Unexpected error after close: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "temp")); !os.IsNotExist(err) {
+		t.Errorf("Temporary merge file was left behind")
+	}
+
+	db, err = NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 40; i < 50; i++ {
+		value, err := db.Get(fmt.Sprintf("key%d", i%10))
+		if err != nil || value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Bad value returned for key%d: %s (%v)", i%10, value, err)
+		}
+	}
+}
+
+func TestDb_Context(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := db.PutContext(ctx, "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.GetContext(ctx, "key"); err != nil || value != "value" {
+		t.Errorf("Bad value returned: %s (%v)", value, err)
+	}
+	cancel()
+	if err := db.PutContext(ctx, "key", "other"); err != context.Canceled {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if _, err := db.GetContext(ctx, "key"); err != context.Canceled {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if value, err := db.Get("key"); err != nil || value != "value" {
+		t.Errorf("Bad value returned: %s (%v)", value, err)
+	}
+}
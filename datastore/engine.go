@@ -0,0 +1,84 @@
+package datastore
+
+type Engine interface {
+	Get(key string) (string, error)
+	GetInt64(key string) (int64, error)
+	Put(key, value string) error
+	PutInt64(key string, value int64) error
+	Delete(key string) error
+	Scan(start, end string, fn func(key string, value any) error) error
+	Stats() Stats
+	Close() error
+}
+
+type VersionedEngine interface {
+	Engine
+	GetVersion(key string, number uint64) (any, error)
+	History(key string) ([]Version, error)
+}
+
+type BatchEngine interface {
+	Engine
+	Write(b *Batch) error
+}
+
+type TransactionalEngine interface {
+	BatchEngine
+	Begin() *Tx
+	GetWithVersion(key string) (any, uint64, error)
+}
+
+type BucketEngine interface {
+	Engine
+	Bucket(name string) (*Bucket, error)
+	DropBucket(name string) error
+}
+
+type RangeDeleteEngine interface {
+	Engine
+	DeleteRange(start, end string) (int, error)
+	DeletePrefix(prefix string) (int, error)
+}
+
+type MultiGetEngine interface {
+	Engine
+	GetMany(keys []string) ([]any, error)
+}
+
+type KeyEngine interface {
+	Engine
+	Keys(start, end string, limit int) ([]string, error)
+}
+
+type ScanLimitEngine interface {
+	Engine
+	ScanLimit(start, end string, limit int, fn func(key string, value any) error) error
+}
+
+type IndexedEngine interface {
+	Engine
+	QueryIndex(name, value string, fn func(key string, value any) error) error
+}
+
+var (
+	_ MultiGetEngine      = (*Db)(nil)
+	_ MultiGetEngine      = (*MemoryDb)(nil)
+	_ IndexedEngine       = (*Db)(nil)
+	_ KeyEngine           = (*Db)(nil)
+	_ ScanLimitEngine     = (*Db)(nil)
+	_ RangeDeleteEngine   = (*Db)(nil)
+	_ RangeDeleteEngine   = (*MemoryDb)(nil)
+	_ BucketEngine        = (*Db)(nil)
+	_ VersionedEngine     = (*Bucket)(nil)
+	_ VersionedEngine     = (*Db)(nil)
+	_ TransactionalEngine = (*Db)(nil)
+	_ BatchEngine         = (*Db)(nil)
+	_ BatchEngine         = (*MemoryDb)(nil)
+	_ Engine              = (*Db)(nil)
+	_ Engine              = (*MemoryDb)(nil)
+	_ Engine              = (*LsmDb)(nil)
+)
+
+func inRange(key, start, end string) bool {
+	return key >= start && (end == "" || key < end)
+}
@@ -0,0 +1,99 @@
+package datastore
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func testEngine(t *testing.T, e Engine) {
+	t.Run("put/get", func(t *testing.T) {
+		if err := e.Put("key1", "value1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.PutInt64("key2", 42); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := e.Get("key1"); err != nil || v != "value1" {
+			t.Errorf("Bad value returned for key1: %s (%v)", v, err)
+		}
+		if v, err := e.GetInt64("key2"); err != nil || v != 42 {
+			t.Errorf("Bad value returned for key2: %d (%v)", v, err)
+		}
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		if err := e.Put("key1", "value1-new"); err != nil {
+			t.Fatal(err)
+		}
+		if v, err := e.Get("key1"); err != nil || v != "value1-new" {
+			t.Errorf("Bad value returned for key1: %s (%v)", v, err)
+		}
+	})
+
+	t.Run("incorrect type", func(t *testing.T) {
+		_, err := e.Get("key2")
+		if err == nil || err.Error() != "value does not match expected type: string" {
+			t.Errorf("Unexpected error %v", err)
+		}
+		_, err = e.GetInt64("key1")
+		if err == nil || err.Error() != "value does not match expected type: int64" {
+			t.Errorf("Unexpected error %v", err)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		if _, err := e.Get("missing"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Unexpected error %v", err)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if err := e.Put("key3", "value3"); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Delete("key3"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.Get("key3"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Unexpected error %v", err)
+		}
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		for _, key := range []string{"scan-c", "scan-a", "scan-b", "scan-d"} {
+			if err := e.Put(key, "v-"+key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var keys []string
+		err := e.Scan("scan-a", "scan-d", func(key string, value any) error {
+			if value != "v-"+key {
+				t.Errorf("Bad value returned for %s: %v", key, value)
+			}
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, []string{"scan-a", "scan-b", "scan-c"}) {
+			t.Errorf("Unexpected scan result %v", keys)
+		}
+	})
+}
+
+func TestMemoryDb(t *testing.T) {
+	db := NewMemoryDb()
+	defer db.Close()
+	testEngine(t, db)
+}
+
+func TestDb_Engine(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testEngine(t, db)
+}
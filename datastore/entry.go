@@ -2,11 +2,40 @@ package datastore
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"reflect"
 )
 
+const (
+	tombstoneType      = "datastore.tombstone"
+	blobRefType        = "datastore.blobRef"
+	batchType          = "datastore.batchRecords"
+	dropBucketType     = "datastore.dropBucket"
+	rangeTombstoneType = "datastore.rangeTombstone"
+)
+
+type tombstone struct{}
+
+// dropBucket marks the removal of every key of the bucket, whose prefix is
+// stored as the key of the record.
+type dropBucket struct{}
+
+// rangeTombstone marks the removal of every key from the key of the record up
+// to, but not including, the end key it holds. An empty end key means no upper
+// bound.
+type rangeTombstone string
+
+// blobRef is stored in place of a value that was moved to a separate blob
+// file and holds the name of that file.
+type blobRef string
+
+// batchRecords is the value of a batch group and holds the encoded records
+// of the batch one after another.
+type batchRecords []byte
+
 type entry[T any] struct {
 	key   string
 	value T
@@ -24,6 +53,12 @@ func (e *entry[T]) Encode() []byte {
 		vl = len(any(e.value).(string))
 	case int64:
 		vl = 8
+	case blobRef:
+		vl = len(any(e.value).(blobRef))
+	case rangeTombstone:
+		vl = len(any(e.value).(rangeTombstone))
+	case batchRecords:
+		vl = len(any(e.value).(batchRecords))
 	}
 
 	size := kl + tl + vl + 16
@@ -40,6 +75,12 @@ func (e *entry[T]) Encode() []byte {
 		copy(res[kl+tl+16:], any(e.value).(string))
 	case int64:
 		binary.LittleEndian.PutUint64(res[kl+tl+16:], uint64(any(e.value).(int64)))
+	case blobRef:
+		copy(res[kl+tl+16:], any(e.value).(blobRef))
+	case rangeTombstone:
+		copy(res[kl+tl+16:], any(e.value).(rangeTombstone))
+	case batchRecords:
+		copy(res[kl+tl+16:], any(e.value).(batchRecords))
 	}
 
 	return res
@@ -82,7 +123,7 @@ func readValue(in *bufio.Reader) (any, error) {
 	}
 
 	valueType := make([]byte, valTypeSize)
-	n, err := in.Read(valueType)
+	n, err := io.ReadFull(in, valueType)
 	if err != nil {
 		return "", err
 	}
@@ -102,7 +143,7 @@ func readValue(in *bufio.Reader) (any, error) {
 	}
 
 	data := make([]byte, valSize)
-	n, err = in.Read(data)
+	n, err = io.ReadFull(in, data)
 	if err != nil {
 		return "", err
 	}
@@ -110,21 +151,82 @@ func readValue(in *bufio.Reader) (any, error) {
 		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
 	}
 
-	if string(valueType) == "string" {
+	switch string(valueType) {
+	case "string":
 		return string(data), nil
+	case "int64":
+		return int64(binary.LittleEndian.Uint64(data)), nil
+	case tombstoneType:
+		return nil, ErrNotFound
+	case blobRefType:
+		return blobRef(data), nil
+	case rangeTombstoneType:
+		return rangeTombstone(data), nil
+	default:
+		return nil, fmt.Errorf("%w: unknown value type %s", ErrCorrupted, valueType)
+	}
+}
+
+// withVersion appends the version number after the value of the record.
+// Version numbers are sequence numbers taken from a single counter of the
+// database, so a key never gets a number it had before, even after it is
+// deleted. Records without one were written by earlier versions and are
+// numbered when they are read.
+func withVersion(data []byte, version uint64) []byte {
+	res := make([]byte, len(data)+8)
+	copy(res, data)
+	binary.LittleEndian.PutUint32(res, uint32(len(res)))
+	binary.LittleEndian.PutUint64(res[len(data):], version)
+	return res
+}
+
+func recordVersion(data []byte) (uint64, bool) {
+	kl := binary.LittleEndian.Uint32(data[4:])
+	tl := binary.LittleEndian.Uint32(data[kl+8:])
+	vl := binary.LittleEndian.Uint32(data[kl+tl+12:])
+	end := int(kl + tl + vl + 16)
+	if len(data) < end+8 {
+		return 0, false
 	}
+	return binary.LittleEndian.Uint64(data[end:]), true
+}
 
-	return int64(binary.LittleEndian.Uint64(data)), nil
+func recordKey(data []byte) string {
+	kl := binary.LittleEndian.Uint32(data[4:])
+	return string(data[8 : kl+8])
+}
+
+// recordValueSize returns the size of the encoded value of a record.
+func recordValueSize(data []byte) int {
+	kl := binary.LittleEndian.Uint32(data[4:])
+	tl := binary.LittleEndian.Uint32(data[kl+8:])
+	return int(binary.LittleEndian.Uint32(data[kl+12+tl:]))
+}
+
+func recordValue(data []byte) (any, error) {
+	return readValue(bufio.NewReader(bytes.NewReader(data)))
+}
+
+func recordType(data []byte) string {
+	kl := binary.LittleEndian.Uint32(data[4:])
+	tl := binary.LittleEndian.Uint32(data[kl+8:])
+	return string(data[kl+12 : kl+12+tl])
 }
 
 func readRecord(in *bufio.Reader) ([]byte, error) {
 	header, err := in.Peek(4)
+	if err == io.EOF && len(header) > 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
 	if err != nil {
 		return nil, err
 	}
 	recordSize := int(binary.LittleEndian.Uint32(header))
+	if recordSize < 16 {
+		return nil, fmt.Errorf("invalid record size %d", recordSize)
+	}
 	data := make([]byte, recordSize)
-	n, err := in.Read(data)
+	n, err := io.ReadFull(in, data)
 	if err != nil {
 		return nil, err
 	}
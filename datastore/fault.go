@@ -0,0 +1,194 @@
+package datastore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrInjected is returned by an operation that FaultFS made fail.
+var ErrInjected = fmt.Errorf("injected fault")
+
+// FaultMode is the kind of fault FaultFS injects.
+type FaultMode int
+
+const (
+	// FaultFail makes the operation fail without any effect.
+	FaultFail FaultMode = iota
+	// FaultShortWrite makes a write store only half of the data before it
+	// fails. Other operations fail without any effect.
+	FaultShortWrite
+	// FaultCrash cuts a write short like FaultShortWrite and fails every
+	// later operation, as if the process was killed.
+	FaultCrash
+)
+
+// FaultFS injects a fault into the n-th operation performed through it,
+// counting file system operations and operations on opened files alike. No
+// fault is injected if n is not positive, which is useful to count operations.
+type FaultFS struct {
+	fs   FS
+	mode FaultMode
+	n    int
+
+	mu      sync.Mutex
+	ops     int
+	crashed bool
+}
+
+// NewFaultFS wraps fs so that its n-th operation fails as mode describes.
+func NewFaultFS(fs FS, mode FaultMode, n int) *FaultFS {
+	return &FaultFS{fs: fs, mode: mode, n: n}
+}
+
+// Ops returns the number of operations performed so far.
+func (f *FaultFS) Ops() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.ops
+}
+
+// Faulted reports whether the fault has been injected.
+func (f *FaultFS) Faulted() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.n > 0 && f.ops >= f.n
+}
+
+// next counts an operation and reports whether it fails.
+func (f *FaultFS) next() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.crashed {
+		return true
+	}
+	f.ops++
+	if f.ops != f.n {
+		return false
+	}
+	if f.mode == FaultCrash {
+		f.crashed = true
+	}
+	return true
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if f.next() {
+		return nil, ErrInjected
+	}
+	file, err := f.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f}, nil
+}
+
+func (f *FaultFS) Remove(name string) error {
+	if f.next() {
+		return ErrInjected
+	}
+	return f.fs.Remove(name)
+}
+
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	if f.next() {
+		return ErrInjected
+	}
+	return f.fs.Rename(oldpath, newpath)
+}
+
+func (f *FaultFS) Glob(pattern string) ([]string, error) {
+	if f.next() {
+		return nil, ErrInjected
+	}
+	return f.fs.Glob(pattern)
+}
+
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if f.next() {
+		return nil, ErrInjected
+	}
+	return f.fs.Stat(name)
+}
+
+func (f *FaultFS) Truncate(name string, size int64) error {
+	if f.next() {
+		return ErrInjected
+	}
+	return f.fs.Truncate(name, size)
+}
+
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if f.fs.next() {
+		return 0, ErrInjected
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.fs.next() {
+		return 0, ErrInjected
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	crashed := f.fs.crashed
+	f.fs.mu.Unlock()
+	if !f.fs.next() {
+		return f.File.Write(p)
+	}
+	if crashed || f.fs.mode == FaultFail {
+		return 0, ErrInjected
+	}
+	n, err := f.File.Write(p[:len(p)/2])
+	if err != nil {
+		return n, err
+	}
+	return n, fmt.Errorf("%w: %w", ErrInjected, io.ErrShortWrite)
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	if f.fs.next() {
+		return 0, ErrInjected
+	}
+	return f.File.Seek(offset, whence)
+}
+
+func (f *faultFile) Close() error {
+	// The underlying file is closed even after a crash so that it does not
+	// leak, but the caller still sees the failure.
+	err := f.File.Close()
+	if f.fs.next() {
+		return ErrInjected
+	}
+	return err
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	if f.fs.next() {
+		return nil, ErrInjected
+	}
+	return f.File.Stat()
+}
+
+func (f *faultFile) Sync() error {
+	if f.fs.next() {
+		return ErrInjected
+	}
+	return f.File.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if f.fs.next() {
+		return ErrInjected
+	}
+	return f.File.Truncate(size)
+}
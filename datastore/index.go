@@ -0,0 +1,156 @@
+package datastore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrUnknownIndex = fmt.Errorf("unknown index")
+
+// secondaryIndex maps the values of a JSON field of documents stored as
+// string values to the keys of those documents. Only keys of the default
+// bucket are indexed.
+type secondaryIndex struct {
+	path   []string
+	keys   map[string]map[string]struct{}
+	values map[string]string
+}
+
+type queryRequest struct {
+	name, value string
+	reply       chan []keyOffset
+}
+
+func newSecondaryIndexes(indexes map[string]string) map[string]*secondaryIndex {
+	res := make(map[string]*secondaryIndex, len(indexes))
+	for name, path := range indexes {
+		res[name] = &secondaryIndex{
+			path:   strings.Split(path, "."),
+			keys:   make(map[string]map[string]struct{}),
+			values: make(map[string]string),
+		}
+	}
+	return res
+}
+
+func (idx *secondaryIndex) set(key string, doc any) {
+	idx.remove(key)
+	value, ok := fieldValue(doc, idx.path)
+	if !ok {
+		return
+	}
+	if idx.keys[value] == nil {
+		idx.keys[value] = make(map[string]struct{})
+	}
+	idx.keys[value][key] = struct{}{}
+	idx.values[key] = value
+}
+
+func (idx *secondaryIndex) remove(key string) {
+	value, ok := idx.values[key]
+	if !ok {
+		return
+	}
+	delete(idx.keys[value], key)
+	if len(idx.keys[value]) == 0 {
+		delete(idx.keys, value)
+	}
+	delete(idx.values, key)
+}
+
+// fieldValue returns the scalar at the path in a decoded JSON document in its
+// JSON text form, without quotes for strings.
+func fieldValue(doc any, path []string) (string, bool) {
+	for _, name := range path {
+		object, ok := doc.(map[string]any)
+		if !ok {
+			return "", false
+		}
+		if doc, ok = object[name]; !ok {
+			return "", false
+		}
+	}
+	switch v := doc.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
+// updateIndexes indexes the document stored by the record, if the record
+// holds one.
+func (db *Db) updateIndexes(key string, data []byte) {
+	if len(db.secondary) == 0 || isBucketKey(key) {
+		return
+	}
+	doc, ok := db.document(data)
+	for _, idx := range db.secondary {
+		if ok {
+			idx.set(key, doc)
+		} else {
+			idx.remove(key)
+		}
+	}
+}
+
+func (db *Db) removeFromIndexes(key string) {
+	for _, idx := range db.secondary {
+		idx.remove(key)
+	}
+}
+
+func (db *Db) document(data []byte) (any, bool) {
+	value, err := recordValue(data)
+	if ref, ok := value.(blobRef); ok && err == nil {
+		value, err = db.readBlob(ref)
+	}
+	s, ok := value.(string)
+	if err != nil || !ok {
+		return nil, false
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, false
+	}
+	return doc, true
+}
+
+// QueryIndex calls fn for every key whose document has the value at the path
+// of the index, in key order. Numbers and booleans are matched by their JSON
+// text.
+func (db *Db) QueryIndex(name, value string, fn func(key string, value any) error) error {
+	if _, ok := db.secondary[name]; !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownIndex, name)
+	}
+	ctx := context.Background()
+	return db.readAll(func() ([]keyOffset, error) {
+		reply := make(chan []keyOffset, 1)
+		if err := request(ctx, db, db.queryCh, queryRequest{name: name, value: value, reply: reply}); err != nil {
+			return nil, err
+		}
+		return await(ctx, reply)
+	}, fn)
+}
+
+func (db *Db) queryIndex(name, value string) []keyOffset {
+	keys := db.secondary[name].keys[value]
+	res := make([]keyOffset, 0, len(keys))
+	for key := range keys {
+		res = append(res, keyOffset{key: key, offset: db.index[key]})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].key < res[j].key
+	})
+	return res
+}
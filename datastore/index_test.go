@@ -0,0 +1,79 @@
+package datastore
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDb_QueryIndex(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{
+		SegmentSize: 1024,
+		Indexes:     map[string]string{"city": "address.city", "age": "age"},
+	}
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := map[string]string{
+		"alice": `{"age": 30, "address": {"city": "Kyiv"}}`,
+		"bob":   `{"age": 25, "address": {"city": "Lviv"}}`,
+		"carol": `{"age": 30, "address": {"city": "Kyiv"}}`,
+		"plain": `not a document`,
+	}
+	for key, doc := range docs {
+		if err := db.Put(key, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("carol", `{"age": 31, "address": {"city": "Odesa"}}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	query := func(name, value string) []string {
+		t.Helper()
+		var keys []string
+		err := db.QueryIndex(name, value, func(key string, value any) error {
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+	check := func() {
+		t.Helper()
+		if keys := query("city", "Kyiv"); !reflect.DeepEqual(keys, []string{"alice"}) {
+			t.Errorf("Unexpected keys %v", keys)
+		}
+		if keys := query("city", "Lviv"); keys != nil {
+			t.Errorf("Unexpected keys of a deleted document %v", keys)
+		}
+		if keys := query("age", "31"); !reflect.DeepEqual(keys, []string{"carol"}) {
+			t.Errorf("Unexpected keys %v", keys)
+		}
+	}
+	check()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check()
+
+	err = db.QueryIndex("missing", "value", func(string, any) error {
+		return nil
+	})
+	if !errors.Is(err, ErrUnknownIndex) {
+		t.Errorf("Expected ErrUnknownIndex, got %v", err)
+	}
+}
@@ -0,0 +1,548 @@
+package datastore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	walFileName      = "wal"
+	manifestFileName = "MANIFEST"
+	sstFilePrefix    = "sst-"
+
+	level0MaxTables = 4
+	levelSizeRatio  = 10
+)
+
+// LsmDb is a storage engine that keeps recent writes in a memtable backed by
+// a write-ahead log and flushes them to sorted immutable tables. Tables are
+// organized in levels: level 0 holds freshly flushed, possibly overlapping
+// tables, while every deeper level is a single sorted run produced by
+// compaction.
+type LsmDb struct {
+	mu           sync.RWMutex
+	fs           FS
+	dir          string
+	memtableSize int
+	memtable     map[string][]byte
+	memSize      int
+	wal          File
+	walSize      int64
+	levels       [][]*sstable
+	nextID       int
+	closed       bool
+
+	compacting         bool
+	compactWg          sync.WaitGroup
+	compactions        uint64
+	compactionDuration time.Duration
+	readLatency        *latencyRecorder
+	writeLatency       *latencyRecorder
+}
+
+type compaction struct {
+	level   int
+	inputs  []*sstable
+	targets []*sstable
+	drop    bool
+}
+
+func NewLsmDb(dir string, memtableSize int) (*LsmDb, error) {
+	return NewLsmDbWithOptions(dir, Options{SegmentSize: memtableSize})
+}
+
+// NewLsmDbWithOptions opens an LsmDb with a memtable of opts.SegmentSize bytes
+// stored on opts.FS. Other options are not supported by the engine.
+func NewLsmDbWithOptions(dir string, opts Options) (*LsmDb, error) {
+	opts = opts.withDefaults()
+	db := &LsmDb{
+		fs:           opts.FS,
+		dir:          dir,
+		memtableSize: opts.SegmentSize,
+		memtable:     make(map[string][]byte),
+		levels:       make([][]*sstable, 1),
+		nextID:       1,
+		readLatency:  newLatencyRecorder(),
+		writeLatency: newLatencyRecorder(),
+	}
+	if err := db.loadManifest(); err != nil {
+		return nil, err
+	}
+	size, err := db.replayWal()
+	if err != nil {
+		return nil, err
+	}
+	wal, err := db.fs.OpenFile(filepath.Join(dir, walFileName), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	// A torn record is cut off, or the records appended after it would be
+	// lost on the next replay.
+	if err := wal.Truncate(size); err != nil {
+		_ = wal.Close()
+		return nil, err
+	}
+	db.wal = wal
+	db.walSize = size
+	db.maybeCompact()
+	return db, nil
+}
+
+func (db *LsmDb) loadManifest() error {
+	live := make(map[string]bool)
+	data, err := readFile(db.fs, filepath.Join(db.dir, manifestFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		var level, id int
+		if _, err := fmt.Sscanf(line, "%d %d", &level, &id); err != nil {
+			return fmt.Errorf("corrupted manifest: %w", err)
+		}
+		t, err := openSSTable(db.fs, db.tablePath(id), id)
+		if err != nil {
+			return err
+		}
+		for len(db.levels) <= level {
+			db.levels = append(db.levels, nil)
+		}
+		db.levels[level] = append(db.levels[level], t)
+		live[filepath.Base(t.path)] = true
+		if id >= db.nextID {
+			db.nextID = id + 1
+		}
+	}
+
+	files, err := db.fs.Glob(filepath.Join(db.dir, sstFilePrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !live[filepath.Base(file)] {
+			if err := db.fs.Remove(file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (db *LsmDb) writeManifest() error {
+	var sb strings.Builder
+	for level, tables := range db.levels {
+		for _, t := range tables {
+			fmt.Fprintf(&sb, "%d %d\n", level, t.id)
+		}
+	}
+	path := filepath.Join(db.dir, manifestFileName)
+	f, err := db.fs.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, sb.String()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return db.fs.Rename(path+".tmp", path)
+}
+
+// replayWal loads the log into the memtable and returns the size of the
+// complete records in it.
+func (db *LsmDb) replayWal() (int64, error) {
+	f, err := openRead(db.fs, filepath.Join(db.dir, walFileName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	in := bufio.NewReaderSize(f, bufSize)
+	var size int64
+	for {
+		record, err := readRecord(in)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// A record torn by a crash was never acknowledged, so it is dropped.
+			return size, nil
+		} else if err != nil {
+			return 0, err
+		}
+		db.memtable[recordKey(record)] = record
+		db.memSize += len(record)
+		size += int64(len(record))
+	}
+}
+
+func (db *LsmDb) tablePath(id int) string {
+	return filepath.Join(db.dir, sstFilePrefix+strconv.Itoa(id))
+}
+
+func (db *LsmDb) Get(key string) (string, error) {
+	value, err := db.get(key)
+	if err != nil {
+		return "", err
+	}
+	stringValue, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%w: string", ErrTypeMismatch)
+	}
+	return stringValue, nil
+}
+
+func (db *LsmDb) GetInt64(key string) (int64, error) {
+	value, err := db.get(key)
+	if err != nil {
+		return 0, err
+	}
+	int64Value, ok := value.(int64)
+	if !ok {
+		return 0, fmt.Errorf("%w: int64", ErrTypeMismatch)
+	}
+	return int64Value, nil
+}
+
+func (db *LsmDb) get(key string) (any, error) {
+	defer db.observeRead(time.Now())
+	record, err := db.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	return recordValue(record)
+}
+
+func (db *LsmDb) lookup(key string) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	if record, ok := db.memtable[key]; ok {
+		return record, nil
+	}
+	for _, tables := range db.levels {
+		for _, t := range tables {
+			record, err := t.get(key)
+			if err == nil {
+				return record, nil
+			} else if err != ErrNotFound {
+				return nil, err
+			}
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (db *LsmDb) Put(key, value string) error {
+	e := entry[string]{
+		key:   key,
+		value: value,
+	}
+	return db.write(key, e.Encode())
+}
+
+func (db *LsmDb) PutInt64(key string, value int64) error {
+	e := entry[int64]{
+		key:   key,
+		value: value,
+	}
+	return db.write(key, e.Encode())
+}
+
+func (db *LsmDb) Delete(key string) error {
+	e := entry[tombstone]{
+		key: key,
+	}
+	return db.write(key, e.Encode())
+}
+
+func (db *LsmDb) write(key string, record []byte) error {
+	defer db.observeWrite(time.Now())
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if _, err := db.wal.Write(record); err != nil {
+		// A part of the record may have been written.
+		if truncErr := db.wal.Truncate(db.walSize); truncErr != nil {
+			return errors.Join(err, truncErr)
+		}
+		return err
+	}
+	db.walSize += int64(len(record))
+	if old, ok := db.memtable[key]; ok {
+		db.memSize -= len(old)
+	}
+	db.memtable[key] = record
+	db.memSize += len(record)
+	if db.memSize < db.memtableSize {
+		return nil
+	}
+	// The record is already durable in the log, so a failed flush does not
+	// fail the write. The memtable is kept and the flush is retried on the
+	// next write.
+	if err := db.flush(); err != nil {
+		fmt.Println(err)
+		return nil
+	}
+	db.maybeCompact()
+	return nil
+}
+
+func (db *LsmDb) flush() error {
+	id := db.nextID
+	db.nextID++
+	t, err := writeSSTable(db.fs, db.tablePath(id), id, newMemIterator(db.memtable, "", ""), false)
+	if err != nil {
+		return err
+	}
+	if t != nil {
+		db.levels[0] = append([]*sstable{t}, db.levels[0]...)
+		if err := db.writeManifest(); err != nil {
+			return err
+		}
+	}
+	db.memtable = make(map[string][]byte)
+	db.memSize = 0
+	// If the log cannot be emptied, writes go on to the old one. Its records
+	// are replayed in order, so they still recover the same state.
+	wal, err := db.fs.OpenFile(filepath.Join(db.dir, walFileName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	old := db.wal
+	db.wal, db.walSize = wal, 0
+	return old.Close()
+}
+
+func (db *LsmDb) maybeCompact() {
+	if db.compacting || db.pickCompaction() == nil {
+		return
+	}
+	db.compacting = true
+	db.compactWg.Add(1)
+	go db.compactLoop()
+}
+
+// pickCompaction chooses the shallowest level that exceeds its limit. Level 0
+// is limited by the number of tables, deeper levels by their total size.
+func (db *LsmDb) pickCompaction() *compaction {
+	if db.closed {
+		return nil
+	}
+	limit := int64(db.memtableSize) * levelSizeRatio
+	for level, tables := range db.levels {
+		var over bool
+		if level == 0 {
+			over = len(tables) > level0MaxTables
+		} else {
+			var size int64
+			for _, t := range tables {
+				size += t.size
+			}
+			over = size > limit
+			limit *= levelSizeRatio
+		}
+		if !over {
+			continue
+		}
+		c := &compaction{level: level, inputs: append([]*sstable(nil), tables...), drop: true}
+		if level+1 < len(db.levels) {
+			c.targets = append(c.targets, db.levels[level+1]...)
+			for _, deeper := range db.levels[level+2:] {
+				if len(deeper) > 0 {
+					c.drop = false
+				}
+			}
+		}
+		return c
+	}
+	return nil
+}
+
+func (db *LsmDb) compactLoop() {
+	defer db.compactWg.Done()
+	for {
+		db.mu.Lock()
+		c := db.pickCompaction()
+		if c == nil {
+			db.compacting = false
+			db.mu.Unlock()
+			return
+		}
+		id := db.nextID
+		db.nextID++
+		db.mu.Unlock()
+
+		start := time.Now()
+		t, err := db.runCompaction(c, id)
+		if err == nil {
+			err = db.installCompaction(c, t, time.Since(start))
+		}
+		if err != nil {
+			fmt.Println(err)
+			db.mu.Lock()
+			db.compacting = false
+			db.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (db *LsmDb) runCompaction(c *compaction, id int) (*sstable, error) {
+	var sources []recordIterator
+	for _, t := range append(append([]*sstable(nil), c.inputs...), c.targets...) {
+		it, err := t.iterator("", "")
+		if err != nil {
+			_ = newMergeIterator(sources).close()
+			return nil, err
+		}
+		sources = append(sources, it)
+	}
+	it := newMergeIterator(sources)
+	defer it.close()
+	return writeSSTable(db.fs, db.tablePath(id), id, it, c.drop)
+}
+
+func (db *LsmDb) installCompaction(c *compaction, t *sstable, duration time.Duration) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	compacted := make(map[*sstable]bool)
+	for _, input := range c.inputs {
+		compacted[input] = true
+	}
+	var remaining []*sstable
+	for _, table := range db.levels[c.level] {
+		if !compacted[table] {
+			remaining = append(remaining, table)
+		}
+	}
+	db.levels[c.level] = remaining
+	if c.level+1 == len(db.levels) {
+		db.levels = append(db.levels, nil)
+	}
+	db.levels[c.level+1] = nil
+	if t != nil {
+		db.levels[c.level+1] = []*sstable{t}
+	}
+	if err := db.writeManifest(); err != nil {
+		return err
+	}
+	db.compactions++
+	db.compactionDuration += duration
+	for _, table := range append(c.inputs, c.targets...) {
+		if err := db.fs.Remove(table.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *LsmDb) Scan(start, end string, fn func(key string, value any) error) error {
+	it, err := db.iterator(start, end)
+	if err != nil {
+		return err
+	}
+	defer it.close()
+	for it.next() {
+		if recordType(it.record()) == tombstoneType {
+			continue
+		}
+		value, err := recordValue(it.record())
+		if err != nil {
+			return err
+		}
+		if err := fn(it.key(), value); err != nil {
+			return err
+		}
+	}
+	return it.err()
+}
+
+// iterator takes a consistent snapshot of the memtable and open table files,
+// so that the caller may iterate without holding the lock.
+func (db *LsmDb) iterator(start, end string) (*mergeIterator, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	sources := []recordIterator{newMemIterator(db.memtable, start, end)}
+	for _, tables := range db.levels {
+		for _, t := range tables {
+			if len(t.index) == 0 || t.lastKey < start || (end != "" && t.index[0].key >= end) {
+				continue
+			}
+			it, err := t.iterator(start, end)
+			if err != nil {
+				_ = newMergeIterator(sources).close()
+				return nil, err
+			}
+			sources = append(sources, it)
+		}
+	}
+	return newMergeIterator(sources), nil
+}
+
+// Stats reports the number of records stored in the memtable and tables as
+// Keys, which counts a key once per table it is present in.
+func (db *LsmDb) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	s := Stats{
+		Keys:          len(db.memtable),
+		Merges:        db.compactions,
+		MergeDuration: db.compactionDuration,
+		Reads:         db.readLatency.snapshot(),
+		Writes:        db.writeLatency.snapshot(),
+	}
+	for _, tables := range db.levels {
+		for _, t := range tables {
+			s.Keys += t.records
+			s.Segments++
+			s.SegmentBytes += t.size
+		}
+	}
+	return s
+}
+
+func (db *LsmDb) observeRead(start time.Time) {
+	db.readLatency.observe(time.Since(start))
+}
+
+func (db *LsmDb) observeWrite(start time.Time) {
+	db.writeLatency.observe(time.Since(start))
+}
+
+func (db *LsmDb) Close() error {
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil
+	}
+	db.closed = true
+	db.mu.Unlock()
+	db.compactWg.Wait()
+
+	if err := db.wal.Sync(); err != nil {
+		return err
+	}
+	return db.wal.Close()
+}
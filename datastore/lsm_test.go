@@ -0,0 +1,298 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestLsmDb_Engine(t *testing.T) {
+	db, err := NewLsmDb(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testEngine(t, db)
+}
+
+func TestLsmDb_Recovery(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewLsmDb(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	model := make(map[string]string)
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key-%03d", i%120)
+		value := fmt.Sprintf("value-%d", i)
+		if i%7 == 0 {
+			if err := db.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			delete(model, key)
+			continue
+		}
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		model[key] = value
+	}
+	if db.Stats().Merges == 0 {
+		t.Errorf("Expected at least one compaction")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key-001"); err != ErrClosed {
+		t.Errorf("Unexpected error after close: %v", err)
+	}
+
+	db, err = NewLsmDb(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 120; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		value, err := db.Get(key)
+		expected, ok := model[key]
+		if !ok {
+			if err != ErrNotFound {
+				t.Errorf("Expected %s to be deleted, got %s (%v)", key, value, err)
+			}
+			continue
+		}
+		if err != nil || value != expected {
+			t.Errorf("Bad value returned for %s: expected %s, got %s (%v)", key, expected, value, err)
+		}
+	}
+
+	var expectedKeys, keys []string
+	for key := range model {
+		if key >= "key-050" && key < "key-100" {
+			expectedKeys = append(expectedKeys, key)
+		}
+	}
+	sort.Strings(expectedKeys)
+	err = db.Scan("key-050", "key-100", func(key string, value any) error {
+		if value != model[key] {
+			t.Errorf("Bad value scanned for %s: %v", key, value)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, expectedKeys) {
+		t.Errorf("Unexpected scan result %v", keys)
+	}
+}
+
+func TestLsmDb_Put(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewLsmDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	pairs := [][]string{
+		{"key1", "value1"},
+		{"key2", "value2"},
+		{"key3", "value3"},
+	}
+
+	t.Run("put/get", func(t *testing.T) {
+		for _, pair := range pairs {
+			if err := db.Put(pair[0], pair[1]); err != nil {
+				t.Errorf("Cannot put %s: %s", pair[0], err)
+			}
+			value, err := db.Get(pair[0])
+			if err != nil {
+				t.Errorf("Cannot get %s: %s", pair[0], err)
+			}
+			if value != pair[1] {
+				t.Errorf("Bad value returned expected %s, got %s", pair[1], value)
+			}
+		}
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		// The memtable is flushed in between, so the new value shadows the
+		// one in a sorted table.
+		for i := 0; i < 10; i++ {
+			if err := db.Put(fmt.Sprintf("filler%d", i), "filler"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Put("key2", "someOTHERvalue"); err != nil {
+			t.Errorf("Cannot put key2: %s", err)
+		}
+		if value, err := db.Get("key2"); err != nil || value != "someOTHERvalue" {
+			t.Errorf("Bad value returned expected someOTHERvalue, got %s (%v)", value, err)
+		}
+	})
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewLsmDb(dir, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, err := db.Get("key1"); err != nil || value != "value1" {
+			t.Errorf("Bad value returned expected value1, got %s (%v)", value, err)
+		}
+		if value, err := db.Get("key2"); err != nil || value != "someOTHERvalue" {
+			t.Errorf("Bad value returned expected someOTHERvalue, got %s (%v)", value, err)
+		}
+	})
+
+	t.Run("incorrect type", func(t *testing.T) {
+		if err := db.PutInt64("keyI", 42); err != nil {
+			t.Errorf("Cannot put keyI: %s", err)
+		}
+		_, err := db.Get("keyI")
+		if err == nil || err.Error() != "value does not match expected type: string" {
+			t.Errorf("Unexpected error %v", err)
+		}
+	})
+}
+
+func TestLsmDb_Put_Int64_Values(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewLsmDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+	pairs := map[string]int64{"key1": 42, "key2": 1984, "key3": -2077}
+
+	t.Run("put/get", func(t *testing.T) {
+		for key, expected := range pairs {
+			if err := db.PutInt64(key, expected); err != nil {
+				t.Errorf("Cannot put %s: %s", key, err)
+			}
+			if value, err := db.GetInt64(key); err != nil || value != expected {
+				t.Errorf("Bad value returned expected %d, got %d (%v)", expected, value, err)
+			}
+		}
+	})
+
+	t.Run("new db process", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewLsmDb(dir, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, expected := range pairs {
+			if value, err := db.GetInt64(key); err != nil || value != expected {
+				t.Errorf("Bad value returned expected %d, got %d (%v)", expected, value, err)
+			}
+		}
+	})
+
+	t.Run("incorrect type", func(t *testing.T) {
+		if err := db.Put("keyS", "value"); err != nil {
+			t.Errorf("Cannot put keyS: %s", err)
+		}
+		_, err := db.GetInt64("keyS")
+		if err == nil || err.Error() != "value does not match expected type: int64" {
+			t.Errorf("Unexpected error %v", err)
+		}
+	})
+}
+
+func TestLsmDb_Delete_Recovery(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewLsmDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key2", "value2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key1"); err != ErrNotFound {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewLsmDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get("key1"); err != ErrNotFound {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if value, err := db.Get("key2"); err != nil || value != "value2" {
+		t.Errorf("Bad value returned expected value2, got %s (%v)", value, err)
+	}
+}
+
+func TestLsmDb_TornWal(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewLsmDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A crash in the middle of a write leaves a torn record at the end.
+	record := (&entry[string]{"key2", "value2"}).Encode()
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wal.Write(record[:len(record)/2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewLsmDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key3", "value3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewLsmDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for key, expected := range map[string]string{"key1": "value1", "key3": "value3"} {
+		if value, err := db.Get(key); err != nil || value != expected {
+			t.Errorf("Bad value returned for %s: expected %s, got %s (%v)", key, expected, value, err)
+		}
+	}
+	if _, err := db.Get("key2"); err != ErrNotFound {
+		t.Errorf("Expected the torn record to be dropped, got %v", err)
+	}
+}
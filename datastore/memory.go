@@ -0,0 +1,135 @@
+package datastore
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+type MemoryDb struct {
+	mu   sync.RWMutex
+	data map[string]any
+}
+
+func NewMemoryDb() *MemoryDb {
+	return &MemoryDb{data: make(map[string]any)}
+}
+
+func (db *MemoryDb) get(key string) (any, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	value, ok := db.data[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+func (db *MemoryDb) Get(key string) (string, error) {
+	value, err := db.get(key)
+	if err != nil {
+		return "", err
+	}
+	stringValue, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%w: string", ErrTypeMismatch)
+	}
+	return stringValue, nil
+}
+
+func (db *MemoryDb) GetInt64(key string) (int64, error) {
+	value, err := db.get(key)
+	if err != nil {
+		return 0, err
+	}
+	int64Value, ok := value.(int64)
+	if !ok {
+		return 0, fmt.Errorf("%w: int64", ErrTypeMismatch)
+	}
+	return int64Value, nil
+}
+
+func (db *MemoryDb) put(key string, value any) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.data[key] = value
+	return nil
+}
+
+func (db *MemoryDb) Put(key, value string) error {
+	return db.put(key, value)
+}
+
+func (db *MemoryDb) PutInt64(key string, value int64) error {
+	return db.put(key, value)
+}
+
+func (db *MemoryDb) Delete(key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.data, key)
+	return nil
+}
+
+func (db *MemoryDb) DeleteRange(start, end string) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	deleted := 0
+	for key := range db.data {
+		if inRange(key, start, end) {
+			delete(db.data, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (db *MemoryDb) DeletePrefix(prefix string) (int, error) {
+	return db.DeleteRange(prefix, prefixEnd(prefix))
+}
+
+func (db *MemoryDb) Write(b *Batch) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, op := range b.ops {
+		if _, ok := op.value.(tombstone); ok {
+			delete(db.data, op.key)
+		} else {
+			db.data[op.key] = op.value
+		}
+	}
+	return nil
+}
+
+func (db *MemoryDb) Scan(start, end string, fn func(key string, value any) error) error {
+	db.mu.RLock()
+	keys := make([]string, 0, len(db.data))
+	for key := range db.data {
+		if inRange(key, start, end) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	values := make([]any, len(keys))
+	for i, key := range keys {
+		values[i] = db.data[key]
+	}
+	db.mu.RUnlock()
+
+	for i, key := range keys {
+		if err := fn(key, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *MemoryDb) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return Stats{Keys: len(db.data)}
+}
+
+func (db *MemoryDb) Close() error {
+	return nil
+}
@@ -0,0 +1,66 @@
+package datastore
+
+import (
+	"context"
+	"time"
+)
+
+type getManyRequest struct {
+	keys  []string
+	reply chan []location
+}
+
+// GetMany returns the values of the keys in the order of the keys, with nil
+// for the keys that have no value. All the keys are located with a single
+// request to the monitor, so the values are read from one state of the
+// database.
+func (db *Db) GetMany(keys []string) ([]any, error) {
+	defer db.observeRead(time.Now())
+	ctx := context.Background()
+	var locs []location
+	var values []any
+	err := db.readConsistent(func() error {
+		reply := make(chan []location, 1)
+		if err := request(ctx, db, db.getManyCh, getManyRequest{keys: keys, reply: reply}); err != nil {
+			return err
+		}
+		var err error
+		locs, err = await(ctx, reply)
+		return err
+	}, func() error {
+		values = make([]any, len(locs))
+		for i, loc := range locs {
+			if loc.offset == -1 {
+				continue
+			}
+			value, err := db.readValueAt(loc.offset)
+			if err != nil {
+				return err
+			}
+			values[i] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func (db *Db) locateMany(keys []string) []location {
+	res := make([]location, len(keys))
+	for i, key := range keys {
+		res[i] = db.locate(key)
+	}
+	return res
+}
+
+func (db *MemoryDb) GetMany(keys []string) ([]any, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	values := make([]any, len(keys))
+	for i, key := range keys {
+		values[i] = db.data[key]
+	}
+	return values, nil
+}
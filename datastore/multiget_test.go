@@ -0,0 +1,58 @@
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func testGetMany(t *testing.T, db MultiGetEngine) {
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutInt64("key2", 42); err != nil {
+		t.Fatal(err)
+	}
+	values, err := db.GetMany([]string{"key2", "missing", "key1", "key2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []any{int64(42), nil, "value1", int64(42)}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("Expected %v, got %v", expected, values)
+	}
+	if values, err := db.GetMany(nil); err != nil || len(values) != 0 {
+		t.Errorf("Expected no values, got %v (%v)", values, err)
+	}
+}
+
+func TestDb_GetMany(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testGetMany(t, db)
+
+	// Values spread over several segments are read in one call.
+	keys := make([]string, 50)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%02d", i)
+		if err := db.Put(keys[i], fmt.Sprintf("value%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	values, err := db.GetMany(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, value := range values {
+		if expected := fmt.Sprintf("value%02d", i); value != expected {
+			t.Errorf("Expected %s, got %v", expected, value)
+		}
+	}
+}
+
+func TestMemoryDb_GetMany(t *testing.T) {
+	testGetMany(t, NewMemoryDb())
+}
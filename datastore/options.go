@@ -0,0 +1,75 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultMaxKeySize   = 4 * 1024
+	DefaultMaxValueSize = 64 * 1024 * 1024
+)
+
+var (
+	ErrKeyTooLarge   = fmt.Errorf("key is too large")
+	ErrValueTooLarge = fmt.Errorf("value is too large")
+)
+
+type Options struct {
+	SegmentSize  int
+	MaxKeySize   int
+	MaxValueSize int
+	// Versions is the number of versions retained per key, including the
+	// current one. Values below 2 keep only the current version.
+	Versions int
+	// Indexes declares secondary indexes on JSON documents stored as string
+	// values, mapping the index name to a dot-separated path of the field.
+	Indexes map[string]string
+	// MaxKeys and MaxBytes turn the database into a cache holding at most
+	// MaxKeys keys and MaxBytes bytes of live records, including the values
+	// they keep in blobs. Keys chosen by Eviction are deleted to make room
+	// for new ones, so writes never fail because the cache is full. Zero
+	// means no limit.
+	MaxKeys  int
+	MaxBytes int64
+	// Eviction defaults to EvictLRU.
+	Eviction EvictionPolicy
+	// DedupThreshold enables deduplication of values of at least this many
+	// bytes. Such values are stored once in a blob named after the hash of
+	// their content and records refer to the blob. Zero disables it.
+	DedupThreshold int
+	// ColdDir is a secondary directory, usually on cheaper storage, where
+	// sealed segments last written more than ColdAge ago are moved. Cold
+	// segments are read as usual but are no longer merged. Empty disables it.
+	ColdDir string
+	ColdAge time.Duration
+	// CompressCold compresses each cold segment as a whole. Reading a record
+	// from a compressed segment decompresses the entire segment, and the last
+	// few decompressed segments are kept in memory.
+	CompressCold bool
+	// FS is the file system the database is stored on. It defaults to OSFS.
+	FS FS
+}
+
+func (o Options) withDefaults() Options {
+	if o.MaxKeySize <= 0 {
+		o.MaxKeySize = DefaultMaxKeySize
+	}
+	if o.MaxValueSize <= 0 {
+		o.MaxValueSize = DefaultMaxValueSize
+	}
+	if o.FS == nil {
+		o.FS = OSFS
+	}
+	return o
+}
+
+func (o Options) checkSize(key string, valueSize int) error {
+	if len(key) > o.MaxKeySize {
+		return fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes", ErrKeyTooLarge, len(key), o.MaxKeySize)
+	}
+	if valueSize > o.MaxValueSize {
+		return fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes", ErrValueTooLarge, valueSize, o.MaxValueSize)
+	}
+	return nil
+}
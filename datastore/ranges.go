@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"context"
+	"encoding/binary"
+)
+
+type deleteRangeRequest struct {
+	start, end string
+	reply      chan deleteRangeResult
+}
+
+type deleteRangeResult struct {
+	deleted int
+	err     error
+}
+
+// DeleteRange removes every key from start up to, but not including, end and
+// returns the number of keys removed. An empty end removes every key from
+// start on. Keys of named buckets are not affected, the same way they are
+// not returned by Scan. The removal is stored as a single record, and the
+// space is reclaimed by the next merge of the segments holding the keys.
+func (db *Db) DeleteRange(start, end string) (int, error) {
+	ctx := context.Background()
+	reply := make(chan deleteRangeResult, 1)
+	if err := request(ctx, db, db.deleteRangeCh, deleteRangeRequest{start: start, end: end, reply: reply}); err != nil {
+		return 0, err
+	}
+	res, err := await(ctx, reply)
+	if err != nil {
+		return 0, err
+	}
+	return res.deleted, res.err
+}
+
+// DeletePrefix removes every key starting with prefix and returns the number
+// of keys removed.
+func (db *Db) DeletePrefix(prefix string) (int, error) {
+	return db.DeleteRange(prefix, prefixEnd(prefix))
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or an empty key if there is no such key.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// deleteRange writes a range tombstone if any key falls into the range.
+func (db *Db) deleteRange(start, end string) deleteRangeResult {
+	deleted := len(db.scanIndex(start, end, false, 0))
+	if deleted == 0 {
+		return deleteRangeResult{}
+	}
+	e := entry[rangeTombstone]{
+		key:   start,
+		value: rangeTombstone(end),
+	}
+	if err := db.writeRecord(start, e.Encode()); err != nil {
+		return deleteRangeResult{err: err}
+	}
+	return deleteRangeResult{deleted: deleted}
+}
+
+func (db *Db) forgetRange(start, end string) {
+	for key := range db.index {
+		if inRange(key, start, end) && !isBucketKey(key) {
+			db.forget(key)
+		}
+	}
+}
+
+// recordRangeEnd returns the end key held by a range tombstone record.
+func recordRangeEnd(data []byte) string {
+	kl := binary.LittleEndian.Uint32(data[4:])
+	tl := binary.LittleEndian.Uint32(data[kl+8:])
+	vl := binary.LittleEndian.Uint32(data[kl+tl+12:])
+	return string(data[kl+tl+16 : kl+tl+16+vl])
+}
@@ -0,0 +1,258 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDb_DeletePrefix(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"tenant1/a", "tenant1/b", "tenant10/a", "tenant2/a"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users, err := db.Bucket("tenant1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Put("a", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := db.DeletePrefix("tenant1/")
+	if err != nil || deleted != 2 {
+		t.Fatalf("Expected 2 deleted keys, got %d (%v)", deleted, err)
+	}
+	// A key written after the deletion is not affected by it.
+	if err := db.Put("tenant1/c", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		for key, exists := range map[string]bool{
+			"tenant1/a": false, "tenant1/b": false, "tenant1/c": true, "tenant10/a": true, "tenant2/a": true,
+		} {
+			_, err := db.Get(key)
+			if !exists && !errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected %s to be deleted, got %v", key, err)
+			}
+			if exists && err != nil {
+				t.Errorf("Unexpected error for %s: %v", key, err)
+			}
+		}
+		if _, err := users.Get("a"); err != nil {
+			t.Errorf("Expected the bucket key to remain, got %v", err)
+		}
+	}
+	check()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	users, _ = db.Bucket("tenant1")
+	check()
+
+	// Nothing is written when no key matches.
+	before := db.Stats().SegmentBytes
+	if deleted, err := db.DeletePrefix("missing/"); err != nil || deleted != 0 {
+		t.Errorf("Expected no deleted keys, got %d (%v)", deleted, err)
+	}
+	if after := db.Stats().SegmentBytes; after != before {
+		t.Errorf("Segments grew from %d to %d bytes", before, after)
+	}
+}
+
+func TestDb_DeleteRange(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if deleted, err := db.DeleteRange("key3", "key7"); err != nil || deleted != 4 {
+		t.Fatalf("Expected 4 deleted keys, got %d (%v)", deleted, err)
+	}
+	if deleted, err := db.DeleteRange("key8", ""); err != nil || deleted != 2 {
+		t.Fatalf("Expected 2 deleted keys, got %d (%v)", deleted, err)
+	}
+	var keys []string
+	err = db.Scan("", "", func(key string, value any) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys) != "[key0 key1 key2 key7]" {
+		t.Errorf("Unexpected keys left: %v", keys)
+	}
+}
+
+func TestDb_DeletePrefix_Merge(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("tenant/%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.DeletePrefix("tenant/"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Once every sealed segment is merged, neither the deleted records nor
+	// the range tombstone are left.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if segments, _ := db.getAllSegments(); len(segments) <= 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, outFileName+"-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("tenant/")) {
+		t.Error("The merged segment still holds deleted records")
+	}
+
+	db, err = NewDb(dir, 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if s := db.Stats(); s.Keys != 20 {
+		t.Errorf("Expected 20 keys, got %d", s.Keys)
+	}
+}
+
+func TestDb_Keys(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"d", "b", "a", "c"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users, err := db.Bucket("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Put("a", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys, err := db.Keys("", "", 0); err != nil || !reflect.DeepEqual(keys, []string{"a", "b", "c", "d"}) {
+		t.Errorf("Unexpected keys %v (%v)", keys, err)
+	}
+	if keys, err := db.Keys("b", "", 2); err != nil || !reflect.DeepEqual(keys, []string{"b", "c"}) {
+		t.Errorf("Unexpected keys %v (%v)", keys, err)
+	}
+	if keys, err := db.Keys("b", "d", 0); err != nil || !reflect.DeepEqual(keys, []string{"b", "c"}) {
+		t.Errorf("Unexpected keys %v (%v)", keys, err)
+	}
+	if keys, err := db.Keys("", "", 10); err != nil || !reflect.DeepEqual(keys, []string{"a", "b", "c", "d"}) {
+		t.Errorf("Unexpected keys %v (%v)", keys, err)
+	}
+}
+
+func TestDb_Keys_Limit(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var expected []string
+	for i := 99; i >= 0; i-- {
+		key := fmt.Sprintf("key%02d", i)
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+		if i >= 40 && i < 47 {
+			expected = append([]string{key}, expected...)
+		}
+	}
+	if keys, err := db.Keys("key40", "", 7); err != nil || !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Unexpected keys %v (%v)", keys, err)
+	}
+}
+
+func TestDb_ScanLimit(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key%02d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var keys []string
+	err = db.ScanLimit("key05", "key08", 5, func(key string, value any) error {
+		keys = append(keys, fmt.Sprintf("%s=%v", key, value))
+		return nil
+	})
+	if expected := []string{"key05=value5", "key06=value6", "key07=value7"}; err != nil || !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Unexpected keys %v (%v)", keys, err)
+	}
+	keys = nil
+	err = db.ScanLimit("key10", "", 3, func(key string, value any) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if expected := []string{"key10", "key11", "key12"}; err != nil || !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Unexpected keys %v (%v)", keys, err)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for prefix, expected := range map[string]string{
+		"":            "",
+		"a":           "b",
+		"tenant1/":    "tenant10",
+		"a\xff":       "b",
+		"\xff\xff":    "",
+		"key\x00\xff": "key\x01",
+	} {
+		if got := prefixEnd(prefix); got != expected {
+			t.Errorf("%q: expected %q, got %q", prefix, expected, got)
+		}
+	}
+}
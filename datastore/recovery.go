@@ -0,0 +1,174 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+
+	"github.com/kushnirko/kpi-apz-lab-5/logger"
+)
+
+const recoveryLogInterval = time.Second
+
+// scannedSegment is a segment read into memory and checked for complete
+// records. Segments are scanned concurrently, while their records are
+// applied one segment at a time in order so that newer records win.
+type scannedSegment struct {
+	path       string
+	number     int
+	data       []byte
+	headerSize int64
+	// end is the position after the last complete record.
+	end int64
+	// torn is set if the segment ends with a header or a record cut short.
+	torn bool
+	err  error
+}
+
+// loadSegments rebuilds the in-memory state from the segments and opens the
+// last one for writing.
+func (db *Db) loadSegments(segments []string) error {
+	started := time.Now()
+	lastLog := started
+
+	// At most workers segments are held in memory at once: a worker takes a
+	// token before reading a segment and the token is returned when the
+	// segment has been applied.
+	workers := runtime.GOMAXPROCS(0)
+	tokens := make(chan struct{}, workers)
+	stop := make(chan struct{})
+	defer close(stop)
+	results := make([]chan *scannedSegment, len(segments))
+	for i := range results {
+		results[i] = make(chan *scannedSegment, 1)
+	}
+	go func() {
+		for i, segment := range segments {
+			select {
+			case tokens <- struct{}{}:
+			case <-stop:
+				return
+			}
+			go func(i int, segment string) {
+				results[i] <- db.scanSegment(segment)
+			}(i, segment)
+		}
+	}()
+
+	for i := range segments {
+		s := <-results[i]
+		err := db.loadSegment(s, i == len(segments)-1)
+		<-tokens
+		if err != nil {
+			return err
+		}
+		if time.Since(lastLog) >= recoveryLogInterval {
+			lastLog = time.Now()
+			logger.Printf("recovery: %d/%d segments, %d keys", i+1, len(segments), len(db.index))
+		}
+	}
+	logger.Printf("recovered %d segments, %d keys in %v", len(segments), len(db.index), time.Since(started))
+	return nil
+}
+
+// scanSegment reads the segment and finds where its complete records end.
+func (db *Db) scanSegment(path string) *scannedSegment {
+	s := &scannedSegment{path: path}
+	if s.number, s.err = segmentNumber(path); s.err != nil {
+		return s
+	}
+	if s.data, s.err = db.readSegment(path); s.err != nil {
+		return s
+	}
+	header, err := readSegmentHeader(bufio.NewReader(bytes.NewReader(s.data)))
+	if err == io.ErrUnexpectedEOF {
+		s.torn = true
+		return s
+	}
+	if err != nil {
+		s.err = fmt.Errorf("%w: %w", ErrCorrupted, err)
+		return s
+	}
+	if header != nil {
+		if s.err = header.check(path, s.number); s.err != nil {
+			return s
+		}
+		s.headerSize = segmentHeaderSize
+	}
+
+	s.end = s.headerSize
+	for rest := s.data[s.end:]; len(rest) > 0; rest = s.data[s.end:] {
+		if len(rest) < 4 {
+			s.torn = true
+			return s
+		}
+		size := int(binary.LittleEndian.Uint32(rest))
+		if size < 16 {
+			s.err = fmt.Errorf("%w: invalid record size %d", ErrCorrupted, size)
+			return s
+		}
+		if size > len(rest) {
+			s.torn = true
+			return s
+		}
+		s.end += int64(size)
+	}
+	return s
+}
+
+// readSegment reads the whole segment with a single allocation. Records are
+// sliced out of it instead of being copied one by one.
+func (db *Db) readSegment(path string) ([]byte, error) {
+	if isCompressed(path) {
+		return db.readCompressed(path)
+	}
+	f, err := openRead(db.fs, path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(f File) {
+		if err := f.Close(); err != nil {
+			fmt.Println(err)
+		}
+	}(f)
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, info.Size())
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// loadSegment applies the records of a scanned segment. The last segment is
+// opened for writing, and a header or a record cut short by a crash at its
+// end is dropped as if it was never written.
+func (db *Db) loadSegment(s *scannedSegment, isLastSegment bool) error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.torn && !isLastSegment {
+		return fmt.Errorf("%w: %w", ErrCorrupted, io.ErrUnexpectedEOF)
+	}
+	for pos := s.headerSize; pos < s.end; {
+		size := int64(binary.LittleEndian.Uint32(s.data[pos:]))
+		db.applyRecords(s.data[pos:pos+size], packOffset(s.number, pos))
+		pos += size
+	}
+	db.outOffset = s.end
+	if !isLastSegment {
+		return nil
+	}
+	if s.torn {
+		if err := db.fs.Truncate(s.path, s.end); err != nil {
+			return err
+		}
+	}
+	return db.prepareLastSegment(s.path, s.number)
+}
@@ -0,0 +1,144 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDb_Recovery_ManySegments(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string]string)
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key%d", i%37)
+		value := fmt.Sprintf("value%d", i)
+		if i%11 == 0 {
+			if err := db.Delete(key); err != nil {
+				t.Fatal(err)
+			}
+			delete(expected, key)
+			continue
+		}
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+		expected[key] = value
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if s := db.Stats(); s.Keys != len(expected) {
+		t.Fatalf("Expected %d keys, got %d", len(expected), s.Keys)
+	}
+	for key, value := range expected {
+		if got, err := db.Get(key); err != nil || got != value {
+			t.Errorf("Bad value returned for %s: %s (%v)", key, got, err)
+		}
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDb_Recovery_TornRecord(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record cut short is dropped from the last segment.
+	segments, err := filepath.Glob(filepath.Join(dir, outFileName+"-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last string
+	lastNumber := 0
+	for _, segment := range segments {
+		if n, _ := segmentNumber(segment); n > lastNumber {
+			last, lastNumber = segment, n
+		}
+	}
+	info, err := os.Stat(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(last, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key9"); err == nil {
+		t.Error("Expected the torn record to be dropped")
+	}
+	if value, err := db.Get("key0"); err != nil || value != "value" {
+		t.Errorf("Bad value returned: %s (%v)", value, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// In any other segment it is corruption.
+	first := filepath.Join(dir, outFileName+"-1")
+	info, err = os.Stat(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(first, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDb(dir, 100); err == nil || !strings.Contains(err.Error(), "corrupted file") {
+		t.Errorf("Expected a corrupted file error, got %v", err)
+	}
+}
+
+func BenchmarkDb_Recover(b *testing.B) {
+	dir := b.TempDir()
+	db, err := NewDb(dir, 64*1024)
+	if err != nil {
+		b.Fatal(err)
+	}
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 100000; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i%20000), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db, err := NewDb(dir, 64*1024)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		if err := db.Close(); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+}
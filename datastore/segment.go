@@ -0,0 +1,246 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Segment files start with a header:
+//
+//	magic(4)|format version(4)|creation time in unix nanoseconds(8)|segment id(8)
+//
+// Segments written before the header was introduced start with a record
+// right away. They are still read, and are rewritten with a header when they
+// are merged or upgraded with UpgradeSegments.
+//
+// Format 2 appends a version number to every record, see withVersion. Records
+// of earlier formats may have none and are numbered when they are read.
+const (
+	segmentMagic         = "KVSG"
+	segmentFormatVersion = 2
+	segmentHeaderSize    = 24
+)
+
+type segmentHeader struct {
+	version uint32
+	created time.Time
+	id      uint64
+}
+
+func encodeSegmentHeader(id int) []byte {
+	res := make([]byte, segmentHeaderSize)
+	copy(res, segmentMagic)
+	binary.LittleEndian.PutUint32(res[4:], segmentFormatVersion)
+	binary.LittleEndian.PutUint64(res[8:], uint64(time.Now().UnixNano()))
+	binary.LittleEndian.PutUint64(res[16:], uint64(id))
+	return res
+}
+
+// readSegmentHeader consumes the header of a segment. It returns nil for
+// empty segments and segments in the headerless format.
+func readSegmentHeader(in *bufio.Reader) (*segmentHeader, error) {
+	magic, err := in.Peek(len(segmentMagic))
+	if err == io.EOF && len(magic) == 0 {
+		return nil, nil
+	}
+	if string(magic) != segmentMagic[:len(magic)] {
+		return nil, nil
+	}
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, segmentHeaderSize)
+	if _, err := io.ReadFull(in, data); err != nil {
+		return nil, err
+	}
+	return &segmentHeader{
+		version: binary.LittleEndian.Uint32(data[4:]),
+		created: time.Unix(0, int64(binary.LittleEndian.Uint64(data[8:]))),
+		id:      binary.LittleEndian.Uint64(data[16:]),
+	}, nil
+}
+
+func (h *segmentHeader) check(segment string, fileNumber int) error {
+	if h.version > segmentFormatVersion {
+		return fmt.Errorf("%s: unsupported segment format version %d", segment, h.version)
+	}
+	if h.id != uint64(fileNumber) {
+		return fmt.Errorf("%s: header belongs to segment %d", segment, h.id)
+	}
+	return nil
+}
+
+// openSegment opens the segment for appending and writes the header if the
+// segment is empty. It returns the size of the header, which is 0 for
+// headerless segments.
+func openSegment(fsys FS, path string, id int) (File, int64, error) {
+	f, err := fsys.OpenFile(path, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+	if info.Size() == 0 {
+		if _, err := f.Write(encodeSegmentHeader(id)); err != nil {
+			// A part of the header may have been written.
+			_ = f.Truncate(0)
+			_ = f.Close()
+			return nil, 0, err
+		}
+		return f, segmentHeaderSize, nil
+	}
+	header, err := readSegmentHeader(bufio.NewReader(io.NewSectionReader(f, 0, segmentHeaderSize)))
+	if err != nil {
+		_ = f.Close()
+		return nil, 0, err
+	}
+	if header == nil {
+		return f, 0, nil
+	}
+	return f, segmentHeaderSize, nil
+}
+
+func segmentHeaderSizeOf(fsys FS, path string) int64 {
+	f, err := openRead(fsys, path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	header, err := readSegmentHeader(bufio.NewReader(io.NewSectionReader(f, 0, segmentHeaderSize)))
+	if err != nil || header == nil {
+		return 0
+	}
+	return segmentHeaderSize
+}
+
+// segmentNumber returns the number of the segment from its file name.
+func segmentNumber(path string) (int, error) {
+	name := strings.TrimSuffix(filepath.Base(path), compressedSuffix)
+	return strconv.Atoi(strings.TrimPrefix(name, outFileName+"-"))
+}
+
+// UpgradeSegments rewrites segments in dir written in an earlier format to
+// the current one. Records without a version number get the number the
+// database would give them when reading the segments in order. The database
+// must not be open while the segments are upgraded.
+func UpgradeSegments(dir string) error {
+	return upgradeSegments(OSFS, dir)
+}
+
+func upgradeSegments(fsys FS, dir string) error {
+	segments, err := fsys.Glob(filepath.Join(dir, outFileName+"-*"))
+	if err != nil {
+		return err
+	}
+	sortSegments(segments)
+	var sequence uint64
+	for _, segment := range segments {
+		id, err := segmentNumber(segment)
+		if err != nil {
+			continue
+		}
+		if sequence, err = upgradeSegment(fsys, segment, id, sequence); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upgradeSegment rewrites the segment if it is in an earlier format. It takes
+// and returns the last version number given in the preceding segments.
+func upgradeSegment(fsys FS, segment string, id int, sequence uint64) (uint64, error) {
+	in, err := openRead(fsys, segment)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	reader := bufio.NewReaderSize(in, bufSize)
+	header, err := readSegmentHeader(reader)
+	if err != nil {
+		return 0, err
+	}
+	if header != nil {
+		if err := header.check(segment, id); err != nil {
+			return 0, err
+		}
+	}
+	if header != nil && header.version == segmentFormatVersion {
+		// The segment is read only to carry the sequence on.
+		return numberSegment(reader, sequence, io.Discard)
+	}
+
+	tmpPath := filepath.Join(filepath.Dir(segment), "upgrade-"+strconv.Itoa(id))
+	out, err := fsys.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := out.Write(encodeSegmentHeader(id)); err != nil {
+		_ = out.Close()
+		return 0, err
+	}
+	// Records do not depend on their position in the file, so they are copied
+	// as is apart from the version numbers.
+	w := bufio.NewWriterSize(out, bufSize)
+	if sequence, err = numberSegment(reader, sequence, w); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		_ = out.Close()
+		return 0, err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		return 0, err
+	}
+	return sequence, fsys.Rename(tmpPath, segment)
+}
+
+// numberSegment copies the records to out, numbering those without a version
+// number. A record torn by a crash at the end is dropped.
+func numberSegment(in *bufio.Reader, sequence uint64, out io.Writer) (uint64, error) {
+	for {
+		data, err := readRecord(in)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sequence, nil
+		} else if err != nil {
+			return 0, err
+		}
+		data, sequence = numberRecords(data, sequence)
+		if _, err := out.Write(data); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// numberRecords numbers a record, or every record of a batch group, the same
+// way applyRecord does.
+func numberRecords(data []byte, sequence uint64) ([]byte, uint64) {
+	if recordType(data) == batchType {
+		var body []byte
+		for _, record := range splitBatch(data) {
+			record, sequence = numberRecords(record, sequence)
+			body = append(body, record...)
+		}
+		return (&entry[batchRecords]{value: body}).Encode(), sequence
+	}
+	if number, ok := recordVersion(data); ok {
+		return data, max(sequence, number)
+	}
+	return withVersion(data, sequence+1), sequence + 1
+}
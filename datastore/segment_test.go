@@ -0,0 +1,197 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeLegacySegment writes records in the format used before segments had a
+// header.
+func writeLegacySegment(t *testing.T, path string, pairs ...string) {
+	t.Helper()
+	var data []byte
+	for i := 0; i < len(pairs); i += 2 {
+		e := entry[string]{key: pairs[i], value: pairs[i+1]}
+		data = append(data, e.Encode()...)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func hasHeader(t *testing.T, path string) bool {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.HasPrefix(data, []byte(segmentMagic))
+}
+
+func TestDb_SegmentHeader(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segment := filepath.Join(dir, outFileName+"-1")
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasHeader(t, segment) {
+		t.Fatalf("Segment does not start with a header: %q", data[:segmentHeaderSize])
+	}
+	if version := binary.LittleEndian.Uint32(data[4:]); version != segmentFormatVersion {
+		t.Errorf("Unexpected format version %d", version)
+	}
+	if id := binary.LittleEndian.Uint64(data[16:]); id != 1 {
+		t.Errorf("Unexpected segment id %d", id)
+	}
+	created := time.Unix(0, int64(binary.LittleEndian.Uint64(data[8:])))
+	if time.Since(created) > time.Minute {
+		t.Errorf("Unexpected creation time %v", created)
+	}
+
+	binary.LittleEndian.PutUint32(data[4:], segmentFormatVersion+1)
+	if err := os.WriteFile(segment, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDb(dir, 1024); err == nil || !strings.Contains(err.Error(), "unsupported segment format version") {
+		t.Errorf("Expected an unsupported version error, got %v", err)
+	}
+}
+
+func TestDb_LegacySegments(t *testing.T) {
+	dir := t.TempDir()
+	writeLegacySegment(t, filepath.Join(dir, outFileName+"-1"), "key1", "value1", "key2", "value2")
+
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("key2"); err != nil || value != "value2" {
+		t.Errorf("Bad value returned from a legacy segment: %s (%v)", value, err)
+	}
+	if err := db.Put("key3", "value3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpgradeSegments(dir); err != nil {
+		t.Fatal(err)
+	}
+	if !hasHeader(t, filepath.Join(dir, outFileName+"-1")) {
+		t.Error("Segment was not upgraded")
+	}
+	db, err = NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for key, expected := range map[string]string{"key1": "value1", "key2": "value2", "key3": "value3"} {
+		if value, err := db.Get(key); err != nil || value != expected {
+			t.Errorf("Bad value returned after upgrade: %s (%v)", value, err)
+		}
+	}
+}
+
+func TestDb_LegacySegments_Merge(t *testing.T) {
+	dir := t.TempDir()
+	writeLegacySegment(t, filepath.Join(dir, outFileName+"-1"), "key1", "value1", "key2", "value2")
+	writeLegacySegment(t, filepath.Join(dir, outFileName+"-2"), "key1", "value3")
+
+	db, err := NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 4; i++ {
+		if err := db.Put("key3", "value3"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Stats().Merges == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if db.Stats().Merges == 0 {
+		t.Fatal("Segments were not merged")
+	}
+	if !hasHeader(t, filepath.Join(dir, outFileName+"-1")) {
+		t.Error("Merged segment has no header")
+	}
+	for key, expected := range map[string]string{"key1": "value3", "key2": "value2", "key3": "value3"} {
+		if value, err := db.Get(key); err != nil || value != expected {
+			t.Errorf("Bad value returned after merge: %s (%v)", value, err)
+		}
+	}
+}
+
+func TestUpgradeSegments_Versions(t *testing.T) {
+	dir := t.TempDir()
+	writeLegacySegment(t, filepath.Join(dir, outFileName+"-1"), "key1", "value1", "key2", "value2")
+	// Format 1 had a header, but its records had no version number.
+	data := encodeSegmentHeader(2)
+	binary.LittleEndian.PutUint32(data[4:], 1)
+	data = append(data, (&entry[string]{"key1", "value3"}).Encode()...)
+	if err := os.WriteFile(filepath.Join(dir, outFileName+"-2"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := UpgradeSegments(dir); err != nil {
+		t.Fatal(err)
+	}
+	var numbers []uint64
+	for _, name := range []string{outFileName + "-1", outFileName + "-2"} {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		in := bufio.NewReader(f)
+		header, err := readSegmentHeader(in)
+		if err != nil || header == nil || header.version != segmentFormatVersion {
+			t.Errorf("%s: unexpected header %+v (%v)", name, header, err)
+		}
+		for {
+			record, err := readRecord(in)
+			if err != nil {
+				break
+			}
+			number, ok := recordVersion(record)
+			if !ok {
+				t.Errorf("%s: record of %s has no version number", name, recordKey(record))
+			}
+			numbers = append(numbers, number)
+		}
+		_ = f.Close()
+	}
+	if !reflect.DeepEqual(numbers, []uint64{1, 2, 3}) {
+		t.Errorf("Unexpected version numbers %v", numbers)
+	}
+
+	db, err := NewDb(dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("key1"); err != nil || value != "value3" {
+		t.Errorf("Bad value returned after upgrade: %s (%v)", value, err)
+	}
+}
@@ -0,0 +1,346 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	sparseIndexInterval = 16
+	sstableFooterSize   = 16
+)
+
+type sparseEntry struct {
+	key    string
+	offset int64
+}
+
+// sstable is an immutable file of records sorted by key. The records are
+// followed by a sparse index (every sparseIndexInterval-th key with its
+// offset), the last key of the table and a fixed-size footer.
+type sstable struct {
+	fs      FS
+	path    string
+	id      int
+	size    int64
+	dataEnd int64
+	records int
+	index   []sparseEntry
+	lastKey string
+}
+
+func writeSSTable(fsys FS, path string, id int, it recordIterator, dropTombstones bool) (*sstable, error) {
+	tmpPath := path + ".tmp"
+	f, err := fsys.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	renamed := false
+	defer func() {
+		_ = f.Close()
+		if !renamed {
+			_ = fsys.Remove(tmpPath)
+		}
+	}()
+
+	t := &sstable{fs: fsys, path: path, id: id}
+	w := bufio.NewWriterSize(f, bufSize)
+	for it.next() {
+		record := it.record()
+		if dropTombstones && recordType(record) == tombstoneType {
+			continue
+		}
+		if t.records%sparseIndexInterval == 0 {
+			t.index = append(t.index, sparseEntry{key: it.key(), offset: t.dataEnd})
+		}
+		if _, err := w.Write(record); err != nil {
+			return nil, err
+		}
+		t.dataEnd += int64(len(record))
+		t.records++
+		t.lastKey = it.key()
+	}
+	if err := it.err(); err != nil {
+		return nil, err
+	}
+	if t.records == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, 12)
+	for _, se := range t.index {
+		binary.LittleEndian.PutUint32(buf, uint32(len(se.key)))
+		binary.LittleEndian.PutUint64(buf[4:], uint64(se.offset))
+		if _, err := w.Write(buf); err != nil {
+			return nil, err
+		}
+		if _, err := w.WriteString(se.key); err != nil {
+			return nil, err
+		}
+	}
+	binary.LittleEndian.PutUint32(buf, uint32(len(t.lastKey)))
+	if _, err := w.Write(buf[:4]); err != nil {
+		return nil, err
+	}
+	if _, err := w.WriteString(t.lastKey); err != nil {
+		return nil, err
+	}
+	footer := make([]byte, sstableFooterSize)
+	binary.LittleEndian.PutUint64(footer, uint64(t.dataEnd))
+	binary.LittleEndian.PutUint32(footer[8:], uint32(len(t.index)))
+	binary.LittleEndian.PutUint32(footer[12:], uint32(t.records))
+	if _, err := w.Write(footer); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	t.size = info.Size()
+	if err := fsys.Rename(tmpPath, path); err != nil {
+		return nil, err
+	}
+	renamed = true
+	return t, nil
+}
+
+func openSSTable(fsys FS, path string, id int) (*sstable, error) {
+	f, err := openRead(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < sstableFooterSize {
+		return nil, fmt.Errorf("corrupted sstable %s", path)
+	}
+	footer := make([]byte, sstableFooterSize)
+	if _, err := f.ReadAt(footer, info.Size()-sstableFooterSize); err != nil {
+		return nil, err
+	}
+	t := &sstable{
+		fs:      fsys,
+		path:    path,
+		id:      id,
+		size:    info.Size(),
+		dataEnd: int64(binary.LittleEndian.Uint64(footer)),
+		records: int(binary.LittleEndian.Uint32(footer[12:])),
+	}
+	if _, err := f.Seek(t.dataEnd, io.SeekStart); err != nil {
+		return nil, err
+	}
+	in := bufio.NewReader(io.LimitReader(f, info.Size()-sstableFooterSize-t.dataEnd))
+	buf := make([]byte, 12)
+	for i := 0; i < int(binary.LittleEndian.Uint32(footer[8:])); i++ {
+		if _, err := io.ReadFull(in, buf); err != nil {
+			return nil, fmt.Errorf("corrupted sstable %s: %w", path, err)
+		}
+		key := make([]byte, binary.LittleEndian.Uint32(buf))
+		if _, err := io.ReadFull(in, key); err != nil {
+			return nil, fmt.Errorf("corrupted sstable %s: %w", path, err)
+		}
+		t.index = append(t.index, sparseEntry{key: string(key), offset: int64(binary.LittleEndian.Uint64(buf[4:]))})
+	}
+	if _, err := io.ReadFull(in, buf[:4]); err != nil {
+		return nil, fmt.Errorf("corrupted sstable %s: %w", path, err)
+	}
+	lastKey := make([]byte, binary.LittleEndian.Uint32(buf))
+	if _, err := io.ReadFull(in, lastKey); err != nil {
+		return nil, fmt.Errorf("corrupted sstable %s: %w", path, err)
+	}
+	t.lastKey = string(lastKey)
+	return t, nil
+}
+
+// seekOffset returns the offset of the sparse index block that may contain key.
+func (t *sstable) seekOffset(key string) int64 {
+	i := sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].key > key
+	})
+	if i == 0 {
+		return 0
+	}
+	return t.index[i-1].offset
+}
+
+func (t *sstable) get(key string) ([]byte, error) {
+	if len(t.index) == 0 || key < t.index[0].key || key > t.lastKey {
+		return nil, ErrNotFound
+	}
+	it, err := t.iterator(key, "")
+	if err != nil {
+		return nil, err
+	}
+	defer it.close()
+	if it.next() && it.key() == key {
+		return it.record(), nil
+	}
+	if err := it.err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrNotFound
+}
+
+func (t *sstable) iterator(start, end string) (*tableIterator, error) {
+	f, err := openRead(t.fs, t.path)
+	if err != nil {
+		return nil, err
+	}
+	offset := t.seekOffset(start)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &tableIterator{
+		file:  f,
+		in:    bufio.NewReaderSize(io.LimitReader(f, t.dataEnd-offset), bufSize),
+		start: start,
+		end:   end,
+	}, nil
+}
+
+type recordIterator interface {
+	next() bool
+	key() string
+	record() []byte
+	err() error
+	close() error
+}
+
+type tableIterator struct {
+	file       File
+	in         *bufio.Reader
+	start, end string
+	curKey     string
+	curRecord  []byte
+	lastErr    error
+}
+
+func (it *tableIterator) next() bool {
+	for {
+		record, err := readRecord(it.in)
+		if err != nil {
+			if err != io.EOF {
+				it.lastErr = err
+			}
+			return false
+		}
+		key := recordKey(record)
+		if key < it.start {
+			continue
+		}
+		if it.end != "" && key >= it.end {
+			return false
+		}
+		it.curKey, it.curRecord = key, record
+		return true
+	}
+}
+
+func (it *tableIterator) key() string    { return it.curKey }
+func (it *tableIterator) record() []byte { return it.curRecord }
+func (it *tableIterator) err() error     { return it.lastErr }
+func (it *tableIterator) close() error   { return it.file.Close() }
+
+type memIterator struct {
+	keys    []string
+	records map[string][]byte
+	pos     int
+}
+
+func newMemIterator(memtable map[string][]byte, start, end string) *memIterator {
+	it := &memIterator{records: make(map[string][]byte), pos: -1}
+	for key, record := range memtable {
+		if inRange(key, start, end) {
+			it.keys = append(it.keys, key)
+			it.records[key] = record
+		}
+	}
+	sort.Strings(it.keys)
+	return it
+}
+
+func (it *memIterator) next() bool {
+	it.pos++
+	return it.pos < len(it.keys)
+}
+
+func (it *memIterator) key() string    { return it.keys[it.pos] }
+func (it *memIterator) record() []byte { return it.records[it.keys[it.pos]] }
+func (it *memIterator) err() error     { return nil }
+func (it *memIterator) close() error   { return nil }
+
+// mergeIterator yields records of several sorted sources in key order. When
+// a key is present in more than one source, the record of the source that
+// comes first in the list wins.
+type mergeIterator struct {
+	sources []recordIterator
+	valid   []bool
+	started bool
+	curKey  string
+	curRec  []byte
+	lastErr error
+}
+
+func newMergeIterator(sources []recordIterator) *mergeIterator {
+	return &mergeIterator{sources: sources, valid: make([]bool, len(sources))}
+}
+
+func (it *mergeIterator) next() bool {
+	if !it.started {
+		it.started = true
+		for i, src := range it.sources {
+			it.advance(i, src)
+		}
+	}
+	best := -1
+	for i := range it.sources {
+		if it.valid[i] && (best == -1 || it.sources[i].key() < it.sources[best].key()) {
+			best = i
+		}
+	}
+	if best == -1 || it.lastErr != nil {
+		return false
+	}
+	it.curKey, it.curRec = it.sources[best].key(), it.sources[best].record()
+	for i, src := range it.sources {
+		if it.valid[i] && src.key() == it.curKey {
+			it.advance(i, src)
+		}
+	}
+	return true
+}
+
+func (it *mergeIterator) advance(i int, src recordIterator) {
+	it.valid[i] = src.next()
+	if err := src.err(); err != nil && it.lastErr == nil {
+		it.lastErr = err
+	}
+}
+
+func (it *mergeIterator) key() string    { return it.curKey }
+func (it *mergeIterator) record() []byte { return it.curRec }
+func (it *mergeIterator) err() error     { return it.lastErr }
+
+func (it *mergeIterator) close() error {
+	var err error
+	for _, src := range it.sources {
+		if cerr := src.close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package datastore
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestSSTable_WriteOpen(t *testing.T) {
+	memtable := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		e := entry[int64]{fmt.Sprintf("key-%03d", i), int64(i)}
+		memtable[e.key] = e.Encode()
+	}
+	path := filepath.Join(t.TempDir(), "sst-1")
+	if _, err := writeSSTable(OSFS, path, 1, newMemIterator(memtable, "", ""), false); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := openSSTable(OSFS, path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.records != 100 || len(table.index) != 100/sparseIndexInterval+1 || table.lastKey != "key-099" {
+		t.Errorf("Unexpected table metadata: %d records, %d index entries, last key %s",
+			table.records, len(table.index), table.lastKey)
+	}
+
+	for i := 0; i < 100; i++ {
+		record, err := table.get(fmt.Sprintf("key-%03d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, err := recordValue(record); err != nil || v != int64(i) {
+			t.Errorf("Bad value returned for key-%03d: %v (%v)", i, v, err)
+		}
+	}
+	if _, err := table.get("key-100"); err != ErrNotFound {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	it, err := table.iterator("key-040", "key-045")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer it.close()
+	var n int
+	for it.next() {
+		if it.key() != fmt.Sprintf("key-%03d", 40+n) {
+			t.Errorf("Unexpected key %s", it.key())
+		}
+		n++
+	}
+	if n != 5 {
+		t.Errorf("Unexpected number of iterated records: %d", n)
+	}
+}
+
+func TestMergeIterator(t *testing.T) {
+	newer := map[string][]byte{"a": (&entry[string]{"a", "new"}).Encode()}
+	older := map[string][]byte{
+		"a": (&entry[string]{"a", "old"}).Encode(),
+		"b": (&entry[string]{"b", "old"}).Encode(),
+	}
+	it := newMergeIterator([]recordIterator{newMemIterator(newer, "", ""), newMemIterator(older, "", "")})
+	var res []string
+	for it.next() {
+		v, _ := recordValue(it.record())
+		res = append(res, it.key()+"="+v.(string))
+	}
+	if fmt.Sprint(res) != "[a=new b=old]" {
+		t.Errorf("Unexpected merge result %v", res)
+	}
+}
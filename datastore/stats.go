@@ -0,0 +1,173 @@
+package datastore
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var latencyBuckets = []time.Duration{
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+type Histogram struct {
+	Buckets []time.Duration
+	Counts  []uint64
+	Count   uint64
+	Sum     time.Duration
+}
+
+type Stats struct {
+	Keys         int
+	Segments     int
+	SegmentBytes int64
+	// ColdSegments is the number of segments moved to Options.ColdDir. They
+	// are included in Segments and SegmentBytes.
+	ColdSegments int
+	DeadBytes    int64
+	Blobs        int
+	BlobBytes    int64
+	Merges       uint64
+	// Evictions is the number of keys evicted by a database used as a cache.
+	Evictions     uint64
+	MergeDuration time.Duration
+	Reads         Histogram
+	Writes        Histogram
+	// Buckets holds the stats of named buckets. Keys of the default bucket are
+	// only counted in the totals.
+	Buckets map[string]BucketStats
+}
+
+type latencyRecorder struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+}
+
+func newLatencyRecorder() *latencyRecorder {
+	return &latencyRecorder{counts: make([]uint64, len(latencyBuckets))}
+}
+
+func (lr *latencyRecorder) observe(d time.Duration) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	for i, bound := range latencyBuckets {
+		if d <= bound {
+			lr.counts[i]++
+		}
+	}
+	lr.count++
+	lr.sum += d
+}
+
+func (lr *latencyRecorder) snapshot() Histogram {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	counts := make([]uint64, len(lr.counts))
+	copy(counts, lr.counts)
+	return Histogram{
+		Buckets: latencyBuckets,
+		Counts:  counts,
+		Count:   lr.count,
+		Sum:     lr.sum,
+	}
+}
+
+// statsSnapshot is what Stats takes from the monitor. The monitor keeps the
+// counters up to date as records are applied, and the files are inspected by
+// the caller, so that a scrape does not hold up other operations.
+type statsSnapshot struct {
+	stats     Stats
+	liveBytes int64
+	blobs     []string
+}
+
+func (db *Db) Stats() Stats {
+	ctx := context.Background()
+	reply := make(chan statsSnapshot, 1)
+	if err := request(ctx, db, db.statsCh, reply); err != nil {
+		return Stats{}
+	}
+	snapshot, err := await(ctx, reply)
+	if err != nil {
+		return Stats{}
+	}
+	s := snapshot.stats
+	// Headers are neither live nor dead data, so they are counted as live to
+	// keep them out of DeadBytes.
+	liveBytes := snapshot.liveBytes
+	segments, err := db.getAllSegments()
+	if err == nil {
+		s.Segments = len(segments)
+		for _, segment := range segments {
+			if info, err := db.fs.Stat(segment); err == nil {
+				s.SegmentBytes += info.Size()
+				liveBytes += segmentHeaderSizeOf(db.fs, segment)
+			}
+		}
+	}
+	for _, name := range snapshot.blobs {
+		if info, err := db.fs.Stat(filepath.Join(db.dir, name)); err == nil {
+			s.Blobs++
+			s.BlobBytes += info.Size()
+		}
+	}
+	if s.SegmentBytes > liveBytes {
+		s.DeadBytes = s.SegmentBytes - liveBytes
+	}
+	return s
+}
+
+func (db *Db) collectStats() statsSnapshot {
+	buckets := make(map[string]BucketStats, len(db.buckets))
+	for name, bs := range db.buckets {
+		buckets[name] = bs
+	}
+	blobs := make([]string, 0, len(db.blobRefs))
+	for name := range db.blobRefs {
+		blobs = append(blobs, name)
+	}
+	return statsSnapshot{
+		stats: Stats{
+			Keys:          len(db.index),
+			Merges:        db.merges,
+			Evictions:     db.evictions(),
+			ColdSegments:  len(db.cold),
+			MergeDuration: db.mergeDuration,
+			Reads:         db.readLatency.snapshot(),
+			Writes:        db.writeLatency.snapshot(),
+			Buckets:       buckets,
+		},
+		liveBytes: db.liveBytes,
+		blobs:     blobs,
+	}
+}
+
+// countKey updates the live data counters when the current record of a key
+// is added, replaced or forgotten. keys is the change in the number of keys.
+func (db *Db) countKey(key string, keys int, bytes int64) {
+	db.liveBytes += bytes
+	name, _, ok := strings.Cut(key, bucketSeparator)
+	if !ok {
+		return
+	}
+	bs := db.buckets[name]
+	bs.Keys += keys
+	bs.Bytes += bytes
+	if bs.Keys == 0 {
+		delete(db.buckets, name)
+		return
+	}
+	db.buckets[name] = bs
+}
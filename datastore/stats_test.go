@@ -0,0 +1,67 @@
+package datastore
+
+import (
+	"testing"
+)
+
+func TestDb_Stats(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"key1", "key2", "key1"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Get("key1"); err != nil {
+		t.Fatal(err)
+	}
+
+	s := db.Stats()
+	if s.Keys != 2 {
+		t.Errorf("Unexpected number of keys: %d", s.Keys)
+	}
+	if s.Segments != 1 {
+		t.Errorf("Unexpected number of segments: %d", s.Segments)
+	}
+	recordSize := int64(len(withVersion((&entry[string]{"key1", "value"}).Encode(), 1)))
+	if s.SegmentBytes != segmentHeaderSize+3*recordSize {
+		t.Errorf("Unexpected segment bytes: %d", s.SegmentBytes)
+	}
+	if s.DeadBytes != recordSize {
+		t.Errorf("Unexpected dead bytes: %d", s.DeadBytes)
+	}
+	if s.Writes.Count != 3 {
+		t.Errorf("Unexpected number of writes: %d", s.Writes.Count)
+	}
+	if s.Reads.Count != 1 {
+		t.Errorf("Unexpected number of reads: %d", s.Reads.Count)
+	}
+}
+
+func TestDb_Stats_Versions(t *testing.T) {
+	db, err := NewDbWithOptions(t.TempDir(), Options{SegmentSize: 1024, Versions: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	recordSize := int64(len(withVersion((&entry[string]{"key1", "value"}).Encode(), 1)))
+	for i, dead := range []int64{0, 0, recordSize, 2 * recordSize} {
+		if err := db.Put("key1", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if s := db.Stats(); s.DeadBytes != dead {
+			t.Errorf("Write %d: expected %d dead bytes, got %d", i+1, dead, s.DeadBytes)
+		}
+	}
+	if err := db.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	if s := db.Stats(); s.Keys != 0 || s.DeadBytes != s.SegmentBytes-segmentHeaderSize {
+		t.Errorf("Expected every record to be dead, got %d keys and %d of %d bytes", s.Keys, s.DeadBytes, s.SegmentBytes)
+	}
+}
@@ -0,0 +1,343 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// compressedSuffix ends the names of cold segments compressed as a whole.
+const compressedSuffix = ".gz"
+
+// Sealed segments are checked for being old enough to move at least this
+// often, in addition to every time a new segment is created.
+const maxTierCheckInterval = time.Minute
+
+// moveState reports the segments a move has put into the cold directory,
+// mapping their numbers to their new paths.
+type moveState struct {
+	moved map[int]string
+	err   error
+}
+
+// compressedCacheSize is the number of decompressed cold segments kept in
+// memory.
+const compressedCacheSize = 4
+
+// compressedSegments keeps the content of the compressed cold segments read
+// last, since a compressed segment can only be read from the start. The most
+// recently read segment is at the front of order.
+type compressedSegments struct {
+	mu    sync.Mutex
+	order *list.List
+	elems map[string]*list.Element
+}
+
+type decompressedSegment struct {
+	path string
+	data []byte
+}
+
+func (c *compressedSegments) get(path string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.elems[path]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*decompressedSegment).data, true
+}
+
+func (c *compressedSegments) add(path string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.order == nil {
+		c.order = list.New()
+		c.elems = make(map[string]*list.Element)
+	}
+	if elem, ok := c.elems[path]; ok {
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.elems[path] = c.order.PushFront(&decompressedSegment{path: path, data: data})
+	if c.order.Len() > compressedCacheSize {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.elems, last.Value.(*decompressedSegment).path)
+	}
+}
+
+func isCompressed(path string) bool {
+	return strings.HasSuffix(path, compressedSuffix)
+}
+
+func (db *Db) coldSegmentPath(n int) string {
+	path := filepath.Join(db.opts.ColdDir, outFileName+"-"+strconv.Itoa(n))
+	if db.opts.CompressCold {
+		path += compressedSuffix
+	}
+	return path
+}
+
+func tierCheckInterval(age time.Duration) time.Duration {
+	return max(min(age, maxTierCheckInterval), 10*time.Millisecond)
+}
+
+// completeMove cleans up after a move interrupted by a crash. A cold segment
+// is renamed in place once it is complete, so a segment found in both
+// directories is removed from the hot one.
+func (db *Db) completeMove() error {
+	if db.opts.ColdDir == "" {
+		return nil
+	}
+	temp := filepath.Join(db.opts.ColdDir, tempFileName)
+	if err := db.fs.Remove(temp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	cold, err := db.listSegments(db.opts.ColdDir)
+	if err != nil {
+		return err
+	}
+	for _, segment := range cold {
+		n, err := segmentNumber(segment)
+		if err != nil {
+			continue
+		}
+		if err := db.fs.Remove(db.segmentPath(n)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		db.cold[n] = segment
+	}
+	return nil
+}
+
+// defineSegmentsToMove returns the sealed hot segments last written before
+// ColdAge. Segments are moved in order, so that the cold segments are always
+// older than the hot ones.
+func (db *Db) defineSegmentsToMove() ([]string, error) {
+	segments, err := db.listSegments(db.dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	for _, segment := range segments {
+		n, err := segmentNumber(segment)
+		if err != nil || n >= db.fileNumber {
+			break
+		}
+		if _, ok := db.cold[n]; ok {
+			// The copy in the hot directory was not removed after the move.
+			continue
+		}
+		info, err := db.fs.Stat(segment)
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(info.ModTime()) < db.opts.ColdAge {
+			break
+		}
+		res = append(res, segment)
+	}
+	return res, nil
+}
+
+// startMoveProcess moves old segments to the cold directory in the
+// background. Moves and merges do not run at the same time, so that a merge
+// never reads a segment being moved.
+func (db *Db) startMoveProcess() error {
+	if db.opts.ColdDir == "" || db.mergingSegments != nil || db.movingSegments != nil {
+		return nil
+	}
+	segments, err := db.defineSegmentsToMove()
+	if err != nil || len(segments) == 0 {
+		return err
+	}
+	db.movingSegments = segments
+	db.mergeWg.Add(1)
+	go func() {
+		defer db.mergeWg.Done()
+		state := db.moveSegments(db.mergeCtx, segments)
+		select {
+		case db.finishMoveCh <- state:
+		case <-db.mergeCtx.Done():
+		}
+	}()
+	return nil
+}
+
+func (db *Db) moveSegments(ctx context.Context, segments []string) moveState {
+	state := moveState{moved: make(map[int]string, len(segments))}
+	for _, segment := range segments {
+		if state.err = ctx.Err(); state.err != nil {
+			return state
+		}
+		n, err := segmentNumber(segment)
+		if err != nil {
+			state.err = err
+			return state
+		}
+		path := db.coldSegmentPath(n)
+		if state.err = db.copyToCold(segment, path); state.err != nil {
+			return state
+		}
+		state.moved[n] = path
+	}
+	return state
+}
+
+// copyToCold writes a copy of the segment to path. The directories may be on
+// different file systems, so the segment is copied rather than renamed.
+func (db *Db) copyToCold(segment, path string) (err error) {
+	in, err := openRead(db.fs, segment)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	temp := filepath.Join(db.opts.ColdDir, tempFileName)
+	out, err := db.fs.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = out.Close()
+			_ = db.fs.Remove(temp)
+		}
+	}()
+	if db.opts.CompressCold {
+		zw := gzip.NewWriter(out)
+		if _, err = io.Copy(zw, in); err != nil {
+			return err
+		}
+		if err = zw.Close(); err != nil {
+			return err
+		}
+	} else if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return db.fs.Rename(temp, path)
+}
+
+// finishMovingSegments switches reads of the moved segments to the cold
+// directory and removes them from the hot one.
+func (db *Db) finishMovingSegments(state moveState) error {
+	db.movingSegments = nil
+	db.filesMu.Lock()
+	defer db.filesMu.Unlock()
+	err := state.err
+	for n, path := range state.moved {
+		db.cold[n] = path
+		// A segment left behind is removed on the next start.
+		if removeErr := db.fs.Remove(db.segmentPath(n)); removeErr != nil {
+			err = errors.Join(err, removeErr)
+		}
+	}
+	return err
+}
+
+// segmentReader returns a reader of the segment positioned at position. The
+// segment is read from the cold directory if it has been moved there.
+func (db *Db) segmentReader(fileNumber int, position int64) (*bufio.Reader, io.Closer, error) {
+	path, cold := db.cold[fileNumber]
+	if !cold {
+		path = db.segmentPath(fileNumber)
+	}
+	if cold && isCompressed(path) {
+		data, err := db.readCompressed(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if position > int64(len(data)) {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		r := bytes.NewReader(data[position:])
+		return bufio.NewReader(r), io.NopCloser(r), nil
+	}
+	file, err := openRead(db.fs, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = file.Seek(position, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, nil, err
+	}
+	return bufio.NewReader(file), file, nil
+}
+
+// readCompressed returns the decompressed content of a cold segment. The lock
+// is not held while decompressing, so reads of cached segments go on.
+func (db *Db) readCompressed(path string) ([]byte, error) {
+	if data, ok := db.compressed.get(path); ok {
+		return data, nil
+	}
+	f, err := openRead(db.fs, path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	db.compressed.add(path, data)
+	return data, nil
+}
+
+// copyDeletions appends the tombstones held by the segment to out and
+// returns the number of bytes written.
+func copyDeletions(fsys FS, segment string, out File) (int64, error) {
+	in, err := openRead(fsys, segment)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	reader := bufio.NewReaderSize(in, bufSize)
+	if _, err := readSegmentHeader(reader); err != nil {
+		return 0, err
+	}
+	var written int64
+	for {
+		data, err := readRecord(reader)
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		records := [][]byte{data}
+		if recordType(data) == batchType {
+			records = splitBatch(data)
+		}
+		for _, record := range records {
+			switch recordType(record) {
+			case tombstoneType, rangeTombstoneType, dropBucketType:
+				n, err := out.Write(record)
+				written += int64(n)
+				if err != nil {
+					return written, err
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func waitForColdSegments(t *testing.T, db *Db) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Stats().ColdSegments == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("No segments were moved to the cold directory")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDb_Tier(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			dir, coldDir := t.TempDir(), t.TempDir()
+			opts := Options{SegmentSize: 256, ColdDir: coldDir, ColdAge: 20 * time.Millisecond, CompressCold: compress}
+			db, err := NewDbWithOptions(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := make(map[string]string)
+			for i := 0; i < 50; i++ {
+				key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+				if err := db.Put(key, value); err != nil {
+					t.Fatal(err)
+				}
+				expected[key] = value
+			}
+			waitForColdSegments(t, db)
+
+			check := func() {
+				t.Helper()
+				for key, value := range expected {
+					if got, err := db.Get(key); err != nil || got != value {
+						t.Errorf("Bad value returned for %s: %s (%v)", key, got, err)
+					}
+				}
+			}
+			check()
+			cold, err := filepath.Glob(filepath.Join(coldDir, outFileName+"-*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, segment := range cold {
+				if compress != isCompressed(segment) {
+					t.Errorf("Unexpected cold segment %s", segment)
+				}
+				n, _ := segmentNumber(segment)
+				if _, err := os.Stat(db.segmentPath(n)); !os.IsNotExist(err) {
+					t.Errorf("Segment %d is in both directories", n)
+				}
+			}
+
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			db, err = NewDbWithOptions(dir, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			check()
+			if s := db.Stats(); s.Keys != len(expected) || s.ColdSegments < len(cold) {
+				t.Errorf("Unexpected stats %+v", s)
+			}
+		})
+	}
+}
+
+func TestDb_Tier_Deletions(t *testing.T) {
+	dir, coldDir := t.TempDir(), t.TempDir()
+	opts := Options{SegmentSize: 256, ColdDir: coldDir, ColdAge: 20 * time.Millisecond}
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(0, 20)
+	waitForColdSegments(t, db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Merges of the hot segments keep the tombstones of keys that are still
+	// in the cold segments.
+	opts.ColdAge = time.Hour
+	db, err = NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DeletePrefix("key1"); err != nil {
+		t.Fatal(err)
+	}
+	put(20, 60)
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Stats().Merges == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if db.Stats().Merges == 0 {
+		t.Fatal("The hot segments were not merged")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, key := range []string{"key0", "key1", "key10", "key19"} {
+		if _, err := db.Get(key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected %s to stay deleted, got %v", key, err)
+		}
+	}
+	for _, key := range []string{"key2", "key9", "key20", "key59"} {
+		if _, err := db.Get(key); err != nil {
+			t.Errorf("Unexpected error for %s: %v", key, err)
+		}
+	}
+}
+
+func TestDb_Tier_InterruptedMove(t *testing.T) {
+	dir, coldDir := t.TempDir(), t.TempDir()
+	opts := Options{SegmentSize: 256, ColdDir: coldDir, ColdAge: time.Hour}
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash after the cold copy of a segment is complete leaves the segment
+	// in both directories, and a crash before that leaves a temp file.
+	data, err := os.ReadFile(db.segmentPath(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(coldDir, outFileName+"-1"), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(coldDir, tempFileName), data[:10], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := os.Stat(db.segmentPath(1)); !os.IsNotExist(err) {
+		t.Errorf("Expected the hot copy to be removed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(coldDir, tempFileName)); !os.IsNotExist(err) {
+		t.Errorf("Expected the temp file to be removed, got %v", err)
+	}
+	if s := db.Stats(); s.Keys != 20 || s.ColdSegments != 1 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+}
+
+func TestDb_Tier_SameDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewDbWithOptions(dir, Options{ColdDir: dir + "/"}); err == nil {
+		t.Error("Expected an error for the cold directory equal to the database directory")
+	}
+}
+
+func TestCompressedSegments(t *testing.T) {
+	var c compressedSegments
+	for i := 1; i <= compressedCacheSize; i++ {
+		c.add(fmt.Sprintf("segment-%d", i), []byte{byte(i)})
+	}
+	// Reading segment-1 makes segment-2 the least recently read one.
+	if data, ok := c.get("segment-1"); !ok || data[0] != 1 {
+		t.Errorf("Expected segment-1 to be cached, got %v", data)
+	}
+	c.add("segment-new", []byte{0})
+	if _, ok := c.get("segment-2"); ok {
+		t.Error("Expected segment-2 to be dropped")
+	}
+	for _, path := range []string{"segment-1", "segment-3", "segment-new"} {
+		if _, ok := c.get(path); !ok {
+			t.Errorf("Expected %s to be cached", path)
+		}
+	}
+}
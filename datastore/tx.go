@@ -0,0 +1,153 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	ErrConflict = fmt.Errorf("transaction conflict")
+	ErrTxDone   = fmt.Errorf("transaction has already been committed")
+)
+
+// Tx is an optimistic transaction. Reads remember the version of every key
+// they observe, writes are buffered, and Commit applies the writes as a single
+// batch only if none of the read keys has changed in the meantime.
+type Tx struct {
+	db     *Db
+	reads  map[string]uint64
+	writes map[string]any
+	batch  Batch
+	done   bool
+}
+
+type commitRequest struct {
+	reads   map[string]uint64
+	records [][]byte
+	reply   chan error
+}
+
+func (db *Db) Begin() *Tx {
+	return &Tx{
+		db:     db,
+		reads:  make(map[string]uint64),
+		writes: make(map[string]any),
+	}
+}
+
+// GetWithVersion returns the value of the key together with its version,
+// which can be passed to Tx.Expect by clients that read outside a transaction.
+// Versions are never reused, not even by a key that is deleted and written
+// again, so a matching version means the key has not been written since.
+func (db *Db) GetWithVersion(key string) (any, uint64, error) {
+	return db.get(context.Background(), key)
+}
+
+func (tx *Tx) get(key string) (any, error) {
+	if value, ok := tx.writes[key]; ok {
+		if _, deleted := value.(tombstone); deleted {
+			return nil, ErrNotFound
+		}
+		return value, nil
+	}
+	value, version, err := tx.db.get(context.Background(), key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if _, ok := tx.reads[key]; !ok {
+		tx.reads[key] = version
+	}
+	return value, err
+}
+
+func (tx *Tx) Get(key string) (string, error) {
+	value, err := tx.get(key)
+	if err != nil {
+		return "", err
+	}
+	stringValue, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%w: string", ErrTypeMismatch)
+	}
+	return stringValue, nil
+}
+
+func (tx *Tx) GetInt64(key string) (int64, error) {
+	value, err := tx.get(key)
+	if err != nil {
+		return 0, err
+	}
+	int64Value, ok := value.(int64)
+	if !ok {
+		return 0, fmt.Errorf("%w: int64", ErrTypeMismatch)
+	}
+	return int64Value, nil
+}
+
+// Expect adds the key to the read set as if it was read at the given version.
+// Version 0 stands for a key that does not exist.
+func (tx *Tx) Expect(key string, version uint64) {
+	tx.reads[key] = version
+}
+
+func (tx *Tx) Put(key, value string) {
+	tx.writes[key] = value
+	tx.batch.Put(key, value)
+}
+
+func (tx *Tx) PutInt64(key string, value int64) {
+	tx.writes[key] = value
+	tx.batch.PutInt64(key, value)
+}
+
+func (tx *Tx) Delete(key string) {
+	tx.writes[key] = tombstone{}
+	tx.batch.Delete(key)
+}
+
+func (tx *Tx) Commit() error {
+	return tx.CommitContext(context.Background())
+}
+
+func (tx *Tx) CommitContext(ctx context.Context) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	records, err := tx.batch.encode(tx.db.opts)
+	if err != nil {
+		return err
+	}
+	reply := make(chan error, 1)
+	if err := request(ctx, tx.db, tx.db.commitCh, commitRequest{reads: tx.reads, records: records, reply: reply}); err != nil {
+		return err
+	}
+	err, ctxErr := await(ctx, reply)
+	if ctxErr != nil {
+		return ctxErr
+	}
+	tx.done = true
+	return err
+}
+
+// commit validates the read set against the current versions and writes the
+// records of the transaction. Both happen in OperationMonitor, so no other
+// write can slip in between.
+func (db *Db) commit(reads map[string]uint64, records [][]byte) error {
+	keys := make([]string, 0, len(reads))
+	for key := range reads {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if db.versions[key] != reads[key] {
+			return fmt.Errorf("%w: key %s was changed to version %d after version %d was read",
+				ErrConflict, key, db.versions[key], reads[key])
+		}
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	return db.writeBatch(records)
+}
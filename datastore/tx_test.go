@@ -0,0 +1,203 @@
+package datastore
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTx_Commit(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.PutInt64("from", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutInt64("to", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := db.Begin()
+	from, err := tx.GetInt64("from")
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := tx.GetInt64("to")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.PutInt64("from", from-30)
+	tx.PutInt64("to", to+30)
+	if value, err := tx.GetInt64("from"); err != nil || value != 70 {
+		t.Errorf("Transaction does not see its own write: %d (%v)", value, err)
+	}
+	if value, _ := db.GetInt64("from"); value != 100 {
+		t.Errorf("Uncommitted write is visible: %d", value)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := db.GetInt64("from"); value != 70 {
+		t.Errorf("Bad value returned: %d", value)
+	}
+	if value, _ := db.GetInt64("to"); value != 40 {
+		t.Errorf("Bad value returned: %d", value)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Errorf("Expected ErrTxDone, got %v", err)
+	}
+}
+
+func TestTx_Conflict(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("key", "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := db.Begin()
+	if _, err := tx.Get("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	tx.Put("other", "value")
+	if err := db.Put("key", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+	if _, err := db.Get("other"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Write of a conflicting transaction is visible (%v)", err)
+	}
+
+	tx = db.Begin()
+	if _, err := tx.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound, got %v", err)
+	}
+	tx.Put("missing", "created")
+	if err := db.Put("missing", "concurrent"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict for a key created concurrently, got %v", err)
+	}
+}
+
+func TestTx_Expect(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("key", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	_, version, err := db.GetWithVersion("key")
+	if err != nil || version != 1 {
+		t.Fatalf("Unexpected version %d (%v)", version, err)
+	}
+
+	tx := db.Begin()
+	tx.Expect("key", version)
+	tx.Put("key", "v2")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tx = db.Begin()
+	tx.Expect("key", version)
+	tx.Put("key", "v3")
+	if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+	if value, _ := db.Get("key"); value != "v2" {
+		t.Errorf("Bad value returned: %s", value)
+	}
+}
+
+func TestTx_Expect_Deleted(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("key", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	_, version, err := db.GetWithVersion("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "v2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key was written again after the read, so the version is stale even
+	// though the key has been written the same number of times.
+	tx := db.Begin()
+	tx.Expect("key", version)
+	tx.Put("key", "v3")
+	if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+	if value, _ := db.Get("key"); value != "v2" {
+		t.Errorf("Bad value returned: %s", value)
+	}
+}
+
+func TestTx_Expect_Merged(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Merges drop the key together with its deletions.
+	var version uint64
+	for deadline := time.Now().Add(5 * time.Second); db.Stats().Merges == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("Segments were not merged")
+		}
+		if err := db.Put("key", "v1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, version, err = db.GetWithVersion("key"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete("key"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Put("key", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, current, err := db.GetWithVersion("key"); err != nil || current <= version {
+		t.Errorf("Version %d was given after version %d (%v)", current, version, err)
+	}
+	tx := db.Begin()
+	tx.Expect("key", version)
+	tx.Put("key", "v3")
+	if err := tx.Commit(); !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+}
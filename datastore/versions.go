@@ -0,0 +1,109 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+)
+
+type Version struct {
+	Number uint64
+	Value  any
+}
+
+type version struct {
+	number uint64
+	offset int64
+	size   int64
+	blob   string
+}
+
+type historyRequest struct {
+	key   string
+	reply chan []version
+}
+
+// pushHistory retains the current record of the key before it is replaced,
+// keeping at most opts.Versions-1 previous versions.
+func (db *Db) pushHistory(key string, offset int64) {
+	h := append(db.history[key], version{
+		number: db.versions[key],
+		offset: offset,
+		size:   db.sizes[key],
+		blob:   db.blobs[key],
+	})
+	db.refBlob(db.blobs[key], 1)
+	db.liveBytes += db.sizes[key]
+	if excess := len(h) - (db.opts.Versions - 1); excess > 0 {
+		for _, v := range h[:excess] {
+			db.refBlob(v.blob, -1)
+			db.liveBytes -= v.size
+		}
+		h = h[excess:]
+	}
+	db.history[key] = h
+}
+
+func (db *Db) versionsOf(key string) []version {
+	offset, ok := db.index[key]
+	if !ok {
+		return nil
+	}
+	res := append([]version(nil), db.history[key]...)
+	return append(res, version{number: db.versions[key], offset: offset})
+}
+
+// readVersions reads the values of retained versions of the key.
+func (db *Db) readVersions(key string, keep func(v version) bool) ([]Version, error) {
+	ctx := context.Background()
+	var versions []version
+	var res []Version
+	err := db.readConsistent(func() error {
+		reply := make(chan []version, 1)
+		if err := request(ctx, db, db.historyCh, historyRequest{key: key, reply: reply}); err != nil {
+			return err
+		}
+		var err error
+		versions, err = await(ctx, reply)
+		return err
+	}, func() error {
+		res = nil
+		for _, v := range versions {
+			if !keep(v) {
+				continue
+			}
+			value, err := db.readValueAt(v.offset)
+			if err != nil {
+				return err
+			}
+			res = append(res, Version{Number: v.number, Value: value})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+	return res, nil
+}
+
+// History returns retained versions of the key from the oldest to the current one.
+func (db *Db) History(key string) ([]Version, error) {
+	return db.readVersions(key, func(version) bool {
+		return true
+	})
+}
+
+func (db *Db) GetVersion(key string, number uint64) (any, error) {
+	res, err := db.readVersions(key, func(v version) bool {
+		return v.number == number
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("%w: version %d of %s is not retained", ErrNotFound, number, key)
+	}
+	return res[0].Value, nil
+}
@@ -0,0 +1,79 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func checkHistory(t *testing.T, db *Db, key string, expected []Version) {
+	t.Helper()
+	history, err := db.History(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(history, expected) {
+		t.Errorf("Unexpected history of %s: %v", key, history)
+	}
+}
+
+func TestDb_Versions(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{SegmentSize: 100, Versions: 3}
+	db, err := NewDbWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 6; i++ {
+		if err := db.Put("key", fmt.Sprintf("v%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []Version{{4, "v4"}, {5, "v5"}, {6, "v6"}}
+	checkHistory(t, db, "key", expected)
+
+	if value, err := db.GetVersion("key", 5); err != nil || value != "v5" {
+		t.Errorf("Bad value of version 5: %v (%v)", value, err)
+	}
+	if _, err := db.GetVersion("key", 2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if _, err := db.History("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	t.Run("merge", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			if err := db.PutInt64(fmt.Sprintf("other%d", i), int64(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for deadline := time.Now().Add(5 * time.Second); db.Stats().Merges == 0; {
+			if time.Now().After(deadline) {
+				t.Fatal("Segments were not merged")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		checkHistory(t, db, "key", expected)
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDbWithOptions(dir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		checkHistory(t, db, "key", expected)
+		if err := db.Put("key", "v7"); err != nil {
+			t.Fatal(err)
+		}
+		// Version numbers are shared by all keys, the writes of other keys
+		// have used the numbers after 6.
+		checkHistory(t, db, "key", []Version{{5, "v5"}, {6, "v6"}, {27, "v7"}})
+	})
+}
@@ -0,0 +1,381 @@
+// Package dbclient is a client of the HTTP API served by cmd/db.
+package dbclient
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTimeout = 3 * time.Second
+	DefaultRetries = 3
+	DefaultBackoff = 100 * time.Millisecond
+
+	// maxBackoff limits the delay between two attempts.
+	maxBackoff = 5 * time.Second
+	// maxErrorSize limits the part of an error response kept in StatusError.
+	maxErrorSize = 1024
+)
+
+var (
+	// ErrNotFound is returned when the database holds no value for the key.
+	ErrNotFound = errors.New("key not found")
+	// ErrTypeMismatch is returned when the value of the key has another type
+	// than the one requested.
+	ErrTypeMismatch = errors.New("value has another type")
+)
+
+// StatusError is returned when the database responds with an unexpected
+// status code. Code and Message come from the JSON error of the response.
+type StatusError struct {
+	Method     string
+	Key        string
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s %s: unexpected status %d", e.Method, e.Key, e.StatusCode)
+	}
+	return fmt.Sprintf("%s %s: unexpected status %d: %s", e.Method, e.Key, e.StatusCode, e.Message)
+}
+
+// temporary reports whether the request may succeed if it is repeated.
+func (e *StatusError) temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+type Options struct {
+	// Timeout limits a single attempt of a request. Defaults to
+	// DefaultTimeout.
+	Timeout time.Duration
+	// Retries is the number of times a request is repeated after a network
+	// error or a server error. Defaults to DefaultRetries, a negative value
+	// disables retries.
+	Retries int
+	// Backoff is the delay before the first retry, doubled before every next
+	// one. Defaults to DefaultBackoff.
+	Backoff time.Duration
+	// Transport sends the requests. Defaults to a transport that keeps idle
+	// connections to the database for reuse.
+	Transport http.RoundTripper
+	// APIKey is sent as a bearer token with every request when the database
+	// requires authentication.
+	APIKey string
+}
+
+// Client reads and writes the keys of a database. It is safe for concurrent
+// use and reuses connections between requests.
+type Client struct {
+	base    string
+	client  *http.Client
+	retries int
+	backoff time.Duration
+	apiKey  string
+}
+
+// New returns a client of the database served at base, e.g.
+// http://database:8080.
+func New(base string, opts Options) *Client {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.Retries == 0 {
+		opts.Retries = DefaultRetries
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = DefaultBackoff
+	}
+	if opts.Transport == nil {
+		opts.Transport = &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost: 64,
+			IdleConnTimeout:     90 * time.Second,
+		}
+	}
+	return &Client{
+		base:    strings.TrimSuffix(base, "/"),
+		client:  &http.Client{Timeout: opts.Timeout, Transport: opts.Transport},
+		retries: max(opts.Retries, 0),
+		backoff: opts.Backoff,
+		apiKey:  opts.APIKey,
+	}
+}
+
+type errorResponseBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type valueBody struct {
+	Value any `json:"value"`
+}
+
+type opBody struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value any    `json:"value,omitempty"`
+}
+
+type batchBody struct {
+	Ops      []opBody `json:"ops"`
+	Encoding string   `json:"encoding"`
+}
+
+type txBody struct {
+	Reads    map[string]uint64 `json:"reads"`
+	Writes   []opBody          `json:"writes"`
+	Encoding string            `json:"encoding"`
+}
+
+// Keys and string values of scans, batches and transactions are sent base64
+// encoded, JSON strings cannot hold bytes that are not valid UTF-8.
+const encodingBase64 = "base64"
+
+func encodeBase64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// encodeValue encodes the value of a put for a batch or a transaction.
+func encodeValue(value any) any {
+	if s, ok := value.(string); ok {
+		return encodeBase64(s)
+	}
+	return value
+}
+
+// Get returns the string value of the key.
+func (c *Client) Get(key string) (string, error) {
+	var value string
+	err := c.get(key, "string", &value)
+	return value, err
+}
+
+// GetInt64 returns the int64 value of the key.
+func (c *Client) GetInt64(key string) (int64, error) {
+	var value int64
+	err := c.get(key, "int64", &value)
+	return value, err
+}
+
+func (c *Client) Put(key, value string) error {
+	return c.put(key, value)
+}
+
+func (c *Client) PutInt64(key string, value int64) error {
+	return c.put(key, value)
+}
+
+// PutIfAbsent sets the key to value, a string or an int64, unless the key
+// already holds a value, and reports whether it did.
+func (c *Client) PutIfAbsent(key string, value any) (bool, error) {
+	body, err := json.Marshal(txBody{
+		Reads:    map[string]uint64{encodeBase64(key): 0},
+		Writes:   []opBody{{Op: "put", Key: encodeBase64(key), Value: encodeValue(value)}},
+		Encoding: encodingBase64,
+	})
+	if err != nil {
+		return false, err
+	}
+	_, err = c.do(http.MethodPost, key, c.base+"/db/_tx", body, http.StatusCreated)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.Code == "conflict" {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete deletes the key. Deleting a key that holds no value is not an
+// error.
+func (c *Client) Delete(key string) error {
+	body, err := json.Marshal(batchBody{Ops: []opBody{{Op: "delete", Key: encodeBase64(key)}}, Encoding: encodingBase64})
+	if err != nil {
+		return err
+	}
+	_, err = c.do(http.MethodPost, key, c.base+"/db/_batch", body, http.StatusCreated)
+	return err
+}
+
+// KeyValue is a key with its value, a string or an int64.
+type KeyValue struct {
+	Key   string
+	Value any
+}
+
+// Scan returns up to limit keys from start up to end, an empty end standing
+// for the end of the key space, with their values in the order of the keys.
+// A limit of 0 returns every key of the range. Pages of a large range are
+// read by starting the next scan at NextKey of the last key returned.
+func (c *Client) Scan(start, end string, limit int) ([]KeyValue, error) {
+	query := url.Values{"start": {start}, "end": {end}, "limit": {strconv.Itoa(limit)}, "encoding": {encodingBase64}}
+	body, err := c.do(http.MethodGet, "_scan", c.base+"/db/_scan?"+query.Encode(), nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	var kvs []KeyValue
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	for dec.More() {
+		var line struct {
+			Key   string `json:"key"`
+			Value any    `json:"value"`
+			Type  string `json:"type"`
+			Error *struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := dec.Decode(&line); err != nil {
+			return nil, fmt.Errorf("GET _scan: %w", err)
+		}
+		if line.Error != nil {
+			return nil, &StatusError{Method: http.MethodGet, Key: "_scan", StatusCode: http.StatusOK, Code: line.Error.Code, Message: line.Error.Message}
+		}
+		kv, err := decodeLine(line.Key, line.Value, line.Type)
+		if err != nil {
+			return nil, fmt.Errorf("GET _scan: %w", err)
+		}
+		kvs = append(kvs, kv)
+	}
+	return kvs, nil
+}
+
+// decodeLine decodes a line of a scan in the base64 encoding.
+func decodeLine(key string, value any, valueType string) (KeyValue, error) {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return KeyValue{}, fmt.Errorf("invalid key %q: %w", key, err)
+	}
+	kv := KeyValue{Key: string(k)}
+	n, isNumber := value.(json.Number)
+	s, isString := value.(string)
+	switch {
+	case valueType == "int64" && isNumber:
+		kv.Value, err = n.Int64()
+	case valueType == "string" && isString:
+		var v []byte
+		v, err = base64.StdEncoding.DecodeString(s)
+		kv.Value = string(v)
+	default:
+		err = fmt.Errorf("unexpected value of type %s", valueType)
+	}
+	if err != nil {
+		return KeyValue{}, fmt.Errorf("%s: %w", kv.Key, err)
+	}
+	return kv, nil
+}
+
+// NextKey returns the smallest key greater than key.
+func NextKey(key string) string {
+	return key + "\x00"
+}
+
+// Close closes the idle connections of the client.
+func (c *Client) Close() {
+	c.client.CloseIdleConnections()
+}
+
+func (c *Client) keyURL(key string) string {
+	return c.base + "/db/" + url.PathEscape(key)
+}
+
+func (c *Client) get(key, valueType string, value any) error {
+	u := c.keyURL(key) + "?type=" + valueType
+	body, err := c.do(http.MethodGet, key, u, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, &valueBody{Value: value}); err != nil {
+		return fmt.Errorf("GET %s: %w", key, err)
+	}
+	return nil
+}
+
+func (c *Client) put(key string, value any) error {
+	body, err := json.Marshal(valueBody{Value: value})
+	if err != nil {
+		return err
+	}
+	_, err = c.do(http.MethodPost, key, c.keyURL(key), body, http.StatusCreated)
+	return err
+}
+
+// do sends the request until it succeeds, fails with an error that
+// repeating it would not fix, or runs out of retries, and returns the body of
+// the response. Puts, deletes and scans are idempotent, and a repeated
+// PutIfAbsent reports a conflict at worst, so every request may be repeated.
+func (c *Client) do(method, key, u string, body []byte, expected int) ([]byte, error) {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		res, err := c.attempt(method, key, u, body, expected)
+		if err == nil {
+			return res, nil
+		}
+		var statusErr *StatusError
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrTypeMismatch) ||
+			(errors.As(err, &statusErr) && !statusErr.temporary()) || attempt == c.retries {
+			return nil, err
+		}
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+func (c *Client) attempt(method, key, u string, body []byte, expected int) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	res, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == expected {
+		return res, nil
+	}
+	statusErr := &StatusError{Method: method, Key: key, StatusCode: resp.StatusCode}
+	var eb errorResponseBody
+	if json.Unmarshal(res, &eb) == nil && eb.Error.Code != "" {
+		statusErr.Code, statusErr.Message = eb.Error.Code, eb.Error.Message
+	} else {
+		if len(res) > maxErrorSize {
+			res = res[:maxErrorSize]
+		}
+		statusErr.Message = strings.TrimSpace(string(res))
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%s %s: %w", method, key, ErrNotFound)
+	case statusErr.Code == "type_mismatch":
+		return nil, fmt.Errorf("%s %s: %w", method, key, ErrTypeMismatch)
+	}
+	return nil, statusErr
+}
@@ -0,0 +1,221 @@
+package dbclient
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDb serves the key routes of cmd/db from a map.
+type fakeDb struct {
+	mu     sync.Mutex
+	values map[string]any
+}
+
+func (f *fakeDb) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.EscapedPath(), "/db/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case "GET":
+		v, ok := f.values[key]
+		_, isInt := v.(int64)
+		if !ok {
+			http.Error(rw, "no value found for key "+key, http.StatusNotFound)
+			return
+		}
+		if isInt != (r.URL.Query().Get("type") == "int64") {
+			rw.WriteHeader(http.StatusConflict)
+			_, _ = rw.Write([]byte(`{"error":{"code":"type_mismatch","message":"value does not match expected type","key":"` + key + `"}}`))
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(map[string]any{"key": key, "value": v})
+	case "POST":
+		var body struct {
+			Value any `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(rw, "json decoding error", http.StatusBadRequest)
+			return
+		}
+		if n, ok := body.Value.(float64); ok {
+			body.Value = int64(n)
+		}
+		f.values[key] = body.Value
+		rw.WriteHeader(http.StatusCreated)
+	}
+}
+
+func TestClient(t *testing.T) {
+	srv := httptest.NewServer(&fakeDb{values: make(map[string]any)})
+	defer srv.Close()
+	c := New(srv.URL+"/", Options{})
+	defer c.Close()
+
+	if err := c.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PutInt64("key2", -42); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Get("key1"); err != nil || v != "value1" {
+		t.Errorf("Bad value returned: %s (%v)", v, err)
+	}
+	if v, err := c.GetInt64("key2"); err != nil || v != -42 {
+		t.Errorf("Bad value returned: %d (%v)", v, err)
+	}
+	if _, err := c.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := c.Get("key2"); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("Expected ErrTypeMismatch, got %v", err)
+	}
+}
+
+func TestClient_Retries(t *testing.T) {
+	var attempts atomic.Int32
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			http.Error(rw, "busy", status)
+			return
+		}
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+	c := New(srv.URL, Options{Backoff: time.Millisecond})
+	defer c.Close()
+
+	if err := c.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if attempts.Load() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts.Load())
+	}
+
+	// Client errors are not retried.
+	attempts.Store(0)
+	status = http.StatusBadRequest
+	var statusErr *StatusError
+	if err := c.Put("key", "value"); !errors.As(err, &statusErr) || statusErr.StatusCode != status || statusErr.Message != "busy" {
+		t.Errorf("Expected a status error, got %v", err)
+	}
+	if attempts.Load() != 1 {
+		t.Errorf("Expected 1 attempt, got %d", attempts.Load())
+	}
+
+	// Requests fail once the retries run out.
+	attempts.Store(-10)
+	status = http.StatusInternalServerError
+	c = New(srv.URL, Options{Retries: 2, Backoff: time.Millisecond})
+	if err := c.Put("key", "value"); !errors.As(err, &statusErr) || statusErr.StatusCode != status {
+		t.Errorf("Expected a status error, got %v", err)
+	}
+	if attempts.Load() != -7 {
+		t.Errorf("Expected 3 attempts, got %d", attempts.Load()+10)
+	}
+}
+
+func TestClient_Timeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(done)
+	c := New(srv.URL, Options{Timeout: 20 * time.Millisecond, Retries: -1})
+	defer c.Close()
+
+	start := time.Now()
+	if _, err := c.Get("key"); err == nil {
+		t.Error("Expected a timeout error")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Request was not limited by the timeout")
+	}
+}
+
+func TestClient_APIKey(t *testing.T) {
+	var auth atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		auth.Store(r.Header.Get("Authorization"))
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+	c := New(srv.URL, Options{APIKey: "secret"})
+	defer c.Close()
+
+	if err := c.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if auth.Load() != "Bearer secret" {
+		t.Errorf("Unexpected Authorization header %q", auth.Load())
+	}
+}
+
+func TestClient_Scan(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/db/_scan" || query.Get("start") != "a" || query.Get("limit") != "2" || query.Get("encoding") != "base64" {
+			http.Error(rw, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		// a1 holds bytes that are not valid UTF-8.
+		_, _ = rw.Write([]byte(`{"key":"YTE=","value":"dv8=","type":"string"}` + "\n" + `{"key":"YTI=","value":9007199254740993,"type":"int64"}` + "\n"))
+	}))
+	defer srv.Close()
+	c := New(srv.URL, Options{})
+	defer c.Close()
+
+	kvs, err := c.Scan("a", "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []KeyValue{{"a1", "v\xff"}, {"a2", int64(9007199254740993)}}
+	if len(kvs) != 2 || kvs[0] != expected[0] || kvs[1] != expected[1] {
+		t.Errorf("Unexpected keys %+v", kvs)
+	}
+}
+
+func TestClient_PutIfAbsent(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		if strings.Contains(body, "dGFrZW4=") {
+			rw.WriteHeader(http.StatusConflict)
+			_, _ = rw.Write([]byte(`{"error":{"code":"conflict","message":"transaction conflict"}}`))
+			return
+		}
+		rw.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+	c := New(srv.URL, Options{})
+	defer c.Close()
+
+	if ok, err := c.PutIfAbsent("free", int64(1)); !ok || err != nil {
+		t.Errorf("Expected the key to be set, got %t (%v)", ok, err)
+	}
+	if body != `{"reads":{"ZnJlZQ==":0},"writes":[{"op":"put","key":"ZnJlZQ==","value":1}],"encoding":"base64"}` {
+		t.Errorf("Unexpected body %s", body)
+	}
+	if ok, err := c.PutIfAbsent("taken", "v"); ok || err != nil {
+		t.Errorf("Expected the key to be kept, got %t (%v)", ok, err)
+	}
+	if err := c.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if body != `{"ops":[{"op":"delete","key":"a2V5"}],"encoding":"base64"}` {
+		t.Errorf("Unexpected body %s", body)
+	}
+}